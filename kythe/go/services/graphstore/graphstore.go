@@ -104,12 +104,7 @@ func BatchWrites(entries <-chan *spb.Entry, maxSize int) <-chan *spb.WriteReques
 		defer close(ch)
 		var req *spb.WriteRequest
 		for entry := range entries {
-			update := &spb.WriteRequest_Update{
-				EdgeKind:  entry.EdgeKind,
-				Target:    entry.Target,
-				FactName:  entry.FactName,
-				FactValue: entry.FactValue,
-			}
+			update := writeUpdate(entry)
 
 			if req != nil && (!compare.VNamesEqual(req.Source, entry.Source) || len(req.Update) >= maxSize) {
 				ch <- req
@@ -132,6 +127,109 @@ func BatchWrites(entries <-chan *spb.Entry, maxSize int) <-chan *spb.WriteReques
 	return ch
 }
 
+// BatchWrite writes the given entries to gs.  Consecutive entries with the same
+// Source will be collected in the same WriteRequest, with each request
+// containing up to batchSize updates.  If batchSize <= 0, requests are only
+// split on Source boundaries.
+func BatchWrite(ctx context.Context, gs Service, entries []*spb.Entry, batchSize int) error {
+	var req *spb.WriteRequest
+	for _, entry := range entries {
+		if req != nil && (!compare.VNamesEqual(req.Source, entry.Source) || (batchSize > 0 && len(req.Update) >= batchSize)) {
+			if err := gs.Write(ctx, req); err != nil {
+				return err
+			}
+			req = nil
+		}
+
+		if req == nil {
+			req = &spb.WriteRequest{Source: entry.Source}
+		}
+		req.Update = append(req.Update, writeUpdate(entry))
+	}
+	if req != nil {
+		return gs.Write(ctx, req)
+	}
+	return nil
+}
+
+func writeUpdate(e *spb.Entry) *spb.WriteRequest_Update {
+	return &spb.WriteRequest_Update{
+		EdgeKind:  e.EdgeKind,
+		Target:    e.Target,
+		FactName:  e.FactName,
+		FactValue: e.FactValue,
+	}
+}
+
+// GroupEntriesBySource splits entries into groups of consecutive entries
+// sharing the same Source.  The entries must be in GraphStore order so that
+// all entries for a Source are adjacent.  Each group is a sub-slice of entries;
+// nothing is copied.
+func GroupEntriesBySource(entries []*spb.Entry) [][]*spb.Entry {
+	var groups [][]*spb.Entry
+	start := 0
+	for i := 1; i <= len(entries); i++ {
+		if i == len(entries) || !compare.VNamesEqual(entries[start].Source, entries[i].Source) {
+			groups = append(groups, entries[start:i:i])
+			start = i
+		}
+	}
+	return groups
+}
+
+// EntryFilter returns a function that returns the entries satisfying pred, in
+// their original order.  The given slice is not modified.
+func EntryFilter(pred func(*spb.Entry) bool) func([]*spb.Entry) []*spb.Entry {
+	return func(entries []*spb.Entry) []*spb.Entry {
+		var res []*spb.Entry
+		for _, e := range entries {
+			if pred(e) {
+				res = append(res, e)
+			}
+		}
+		return res
+	}
+}
+
+// EdgeKindFilter returns a predicate matching edge entries with one of the
+// given kinds.
+func EdgeKindFilter(kinds ...string) func(*spb.Entry) bool {
+	set := make(map[string]bool, len(kinds))
+	for _, kind := range kinds {
+		set[kind] = true
+	}
+	return func(e *spb.Entry) bool { return IsEdge(e) && set[e.EdgeKind] }
+}
+
+// FactNameFilter returns a predicate matching fact entries with one of the
+// given names.
+func FactNameFilter(names ...string) func(*spb.Entry) bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return func(e *spb.Entry) bool { return IsFact(e) && set[e.FactName] }
+}
+
+// CorpusFilter returns a predicate matching entries whose Source is in the
+// given corpus.
+func CorpusFilter(corpus string) func(*spb.Entry) bool {
+	return func(e *spb.Entry) bool { return e.Source.GetCorpus() == corpus }
+}
+
+// AndFilter returns a predicate matching entries satisfying each of the given
+// predicates.
+func AndFilter(preds ...func(*spb.Entry) bool) func(*spb.Entry) bool {
+	return func(e *spb.Entry) bool {
+		for _, pred := range preds {
+			if !pred(e) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
 // ValidEntry determines if the given Entry is correctly constructed.
 func ValidEntry(e *spb.Entry) error {
 	if e.Source == nil {
@@ -154,6 +252,11 @@ func IsNodeFact(e *spb.Entry) bool { return e.EdgeKind == "" }
 // IsEdge determines if the Entry describes an edge; implies !IsNodeFact(e).
 func IsEdge(e *spb.Entry) bool { return e.EdgeKind != "" }
 
+// IsFact determines if the Entry describes a fact rather than an edge; it is
+// the complement of IsEdge.  An Entry with an empty EdgeKind is a fact
+// regardless of its Target.  IsFact is equivalent to IsNodeFact.
+func IsFact(e *spb.Entry) bool { return !IsEdge(e) }
+
 type grpcClient struct{ sspb.GraphStoreClient }
 
 // Read implements part of Service interface.
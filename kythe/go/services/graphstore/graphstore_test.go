@@ -0,0 +1,214 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func TestIsFact(t *testing.T) {
+	src := &spb.VName{Signature: "source"}
+	tests := []struct {
+		entry *spb.Entry
+		fact  bool
+	}{
+		{&spb.Entry{Source: src, FactName: "/kythe/node/kind"}, true},
+		{&spb.Entry{Source: src, EdgeKind: "/kythe/edge/childof", Target: src, FactName: "/"}, false},
+		// An empty EdgeKind denotes a fact, even with a Target.
+		{&spb.Entry{Source: src, Target: src, FactName: "/kythe/node/kind"}, true},
+	}
+	for _, test := range tests {
+		if found := IsFact(test.entry); found != test.fact {
+			t.Errorf("IsFact(%v) = %v; want %v", test.entry, found, test.fact)
+		}
+		if IsFact(test.entry) == IsEdge(test.entry) {
+			t.Errorf("IsFact(%v) == IsEdge(%v)", test.entry, test.entry)
+		}
+	}
+}
+
+func TestGroupEntriesBySource(t *testing.T) {
+	v1 := &spb.VName{Signature: "v1"}
+	v2 := &spb.VName{Signature: "v2"}
+	v3 := &spb.VName{Signature: "v3"}
+	entries := []*spb.Entry{
+		{Source: v1, FactName: "/kythe/node/kind"},
+		{Source: &spb.VName{Signature: "v1"}, FactName: "/kythe/text"},
+		{Source: v2, FactName: "/kythe/node/kind"},
+		{Source: v3, EdgeKind: "/kythe/edge/childof", Target: v1, FactName: "/"},
+		{Source: v3, FactName: "/kythe/node/kind"},
+	}
+
+	groups := GroupEntriesBySource(entries)
+	if len(groups) != 3 {
+		t.Fatalf("Expected 3 groups; found %d: %v", len(groups), groups)
+	}
+	for i, expected := range [][]*spb.Entry{entries[0:2], entries[2:3], entries[3:5]} {
+		if len(groups[i]) != len(expected) {
+			t.Errorf("Group %d: expected %d entries; found %d", i, len(expected), len(groups[i]))
+			continue
+		}
+		for j := range expected {
+			if groups[i][j] != expected[j] {
+				t.Errorf("Group %d: expected entry %v; found %v", i, expected[j], groups[i][j])
+			}
+		}
+	}
+
+	if groups := GroupEntriesBySource(nil); len(groups) != 0 {
+		t.Errorf("Expected no groups for empty input; found %v", groups)
+	}
+}
+
+func TestEntryFilters(t *testing.T) {
+	v1 := &spb.VName{Corpus: "c1", Signature: "v1"}
+	v2 := &spb.VName{Corpus: "c2", Signature: "v2"}
+	entries := []*spb.Entry{
+		{Source: v1, FactName: "/kythe/node/kind"},
+		{Source: v1, FactName: "/kythe/text"},
+		{Source: v1, EdgeKind: "/kythe/edge/childof", Target: v2, FactName: "/"},
+		{Source: v2, EdgeKind: "/kythe/edge/ref", Target: v1, FactName: "/"},
+		{Source: v2, FactName: "/kythe/node/kind"},
+	}
+
+	tests := []struct {
+		name     string
+		pred     func(*spb.Entry) bool
+		expected []*spb.Entry
+	}{
+		{"EdgeKindFilter", EdgeKindFilter("/kythe/edge/ref", "/kythe/node/kind"), []*spb.Entry{entries[3]}},
+		{"FactNameFilter", FactNameFilter("/kythe/node/kind", "/"), []*spb.Entry{entries[0], entries[4]}},
+		{"CorpusFilter", CorpusFilter("c1"), entries[0:3]},
+		{"AndFilter", AndFilter(CorpusFilter("c2"), FactNameFilter("/kythe/node/kind")), []*spb.Entry{entries[4]}},
+		{"AndFilter()", AndFilter(), entries},
+	}
+	for _, test := range tests {
+		found := EntryFilter(test.pred)(entries)
+		if len(found) != len(test.expected) {
+			t.Errorf("%s: expected %v; found %v", test.name, test.expected, found)
+			continue
+		}
+		for i := range found {
+			if found[i] != test.expected[i] {
+				t.Errorf("%s: expected %v; found %v", test.name, test.expected, found)
+				break
+			}
+		}
+	}
+}
+
+// recordingService is a Service that records each WriteRequest and fails
+// after failAfter successful writes (if failAfter >= 0).
+type recordingService struct {
+	Service
+
+	writes    []*spb.WriteRequest
+	failAfter int
+}
+
+var errWrite = errors.New("write error")
+
+// Write implements part of the Service interface.
+func (s *recordingService) Write(_ context.Context, req *spb.WriteRequest) error {
+	if s.failAfter >= 0 && len(s.writes) >= s.failAfter {
+		return errWrite
+	}
+	s.writes = append(s.writes, req)
+	return nil
+}
+
+func TestBatchWrite(t *testing.T) {
+	v1 := &spb.VName{Signature: "v1"}
+	v2 := &spb.VName{Signature: "v2"}
+	entries := []*spb.Entry{
+		{Source: v1, FactName: "/kythe/node/kind"},
+		{Source: v1, FactName: "/kythe/text"},
+		{Source: v1, FactName: "/kythe/text/encoding"},
+		{Source: v1, EdgeKind: "/kythe/edge/childof", Target: v2, FactName: "/"},
+		{Source: v1, FactName: "/kythe/loc/start"},
+		{Source: v2, FactName: "/kythe/node/kind"},
+	}
+
+	tests := []struct {
+		batchSize int
+		sizes     []int
+	}{
+		// Full batches of 2, a final partial batch for v1, and a new batch for v2.
+		{2, []int{2, 2, 1, 1}},
+		{3, []int{3, 2, 1}},
+		{5, []int{5, 1}},
+		// Non-positive batch sizes only split on Source boundaries.
+		{0, []int{5, 1}},
+		{-1, []int{5, 1}},
+	}
+
+	ctx := context.Background()
+	for _, test := range tests {
+		gs := &recordingService{failAfter: -1}
+		if err := BatchWrite(ctx, gs, entries, test.batchSize); err != nil {
+			t.Errorf("BatchWrite(%d) error: %v", test.batchSize, err)
+			continue
+		}
+
+		if len(gs.writes) != len(test.sizes) {
+			t.Errorf("BatchWrite(%d): expected %d writes; found %d: %v", test.batchSize, len(test.sizes), len(gs.writes), gs.writes)
+			continue
+		}
+		var i int
+		for j, req := range gs.writes {
+			if len(req.Update) != test.sizes[j] {
+				t.Errorf("BatchWrite(%d): write %d: expected %d updates; found %d", test.batchSize, j, test.sizes[j], len(req.Update))
+				continue
+			}
+			for _, u := range req.Update {
+				if e := entries[i]; req.Source != e.Source || u.FactName != e.FactName || u.EdgeKind != e.EdgeKind || u.Target != e.Target {
+					t.Errorf("BatchWrite(%d): write %d: expected update for %v; found %v %v", test.batchSize, j, e, req.Source, u)
+				}
+				i++
+			}
+		}
+	}
+
+	if err := BatchWrite(ctx, &recordingService{failAfter: -1}, nil, 2); err != nil {
+		t.Errorf("BatchWrite error for empty input: %v", err)
+	}
+}
+
+func TestBatchWriteError(t *testing.T) {
+	v1 := &spb.VName{Signature: "v1"}
+	entries := []*spb.Entry{
+		{Source: v1, FactName: "/kythe/node/kind"},
+		{Source: v1, FactName: "/kythe/text"},
+		{Source: v1, FactName: "/kythe/text/encoding"},
+	}
+
+	ctx := context.Background()
+	// Fail on an intermediate write and on the final partial write.
+	for _, failAfter := range []int{0, 1} {
+		gs := &recordingService{failAfter: failAfter}
+		if err := BatchWrite(ctx, gs, entries, 2); err != errWrite {
+			t.Errorf("BatchWrite (failAfter=%d): expected error %v; found %v", failAfter, errWrite, err)
+		}
+		if len(gs.writes) != failAfter {
+			t.Errorf("BatchWrite (failAfter=%d): expected %d writes; found %d", failAfter, failAfter, len(gs.writes))
+		}
+	}
+}
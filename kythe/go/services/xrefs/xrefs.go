@@ -598,6 +598,14 @@ func (n *Normalizer) Location(loc *xpb.Location) (*xpb.Location, error) {
 	return nl, nil
 }
 
+// LineCount returns the number of lines in the Normalizer's text.  A trailing
+// newline begins a final (empty) line, matching the LineNumber of a normalized
+// point at the end of the text.
+func (n *Normalizer) LineCount() int { return len(n.lineLen) }
+
+// IsEOF reports whether offset is at or past the end of the Normalizer's text.
+func (n *Normalizer) IsEOF(offset int32) bool { return offset >= n.textLen }
+
 var lineEnd = []byte("\n")
 
 // Point returns a normalized point within the Normalizer's text.  A normalized
@@ -653,6 +661,20 @@ func (n *Normalizer) ByteOffset(offset int32) *xpb.Location_Point {
 	return np
 }
 
+// ByteRange returns the normalized points for the given span of byte offsets
+// within the Normalizer's text.  An error is returned if the span is crossed or
+// not entirely within the text.
+func (n *Normalizer) ByteRange(start, end int32) (sp, ep *xpb.Location_Point, err error) {
+	if end > n.textLen {
+		return nil, nil, fmt.Errorf("span past EOF %d: [%d, %d)", n.textLen, start, end)
+	} else if start < 0 {
+		return nil, nil, fmt.Errorf("negative span: [%d, %d)", start, end)
+	} else if start > end {
+		return nil, nil, fmt.Errorf("crossed span: [%d, %d)", start, end)
+	}
+	return n.ByteOffset(start), n.ByteOffset(end), nil
+}
+
 // ConvertFilters converts each filter glob into an equivalent regexp.
 func ConvertFilters(filters []string) []*regexp.Regexp {
 	var patterns []*regexp.Regexp
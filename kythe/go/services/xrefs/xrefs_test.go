@@ -154,6 +154,35 @@ last line without newline`
 	}
 }
 
+func TestNormalizerLines(t *testing.T) {
+	tests := []struct {
+		text  string
+		lines int
+	}{
+		{"", 1},
+		{"line", 1},
+		{"line\n", 2},
+		{"line 1\nline 2", 2},
+		{"line 1\nline 2\n", 3},
+	}
+	for _, test := range tests {
+		n := NewNormalizer([]byte(test.text))
+		if found := n.LineCount(); found != test.lines {
+			t.Errorf("NewNormalizer(%q).LineCount(): expected %d; found %d", test.text, test.lines, found)
+		}
+		end := int32(len(test.text))
+		if p := n.ByteOffset(end); int(p.LineNumber) != n.LineCount() {
+			t.Errorf("NewNormalizer(%q): EOF on line %d; LineCount() = %d", test.text, p.LineNumber, n.LineCount())
+		}
+		if !n.IsEOF(end) || !n.IsEOF(end+1) {
+			t.Errorf("NewNormalizer(%q).IsEOF(%d) = false", test.text, end)
+		}
+		if end > 0 && n.IsEOF(end-1) {
+			t.Errorf("NewNormalizer(%q).IsEOF(%d) = true", test.text, end-1)
+		}
+	}
+}
+
 func TestPatcher(t *testing.T) {
 	tests := []struct {
 		oldText, newText string
@@ -502,3 +531,24 @@ func TestSlowDocumentation(t *testing.T) {
 		}
 	}
 }
+
+func TestNormalizerByteRange(t *testing.T) {
+	n := NewNormalizer([]byte("line 1\nline 2\n"))
+
+	sp, ep, err := n.ByteRange(2, 9)
+	if err != nil {
+		t.Fatalf("ByteRange(2, 9): unexpected error: %v", err)
+	}
+	if expected := n.ByteOffset(2); !proto.Equal(sp, expected) {
+		t.Errorf("ByteRange(2, 9): expected start {%v}; found {%v}", expected, sp)
+	}
+	if expected := n.ByteOffset(9); !proto.Equal(ep, expected) {
+		t.Errorf("ByteRange(2, 9): expected end {%v}; found {%v}", expected, ep)
+	}
+
+	for _, span := range [][2]int32{{-1, 2}, {5, 2}, {2, 15}} {
+		if sp, ep, err := n.ByteRange(span[0], span[1]); err == nil {
+			t.Errorf("ByteRange(%d, %d): expected error; found {%v} {%v}", span[0], span[1], sp, ep)
+		}
+	}
+}
@@ -71,6 +71,11 @@ type Options struct {
 	// IOBufferSize is the size of the reading/writing buffers for the temporary
 	// file shards.
 	IOBufferSize int
+
+	// Validate determines whether each Source is checked with
+	// assemble.ValidateSource.  If set, the pipeline fails after logging the
+	// errors of the first invalid Source.
+	Validate bool
 }
 
 func (o *Options) diskSorter(l sortutil.Lesser, m disksort.Marshaler) (disksort.Interface, error) {
@@ -178,6 +183,14 @@ func combineNodesAndEdges(ctx context.Context, opts *Options, out *servingOutput
 
 	bIdx := out.idx.Buffered()
 	if err := assemble.Sources(rd, func(src *ipb.Source) error {
+		if opts.Validate {
+			if errs := assemble.ValidateSource(src); len(errs) > 0 {
+				for _, err := range errs {
+					log.Printf("Invalid source %q: %v", src.Ticket, err)
+				}
+				return fmt.Errorf("invalid source %q: found %d errors", src.Ticket, len(errs))
+			}
+		}
 		return writePartialEdges(ctx, partialSorter, bIdx, src)
 	}); err != nil {
 		return nil, err
@@ -54,7 +54,8 @@ var (
 	shardIOBufferSize = datasize.Flag("shard_io_buffer", "16KiB",
 		"Size of the reading/writing buffers for the intermediary data shards.")
 
-	verbose = flag.Bool("verbose", false, "Whether to emit extra, and possibly excessive, log messages")
+	verbose  = flag.Bool("verbose", false, "Whether to emit extra, and possibly excessive, log messages")
+	validate = flag.Bool("validate", false, "Whether to fail on any malformed node or edges in the input entries")
 )
 
 func init() {
@@ -107,6 +108,7 @@ func main() {
 		CompressShards: *compressShards,
 		MaxShardSize:   *maxShardSize,
 		IOBufferSize:   int(shardIOBufferSize.Bytes()),
+		Validate:       *validate,
 	}); err != nil {
 		log.Fatal("FATAL ERROR: ", err)
 	}
@@ -19,12 +19,21 @@
 package assemble
 
 import (
+	"bufio"
+	"bytes"
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"kythe.io/kythe/go/services/graphstore"
 	"kythe.io/kythe/go/services/graphstore/compare"
@@ -33,11 +42,15 @@ import (
 	"kythe.io/kythe/go/util/encoding/text"
 	"kythe.io/kythe/go/util/kytheuri"
 	"kythe.io/kythe/go/util/pager"
+	"kythe.io/kythe/go/util/schema"
 	"kythe.io/kythe/go/util/schema/edges"
 	"kythe.io/kythe/go/util/schema/facts"
 	"kythe.io/kythe/go/util/schema/nodes"
 	"kythe.io/kythe/go/util/schema/tickets"
 
+	"bitbucket.org/creachadair/stringset"
+	"github.com/golang/protobuf/proto"
+
 	cpb "kythe.io/kythe/proto/common_proto"
 	ipb "kythe.io/kythe/proto/internal_proto"
 	srvpb "kythe.io/kythe/proto/serving_proto"
@@ -45,6 +58,21 @@ import (
 	xpb "kythe.io/kythe/proto/xref_proto"
 )
 
+// SourceFromNode returns the Source equivalent of the given srvpb.Node.  It is
+// the inverse of Node.  Since nodes carry no edges, the Source will have no
+// edge groups.
+func SourceFromNode(n *srvpb.Node) *ipb.Source {
+	src := &ipb.Source{
+		Ticket:     n.Ticket,
+		Facts:      make(map[string][]byte, len(n.Fact)),
+		EdgeGroups: make(map[string]*ipb.Source_EdgeGroup),
+	}
+	for _, f := range n.Fact {
+		src.Facts[f.Name] = f.Value
+	}
+	return src
+}
+
 // Node returns the Source as a srvpb.Node.
 func Node(s *ipb.Source) *srvpb.Node {
 	facts := make([]*cpb.Fact, 0, len(s.Facts))
@@ -122,6 +150,115 @@ func Sources(rd stream.EntryReader, f func(*ipb.Source) error) error {
 // SourceFromEntries returns a new Source from the given a set of entries with
 // the same source VName.
 func SourceFromEntries(entries []*spb.Entry) *ipb.Source {
+	return sourceFromEntries(entries, nil)
+}
+
+// SourceFromEntriesFiltered returns a new Source from the given a set of
+// entries with the same source VName.  Only facts named in includeFacts are
+// kept; edge entries are always added to the Source.
+func SourceFromEntriesFiltered(entries []*spb.Entry, includeFacts map[string]struct{}) *ipb.Source {
+	return sourceFromEntries(entries, func(e *spb.Entry) bool {
+		if graphstore.IsEdge(e) {
+			return true
+		}
+		_, ok := includeFacts[e.FactName]
+		return ok
+	})
+}
+
+// SourceFromEntriesOptions controls the behavior of
+// SourceFromEntriesWithOptions.
+type SourceFromEntriesOptions struct {
+	// StrictFacts determines whether it is an error for two entries to have the
+	// same fact name with differing values.  Otherwise, the last value given is
+	// kept.
+	StrictFacts bool
+}
+
+// SourceFromEntriesWithOptions returns a new Source from the given a set of
+// entries with the same source VName using the given options.
+func SourceFromEntriesWithOptions(entries []*spb.Entry, opts SourceFromEntriesOptions) (*ipb.Source, error) {
+	if opts.StrictFacts {
+		seen := make(map[string]*spb.Entry)
+		for _, e := range entries {
+			if graphstore.IsEdge(e) {
+				continue
+			}
+			if prev, ok := seen[e.FactName]; ok && !bytes.Equal(prev.FactValue, e.FactValue) {
+				return nil, fmt.Errorf("conflicting values for fact %q of %q: %q and %q",
+					e.FactName, kytheuri.ToString(e.Source), prev.FactValue, e.FactValue)
+			}
+			seen[e.FactName] = e
+		}
+	}
+	return SourceFromEntries(entries), nil
+}
+
+// BatchSourceFromEntries returns the Source for each batch of entries, in the
+// same order as batches.  Each batch must contain the entries of a single
+// source VName and is converted concurrently using SourceFromEntriesWithOptions
+// with StrictFacts set.  The result for a batch that fails to convert (or is
+// not reached before ctx is canceled) is nil and an error describing the first
+// such failure is returned alongside the successfully converted Sources.
+func BatchSourceFromEntries(ctx context.Context, batches [][]*spb.Entry) ([]*ipb.Source, error) {
+	srcs := make([]*ipb.Source, len(batches))
+	errs := make([]error, len(batches))
+
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(batches) {
+		workers = len(batches)
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				srcs[i], errs[i] = batchSource(batches[i])
+			}
+		}()
+	}
+	for i := range batches {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+
+	var failed int
+	var first error
+	for i, err := range errs {
+		if err != nil {
+			if first == nil {
+				first = fmt.Errorf("batch %d: %v", i, err)
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return srcs, fmt.Errorf("%d of %d batches failed; first error: %v", failed, len(batches), first)
+	}
+	return srcs, nil
+}
+
+func batchSource(entries []*spb.Entry) (*ipb.Source, error) {
+	if len(entries) == 0 {
+		return nil, errors.New("empty batch of entries")
+	}
+	for _, e := range entries[1:] {
+		if !compare.VNamesEqual(entries[0].Source, e.Source) {
+			return nil, fmt.Errorf("mismatched entry sources: %q and %q",
+				kytheuri.ToString(entries[0].Source), kytheuri.ToString(e.Source))
+		}
+	}
+	return SourceFromEntriesWithOptions(entries, SourceFromEntriesOptions{StrictFacts: true})
+}
+
+func sourceFromEntries(entries []*spb.Entry, keep func(*spb.Entry) bool) *ipb.Source {
 	if len(entries) == 0 {
 		return nil
 	}
@@ -133,7 +270,9 @@ func SourceFromEntries(entries []*spb.Entry) *ipb.Source {
 	}
 
 	for _, e := range entries {
-		AppendEntry(src, e)
+		if keep == nil || keep(e) {
+			AppendEntry(src, e)
+		}
 	}
 
 	for _, group := range src.EdgeGroups {
@@ -143,6 +282,93 @@ func SourceFromEntries(entries []*spb.Entry) *ipb.Source {
 	return src
 }
 
+// MergeEntrySources returns a new Source combining the facts and edges of each
+// of the given sources.  All sources must share the same ticket.  An error is
+// returned if two sources have differing values for the same fact.  Edges are
+// deduplicated by their (Ordinal, Ticket) pair.  The merged Source shares its
+// fact values with the given sources; use CopySource on the result if it may
+// be mutated while the originals are in use.
+func MergeEntrySources(sources []*ipb.Source) (*ipb.Source, error) {
+	if len(sources) == 0 {
+		return nil, nil
+	}
+
+	merged := &ipb.Source{
+		Ticket:     sources[0].Ticket,
+		Facts:      make(map[string][]byte),
+		EdgeGroups: make(map[string]*ipb.Source_EdgeGroup),
+	}
+	for _, src := range sources {
+		if src.Ticket != merged.Ticket {
+			return nil, fmt.Errorf("mismatched source tickets: %q and %q", merged.Ticket, src.Ticket)
+		}
+		for name, value := range src.Facts {
+			if prev, ok := merged.Facts[name]; ok && !bytes.Equal(prev, value) {
+				return nil, fmt.Errorf("conflicting values for fact %q of %q: %q and %q", name, merged.Ticket, prev, value)
+			}
+			merged.Facts[name] = value
+		}
+		for kind, group := range src.EdgeGroups {
+			mg, ok := merged.EdgeGroups[kind]
+			if !ok {
+				mg = &ipb.Source_EdgeGroup{}
+				merged.EdgeGroups[kind] = mg
+			}
+		edgeLoop:
+			for _, e := range group.Edges {
+				for _, existing := range mg.Edges {
+					if existing.Ticket == e.Ticket && existing.Ordinal == e.Ordinal {
+						continue edgeLoop
+					}
+				}
+				mg.Edges = append(mg.Edges, &ipb.Source_Edge{
+					Ticket:  e.Ticket,
+					Ordinal: e.Ordinal,
+				})
+			}
+		}
+	}
+
+	for _, group := range merged.EdgeGroups {
+		sort.Sort(byOrdinal(group.Edges))
+	}
+
+	return merged, nil
+}
+
+// CopySource returns a deep copy of src that shares no memory with the
+// original.  This allows the copy to be mutated while the original is
+// concurrently in use.
+func CopySource(src *ipb.Source) *ipb.Source {
+	if src == nil {
+		return nil
+	}
+	cp := &ipb.Source{Ticket: src.Ticket}
+	if src.Facts != nil {
+		cp.Facts = make(map[string][]byte, len(src.Facts))
+		for name, value := range src.Facts {
+			if value != nil {
+				value = append([]byte{}, value...)
+			}
+			cp.Facts[name] = value
+		}
+	}
+	if src.EdgeGroups != nil {
+		cp.EdgeGroups = make(map[string]*ipb.Source_EdgeGroup, len(src.EdgeGroups))
+		for kind, group := range src.EdgeGroups {
+			cg := &ipb.Source_EdgeGroup{}
+			if group.Edges != nil {
+				cg.Edges = make([]*ipb.Source_Edge, len(group.Edges))
+				for i, e := range group.Edges {
+					cg.Edges[i] = &ipb.Source_Edge{Ticket: e.Ticket, Ordinal: e.Ordinal}
+				}
+			}
+			cp.EdgeGroups[kind] = cg
+		}
+	}
+	return cp
+}
+
 // FactsToMap returns a map from fact name to value.
 func FactsToMap(facts []*cpb.Fact) map[string][]byte {
 	m := make(map[string][]byte, len(facts))
@@ -152,6 +378,219 @@ func FactsToMap(facts []*cpb.Fact) map[string][]byte {
 	return m
 }
 
+// FactsToMapFiltered returns a map from fact name to value for each fact whose
+// name satisfies include.
+func FactsToMapFiltered(facts []*cpb.Fact, include func(string) bool) map[string][]byte {
+	m := make(map[string][]byte)
+	for _, f := range facts {
+		if include(f.Name) {
+			m[f.Name] = f.Value
+		}
+	}
+	return m
+}
+
+// FactsToMapByNames returns a map from fact name to value for each fact with
+// one of the given names.
+func FactsToMapByNames(facts []*cpb.Fact, names ...string) map[string][]byte {
+	set := stringset.New(names...)
+	return FactsToMapFiltered(facts, func(name string) bool { return set.Contains(name) })
+}
+
+// MapToFacts returns the facts in the given map from fact name to value, sorted
+// by name.  It is the inverse of FactsToMap.
+func MapToFacts(m map[string][]byte) []*cpb.Fact {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	facts := make([]*cpb.Fact, len(names))
+	for i, name := range names {
+		facts[i] = &cpb.Fact{Name: name, Value: m[name]}
+	}
+	return facts
+}
+
+// FactDiff compares two sets of facts by name.  added contains the facts of b
+// whose names do not appear in a, removed contains the facts of a whose names
+// do not appear in b, and changed contains the facts of b whose names appear in
+// a with a different value.  Each result is sorted by name.
+func FactDiff(a, b []*cpb.Fact) (added, removed, changed []*cpb.Fact) {
+	a, b = sortedFacts(a), sortedFacts(b)
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0].Name < b[0].Name:
+			removed = append(removed, a[0])
+			a = a[1:]
+		case a[0].Name > b[0].Name:
+			added = append(added, b[0])
+			b = b[1:]
+		default:
+			if !bytes.Equal(a[0].Value, b[0].Value) {
+				changed = append(changed, b[0])
+			}
+			a, b = a[1:], b[1:]
+		}
+	}
+	removed = append(removed, a...)
+	added = append(added, b...)
+	return
+}
+
+// NodeDiff describes the differences between the facts of two nodes (see
+// DiffNodes).
+type NodeDiff struct {
+	Added   []*cpb.Fact  // facts of the second node absent from the first
+	Removed []*cpb.Fact  // facts of the first node absent from the second
+	Changed []FactChange // facts present in both with different values
+}
+
+// A FactChange is a fact whose value differs between two nodes.
+type FactChange struct {
+	Name     string
+	Old, New []byte
+}
+
+// DiffNodes returns the differences between the facts of a and b.  Facts are
+// compared by name; the diff is cheapest when both fact slices are already
+// sorted by name.
+func DiffNodes(a, b *srvpb.Node) NodeDiff {
+	added, removed, changed := FactDiff(a.Fact, b.Fact)
+	d := NodeDiff{Added: added, Removed: removed}
+	for _, f := range changed {
+		d.Changed = append(d.Changed, FactChange{
+			Name: f.Name,
+			Old:  GetFact(a.Fact, f.Name),
+			New:  f.Value,
+		})
+	}
+	return d
+}
+
+// IsEmpty reports whether the diff contains no differences.
+func (d NodeDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// String returns a line for each difference, prefixed by "+" for additions, "-"
+// for removals, and "~" for changes.
+func (d NodeDiff) String() string {
+	var lines []string
+	for _, f := range d.Added {
+		lines = append(lines, fmt.Sprintf("+%s: %q", f.Name, f.Value))
+	}
+	for _, f := range d.Removed {
+		lines = append(lines, fmt.Sprintf("-%s: %q", f.Name, f.Value))
+	}
+	for _, c := range d.Changed {
+		lines = append(lines, fmt.Sprintf("~%s: %q -> %q", c.Name, c.Old, c.New))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sortedFacts returns fs if it is sorted by name; otherwise a sorted copy.
+func sortedFacts(fs []*cpb.Fact) []*cpb.Fact {
+	if sort.IsSorted(xrefs.ByName(fs)) {
+		return fs
+	}
+	sorted := make([]*cpb.Fact, len(fs))
+	copy(sorted, fs)
+	sort.Sort(xrefs.ByName(sorted))
+	return sorted
+}
+
+// ValidFactPrefixes is the set of prefixes accepted by ValidateFact for fact
+// names.  Languages that emit facts outside of the /kythe/ namespace may add
+// their own prefix.
+var ValidFactPrefixes = []string{"/kythe/"}
+
+// ValidateFact returns an error if f does not follow the conventions for facts:
+// its name must begin with one of the ValidFactPrefixes and consist solely of
+// printable ASCII characters, and its value must be non-nil (but may be empty).
+func ValidateFact(f *cpb.Fact) error {
+	if f == nil {
+		return errors.New("nil fact")
+	} else if f.Name == "" {
+		return errors.New("empty fact name")
+	}
+	var validPrefix bool
+	for _, prefix := range ValidFactPrefixes {
+		if strings.HasPrefix(f.Name, prefix) {
+			validPrefix = true
+			break
+		}
+	}
+	if !validPrefix {
+		return fmt.Errorf("fact name %q has an unknown prefix", f.Name)
+	}
+	for i := 0; i < len(f.Name); i++ {
+		if c := f.Name[i]; c < ' ' || c > '~' {
+			return fmt.Errorf("fact name %q contains non-printable character at offset %d", f.Name, i)
+		}
+	}
+	if f.Value == nil {
+		return fmt.Errorf("fact %q has a nil value", f.Name)
+	}
+	return nil
+}
+
+// ValidateFacts returns the errors from calling ValidateFact on each of the
+// given facts.  If every fact is valid, nil is returned.
+func ValidateFacts(facts []*cpb.Fact) []error {
+	var errs []error
+	for _, f := range facts {
+		if err := ValidateFact(f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// ValidateSource returns the errors found in the given Source: a missing or
+// unparseable ticket, any invalid facts (see ValidateFact), and any edge group
+// with an empty kind, a negative ordinal, or a duplicate (target, ordinal)
+// pair.  If the Source is valid, nil is returned.
+func ValidateSource(src *ipb.Source) []error {
+	var errs []error
+	if src.Ticket == "" {
+		errs = append(errs, errors.New("missing source ticket"))
+	} else if _, err := kytheuri.Parse(src.Ticket); err != nil {
+		errs = append(errs, fmt.Errorf("invalid source ticket %q: %v", src.Ticket, err))
+	}
+	facts := make([]*cpb.Fact, 0, len(src.Facts))
+	for name, value := range src.Facts {
+		facts = append(facts, &cpb.Fact{Name: name, Value: value})
+	}
+	sort.Sort(xrefs.ByName(facts))
+	errs = append(errs, ValidateFacts(facts)...)
+
+	kinds := make([]string, 0, len(src.EdgeGroups))
+	for kind := range src.EdgeGroups {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		if kind == "" {
+			errs = append(errs, errors.New("edge group with empty kind"))
+		}
+		seen := make(map[string]map[int32]bool)
+		for _, e := range src.EdgeGroups[kind].GetEdges() {
+			if e.Ordinal < 0 {
+				errs = append(errs, fmt.Errorf("%s edge to %q has negative ordinal %d", kind, e.Ticket, e.Ordinal))
+			}
+			if seen[e.Ticket] == nil {
+				seen[e.Ticket] = make(map[int32]bool)
+			} else if seen[e.Ticket][e.Ordinal] {
+				errs = append(errs, fmt.Errorf("duplicate %s edge to %q with ordinal %d", kind, e.Ticket, e.Ordinal))
+			}
+			seen[e.Ticket][e.Ordinal] = true
+		}
+	}
+	return errs
+}
+
 // GetFact returns the value of the first fact in facts with the given name; otherwise returns nil.
 func GetFact(facts []*cpb.Fact, name string) []byte {
 	for _, f := range facts {
@@ -162,10 +601,143 @@ func GetFact(facts []*cpb.Fact, name string) []byte {
 	return nil
 }
 
+// GetFacts returns a map from each given name to the value of the first fact in
+// facts with that name.  Names without a corresponding fact are absent from
+// the map.
+func GetFacts(facts []*cpb.Fact, names ...string) map[string][]byte {
+	m := make(map[string][]byte, len(names))
+	want := stringset.New(names...)
+	for _, f := range facts {
+		if want.Len() == 0 {
+			break
+		} else if want.Contains(f.Name) {
+			m[f.Name] = f.Value
+			want.Discard(f.Name)
+		}
+	}
+	return m
+}
+
+// MergeNodes returns a new Node with the union of the facts of a and b, sorted
+// by name.  An error is returned if a and b have different tickets or if any
+// fact has a different value in each.
+func MergeNodes(a, b *srvpb.Node) (*srvpb.Node, error) {
+	if a.Ticket != b.Ticket {
+		return nil, fmt.Errorf("mismatched node tickets: %q and %q", a.Ticket, b.Ticket)
+	}
+
+	vals := FactsToMap(a.Fact)
+	res := &srvpb.Node{
+		Ticket: a.Ticket,
+		Fact:   append([]*cpb.Fact(nil), a.Fact...),
+	}
+	var conflicts []string
+	for _, f := range b.Fact {
+		if val, ok := vals[f.Name]; !ok {
+			vals[f.Name] = f.Value
+			res.Fact = append(res.Fact, f)
+		} else if !bytes.Equal(val, f.Value) {
+			conflicts = append(conflicts, f.Name)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return nil, fmt.Errorf("conflicting facts for %q: %s", a.Ticket, strings.Join(conflicts, ", "))
+	}
+	sort.Sort(xrefs.ByName(res.Fact))
+	return res, nil
+}
+
+// NodeKind returns the node kind of n, or "" if it has none.
+func NodeKind(n *srvpb.Node) string { return string(GetFact(n.Fact, facts.NodeKind)) }
+
+// NodeSubkind returns the subkind of n, or "" if it has none.
+func NodeSubkind(n *srvpb.Node) string { return string(GetFact(n.Fact, facts.Subkind)) }
+
+// IsFileNode reports whether n is a file node.
+func IsFileNode(n *srvpb.Node) bool { return NodeKind(n) == nodes.File }
+
+// IsAnchorNode reports whether n is an anchor node, implicit or otherwise.
+func IsAnchorNode(n *srvpb.Node) bool { return NodeKind(n) == nodes.Anchor }
+
+// IsImplicitAnchorNode reports whether n is an implicit anchor node.
+func IsImplicitAnchorNode(n *srvpb.Node) bool {
+	return IsAnchorNode(n) && NodeSubkind(n) == nodes.Implicit
+}
+
+// IsImplicitAnchor reports whether src is an implicit anchor.
+func IsImplicitAnchor(src *ipb.Source) bool {
+	return string(src.Facts[facts.NodeKind]) == nodes.Anchor && string(src.Facts[facts.Subkind]) == nodes.Implicit
+}
+
+// FilterImplicitAnchors returns a new slice of each Source in srcs that is not
+// an implicit anchor (see IsImplicitAnchor), in their original order.
+func FilterImplicitAnchors(srcs []*ipb.Source) []*ipb.Source {
+	var res []*ipb.Source
+	for _, src := range srcs {
+		if !IsImplicitAnchor(src) {
+			res = append(res, src)
+		}
+	}
+	return res
+}
+
+// GroupSourcesByKind partitions srcs by the value of their node kind fact,
+// retaining their relative order within each kind.  Sources missing the fact
+// are grouped under the empty kind.  Only observed kinds are keys of the result.
+func GroupSourcesByKind(srcs []*ipb.Source) map[string][]*ipb.Source {
+	groups := make(map[string][]*ipb.Source)
+	for _, src := range srcs {
+		kind := string(src.Facts[facts.NodeKind])
+		groups[kind] = append(groups[kind], src)
+	}
+	return groups
+}
+
+// NodeText returns the values of n's text and text encoding facts, found in a
+// single pass over its facts.  Each is empty if n lacks the corresponding fact
+// (e.g. n is not a file node).
+func NodeText(n *srvpb.Node) (text []byte, encoding string) {
+	for _, f := range n.Fact {
+		switch f.Name {
+		case facts.Text:
+			text = f.Value
+		case facts.TextEncoding:
+			encoding = string(f.Value)
+		}
+	}
+	return text, encoding
+}
+
+// FactValueInt32 returns the value of the named fact in src parsed as a
+// base-10 int32.  An error naming the fact and its raw value is returned if the
+// value cannot be parsed (including when the fact is missing).
+func FactValueInt32(src *ipb.Source, factName string) (int32, error) {
+	n, err := factValueInt(src, factName, 32)
+	return int32(n), err
+}
+
+// FactValueInt64 returns the value of the named fact in src parsed as a
+// base-10 int64.  An error naming the fact and its raw value is returned if the
+// value cannot be parsed (including when the fact is missing).
+func FactValueInt64(src *ipb.Source, factName string) (int64, error) {
+	return factValueInt(src, factName, 64)
+}
+
+func factValueInt(src *ipb.Source, factName string, bitSize int) (int64, error) {
+	val := string(src.Facts[factName])
+	n, err := strconv.ParseInt(val, 10, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer value %q for fact %q: %v", val, factName, err)
+	}
+	return n, nil
+}
+
 // PartialReverseEdges returns the set of partial reverse edges from the given source.  Each
 // reversed Edge has its Target fully populated and its Source will have no facts.  To ensure every
-// node has at least 1 Edge, the first Edge will be a self-edge without a Kind or Target.  To reduce
-// the size of edge sets, each Target will have any text facts filtered (see FilterTextFacts).
+// node has at least 1 Edge, the first Edge will be a self-edge without a Kind or Target (see
+// IsNodeSelfEdge).  To reduce the size of edge sets, each Target will have any text facts filtered
+// (see FilterTextFacts).
 func PartialReverseEdges(src *ipb.Source) []*srvpb.Edge {
 	node := Node(src)
 
@@ -190,6 +762,49 @@ func PartialReverseEdges(src *ipb.Source) []*srvpb.Edge {
 	return result
 }
 
+// MergeEdges merges two slices of edges, each sorted by (Source.Ticket, Kind,
+// Ordinal, Target.Ticket), into a single sorted slice.  Edges found in both a
+// and b are only included once, preferring the edge from a.
+func MergeEdges(a, b []*srvpb.Edge) []*srvpb.Edge {
+	res := make([]*srvpb.Edge, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch c := compareServingEdges(a[0], b[0]); {
+		case c < 0:
+			res, a = append(res, a[0]), a[1:]
+		case c > 0:
+			res, b = append(res, b[0]), b[1:]
+		default:
+			res, a, b = append(res, a[0]), a[1:], b[1:]
+		}
+	}
+	res = append(res, a...)
+	return append(res, b...)
+}
+
+// compareServingEdges returns -1, 0, or +1 if e1 is ordered before, equivalent
+// to, or after e2 by (Source.Ticket, Kind, Ordinal, Target.Ticket).
+func compareServingEdges(e1, e2 *srvpb.Edge) int {
+	if s1, s2 := e1.GetSource().GetTicket(), e2.GetSource().GetTicket(); s1 != s2 {
+		return strings.Compare(s1, s2)
+	} else if e1.Kind != e2.Kind {
+		return strings.Compare(e1.Kind, e2.Kind)
+	} else if e1.Ordinal != e2.Ordinal {
+		if e1.Ordinal < e2.Ordinal {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(e1.GetTarget().GetTicket(), e2.GetTarget().GetTicket())
+}
+
+// IsNodeSelfEdge reports whether e is the self-edge emitted by
+// PartialReverseEdges to ensure its node has at least 1 Edge.
+func IsNodeSelfEdge(e *srvpb.Edge) bool { return e.Kind == "" && e.Target == nil }
+
+// IsNodeEdge reports whether e is an actual edge and not a node's self-edge
+// (see IsNodeSelfEdge).
+func IsNodeEdge(e *srvpb.Edge) bool { return !IsNodeSelfEdge(e) }
+
 // FilterTextFacts returns a new Node without any text facts.
 func FilterTextFacts(n *srvpb.Node) *srvpb.Node {
 	res := &srvpb.Node{
@@ -197,92 +812,295 @@ func FilterTextFacts(n *srvpb.Node) *srvpb.Node {
 		Fact:   make([]*cpb.Fact, 0, len(n.Fact)),
 	}
 	for _, f := range n.Fact {
-		switch f.Name {
-		case facts.Text, facts.TextEncoding:
-			// Skip large text facts for targets
-		default:
+		// Skip large text facts for targets
+		if !schema.IsTextFact(f.Name) {
 			res.Fact = append(res.Fact, f)
 		}
 	}
 	return res
 }
 
+// BuildNodeIndex reads each Source from srcs and passes its equivalent Node to
+// output.  File nodes retain their text facts; all other nodes have them
+// removed (see FilterTextFacts).  BuildNodeIndex returns when srcs is closed,
+// the given context is canceled, or output returns an error.
+func BuildNodeIndex(ctx context.Context, srcs <-chan *ipb.Source, output func(context.Context, *srvpb.Node) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case src, ok := <-srcs:
+			if !ok {
+				return nil
+			}
+			n := Node(src)
+			if string(src.Facts[facts.NodeKind]) != nodes.File {
+				n = FilterTextFacts(n)
+			}
+			if err := output(ctx, n); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ShardBy returns the shard in [0, numShards) to which the given source
+// ticket belongs.  The result is deterministic so that every Source for a
+// ticket is routed to the same shard.  numShards must be positive.
+func ShardBy(ticket string, numShards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(ticket))
+	return int(h.Sum32() % uint32(numShards))
+}
+
+// AnchorParents returns the tickets of each file targeted by one of src's
+// childof edges, in edge order.  Since a Source does not carry the facts of its
+// edges' targets, nodeKindLookup must return the node kind of the given
+// ticket; an edge is kept only when its target's kind is nodes.File.
+func AnchorParents(src *ipb.Source, nodeKindLookup func(ticket string) string) []string {
+	var parents []string
+	for _, e := range src.EdgeGroups[edges.ChildOf].GetEdges() {
+		if nodeKindLookup(e.Ticket) == nodes.File {
+			parents = append(parents, e.Ticket)
+		}
+	}
+	return parents
+}
+
+// ProgressTracker is notified of the work done by an EdgeSetBuilder,
+// DecorationFragmentBuilder, or CrossReferencesBuilder.  A single tracker may
+// be shared between builders running concurrently, so implementations must be
+// safe for concurrent use.
+type ProgressTracker interface {
+	// OnSource is called for each source node given to a builder.
+	OnSource(ticket string)
+	// OnEdge is called for each edge added to an EdgeSetBuilder.
+	OnEdge()
+	// OnDecoration is called for each decoration added to a
+	// DecorationFragmentBuilder.
+	OnDecoration()
+	// OnCrossReference is called for each cross-reference added to a
+	// CrossReferencesBuilder.
+	OnCrossReference()
+}
+
+// LogProgressTracker is a ProgressTracker that logs its running totals after
+// every Interval events.
+type LogProgressTracker struct {
+	// counters are accessed atomically and must remain the first fields to
+	// ensure 64-bit alignment.
+	events, sources, edges, decorations, crossRefs int64
+
+	// Interval is the number of events between each log message.  If
+	// Interval <= 0, nothing is logged.
+	Interval int64
+}
+
+// OnSource implements part of the ProgressTracker interface.
+func (t *LogProgressTracker) OnSource(ticket string) { t.event(&t.sources) }
+
+// OnEdge implements part of the ProgressTracker interface.
+func (t *LogProgressTracker) OnEdge() { t.event(&t.edges) }
+
+// OnDecoration implements part of the ProgressTracker interface.
+func (t *LogProgressTracker) OnDecoration() { t.event(&t.decorations) }
+
+// OnCrossReference implements part of the ProgressTracker interface.
+func (t *LogProgressTracker) OnCrossReference() { t.event(&t.crossRefs) }
+
+func (t *LogProgressTracker) event(counter *int64) {
+	atomic.AddInt64(counter, 1)
+	if n := atomic.AddInt64(&t.events, 1); t.Interval > 0 && n%t.Interval == 0 {
+		log.Printf("Progress: %d sources, %d edges, %d decorations, %d cross-references",
+			atomic.LoadInt64(&t.sources), atomic.LoadInt64(&t.edges),
+			atomic.LoadInt64(&t.decorations), atomic.LoadInt64(&t.crossRefs))
+	}
+}
+
 // DecorationFragmentBuilder builds pieces of FileDecorations given an ordered (see AddEdge) stream
 // of completed Edges.  Each fragment constructed (either by AddEdge or Flush) will be emitted using
 // the Output function in the builder.  There are two types of fragments: file fragments (which have
 // their SourceText, FileTicket, and Encoding set) and decoration fragments (which have only
 // Decoration set).
+//
+// By default, an anchor's decorations are emitted as soon as they are added to
+// the builder, paired with the anchor's parent file (as derived from the
+// anchor's ticket).  If BufferDecorations is set, an anchor's decorations are
+// instead held until the next Flush (or the start of the next Source) and the
+// targets of the anchor's childof edges are also considered its parents.  This
+// allows childof edges to arrive in any order relative to the anchor's other
+// edges.
 type DecorationFragmentBuilder struct {
+	// metrics is accessed atomically and must remain the first field to ensure
+	// 64-bit alignment.
+	metrics DecorationMetrics
+
 	Output func(ctx context.Context, file string, fragment *srvpb.FileDecorations) error
 
+	// BufferDecorations determines whether decorations are held until Flush is
+	// called rather than emitted as soon as they are added.
+	BufferDecorations bool
+
+	// PanicOnInvalidEdge determines whether AddEdge will panic when given an
+	// edge that could only have been produced by a bug in the pipeline: an
+	// anchor with unparseable offsets, a negative or crossed span, or a ticket
+	// from which no parent file can be derived.  By default, such edges are
+	// logged; anchors with unparseable offsets or invalid spans are skipped
+	// while an anchor without a derivable parent file is still decorated if a
+	// childof edge later supplies its parent (see BufferDecorations).
+	PanicOnInvalidEdge bool
+
+	// OnOverflow is called by Flush, if non-nil, with the total number of
+	// decorations dropped for each file due to the limit given to
+	// SetMaxDecorationsPerFile.
+	OnOverflow func(file string, dropped int)
+
 	anchor  *srvpb.RawAnchor
 	targets map[string]*srvpb.Node
 	decor   []*srvpb.FileDecorations_Decoration
 	parents []string
+
+	anchorFilter    func(*srvpb.RawAnchor) bool
+	kindFilter      stringset.Set
+	maxDecorations  int
+	fileDecorations map[string]int // parent file -> decorations emitted since the last Flush
+	dropped         map[string]int // parent file -> decorations dropped since the last Flush
+
+	progress ProgressTracker
+}
+
+// DecorationMetrics are counters describing the work done by a
+// DecorationFragmentBuilder.
+type DecorationMetrics struct {
+	// AnchorsProcessed is the number of (non-implicit) anchors seen.
+	AnchorsProcessed int64
+	// DecorationsEmitted is the number of decorations output.
+	DecorationsEmitted int64
+	// DecorationsDropped is the number of decorations discarded, either due to
+	// limits placed on the builder or due to their anchor having no parent file.
+	DecorationsDropped int64
+	// FilesEmitted is the number of file fragments output.
+	FilesEmitted int64
+	// ImplicitAnchorsSkipped is the number of implicit anchors seen.
+	ImplicitAnchorsSkipped int64
+}
+
+// Metrics returns a snapshot of the builder's current counters.  It is safe to
+// call concurrently with the builder's other methods.
+func (b *DecorationFragmentBuilder) Metrics() DecorationMetrics {
+	return DecorationMetrics{
+		AnchorsProcessed:       atomic.LoadInt64(&b.metrics.AnchorsProcessed),
+		DecorationsEmitted:     atomic.LoadInt64(&b.metrics.DecorationsEmitted),
+		DecorationsDropped:     atomic.LoadInt64(&b.metrics.DecorationsDropped),
+		FilesEmitted:           atomic.LoadInt64(&b.metrics.FilesEmitted),
+		ImplicitAnchorsSkipped: atomic.LoadInt64(&b.metrics.ImplicitAnchorsSkipped),
+	}
+}
+
+// SetAnchorFilter restricts the anchors decorated to those for which fn
+// returns true.  Each anchor skipped is counted as a dropped decoration.  If fn
+// is nil, every anchor is decorated.
+func (b *DecorationFragmentBuilder) SetAnchorFilter(fn func(*srvpb.RawAnchor) bool) {
+	b.anchorFilter = fn
+}
+
+// SetEdgeKindFilter restricts the decorations emitted to those with one of the
+// given edge kinds.  If kinds is empty, decorations of every kind are emitted.
+func (b *DecorationFragmentBuilder) SetEdgeKindFilter(kinds []string) {
+	if len(kinds) == 0 {
+		b.kindFilter = nil
+	} else {
+		b.kindFilter = stringset.New(kinds...)
+	}
 }
 
+// SetMaxDecorationsPerFile limits the number of decorations output for each
+// parent file between calls to Flush to n.  Any further decorations for the
+// file are dropped and reported to OnOverflow.  If n <= 0, there is no limit.
+// The per-file counts are kept until the next Flush.
+func (b *DecorationFragmentBuilder) SetMaxDecorationsPerFile(n int) { b.maxDecorations = n }
+
+// SetProgressTracker sets the ProgressTracker notified of each source node seen
+// and each decoration added.  If t is nil, no progress is reported.
+func (b *DecorationFragmentBuilder) SetProgressTracker(t ProgressTracker) { b.progress = t }
+
 // AddEdge adds the given edge to the current fragment (or emits some fragments and starts a new
 // fragment with e).  AddEdge must be called in GraphStore sorted order of the Edges with the
 // beginning to every set of edges with the same Source having a signaling Edge with only its Source
 // set (no Kind or Target).  Otherwise, every Edge must have a completed Source, Kind, and Target.
 // Flush must be called after every call to AddEdge in order to output any remaining fragments.
+// Anchors with unparseable offsets or negative or crossed spans are skipped (see
+// PanicOnInvalidEdge).
 func (b *DecorationFragmentBuilder) AddEdge(ctx context.Context, e *srvpb.Edge) error {
 	if e.Target == nil {
 		// Beginning of a set of edges with a new Source
-		if err := b.Flush(ctx); err != nil {
+		if err := b.flush(ctx); err != nil {
 			return err
 		}
 
-		srcFacts := FactsToMap(e.Source.Fact)
+		if b.progress != nil {
+			b.progress.OnSource(e.Source.Ticket)
+		}
+		src := SourceFromNode(e.Source)
 
-		switch string(srcFacts[facts.NodeKind]) {
+		switch string(src.Facts[facts.NodeKind]) {
 		case nodes.File:
 			if err := b.Output(ctx, e.Source.Ticket, &srvpb.FileDecorations{
 				File: &srvpb.File{
 					Ticket:   e.Source.Ticket,
-					Text:     srcFacts[facts.Text],
-					Encoding: string(srcFacts[facts.TextEncoding]),
+					Text:     src.Facts[facts.Text],
+					Encoding: string(src.Facts[facts.TextEncoding]),
 				},
 			}); err != nil {
 				return err
 			}
+			atomic.AddInt64(&b.metrics.FilesEmitted, 1)
 		case nodes.Anchor:
 			// Implicit anchors don't belong in file decorations.
-			if string(srcFacts[facts.Subkind]) == nodes.Implicit {
+			if IsImplicitAnchor(src) {
+				atomic.AddInt64(&b.metrics.ImplicitAnchorsSkipped, 1)
 				return nil
 			}
-			anchorStart, err := strconv.Atoi(string(srcFacts[facts.AnchorStart]))
+			anchorStart, err := FactValueInt32(src, facts.AnchorStart)
 			if err != nil {
-				log.Printf("Error parsing anchor start offset %q: %v",
-					string(srcFacts[facts.AnchorStart]), err)
+				b.invalidEdge("Error parsing anchor start offset for %q: %v", e.Source.Ticket, err)
 				return nil
 			}
-			anchorEnd, err := strconv.Atoi(string(srcFacts[facts.AnchorEnd]))
+			anchorEnd, err := FactValueInt32(src, facts.AnchorEnd)
 			if err != nil {
-				log.Printf("Error parsing anchor end offset %q: %v",
-					string(srcFacts[facts.AnchorEnd]), err)
+				b.invalidEdge("Error parsing anchor end offset for %q: %v", e.Source.Ticket, err)
+				return nil
+			}
+			if anchorStart < 0 || anchorEnd < anchorStart {
+				b.invalidEdge("Invalid anchor span for %q: [%d, %d)", e.Source.Ticket, anchorStart, anchorEnd)
 				return nil
 			}
 			// Record the parent file for the anchor.
 			parentFile, err := tickets.AnchorFile(e.Source.Ticket)
 			if err != nil {
-				log.Printf("Error deriving anchor ticket for %q: %v", e.Source.Ticket, err)
+				b.invalidEdge("Error deriving anchor file for %q: %v", e.Source.Ticket, err)
 			} else {
 				b.parents = append(b.parents, parentFile)
 			}
 
 			// Ignore errors; offsets will just be zero
-			snippetStart, _ := strconv.Atoi(string(srcFacts[facts.SnippetStart]))
-			snippetEnd, _ := strconv.Atoi(string(srcFacts[facts.SnippetEnd]))
+			snippetStart, _ := FactValueInt32(src, facts.SnippetStart)
+			snippetEnd, _ := FactValueInt32(src, facts.SnippetEnd)
 
 			b.anchor = &srvpb.RawAnchor{
 				Ticket:       e.Source.Ticket,
-				StartOffset:  int32(anchorStart),
-				EndOffset:    int32(anchorEnd),
-				SnippetStart: int32(snippetStart),
-				SnippetEnd:   int32(snippetEnd),
+				StartOffset:  anchorStart,
+				EndOffset:    anchorEnd,
+				SnippetStart: snippetStart,
+				SnippetEnd:   snippetEnd,
+			}
+			if b.anchorFilter != nil && !b.anchorFilter(b.anchor) {
+				b.anchor = nil
+				atomic.AddInt64(&b.metrics.DecorationsDropped, 1)
+				return nil
 			}
 			b.targets = make(map[string]*srvpb.Node)
+			atomic.AddInt64(&b.metrics.AnchorsProcessed, 1)
 		}
 		return nil
 	} else if b.anchor == nil {
@@ -290,55 +1108,168 @@ func (b *DecorationFragmentBuilder) AddEdge(ctx context.Context, e *srvpb.Edge)
 		return nil
 	}
 
-	if e.Kind != edges.ChildOf {
-		b.decor = append(b.decor, &srvpb.FileDecorations_Decoration{
-			Anchor: b.anchor,
-			Kind:   e.Kind,
-			Target: e.Target.Ticket,
-		})
-
-		if _, ok := b.targets[e.Target.Ticket]; !ok {
-			b.targets[e.Target.Ticket] = e.Target
+	if e.Kind == edges.ChildOf {
+		if b.BufferDecorations {
+			b.addParent(e.Target.Ticket)
 		}
+		return nil
+	}
 
-		if len(b.parents) > 0 {
-			fd := &srvpb.FileDecorations{Decoration: b.decor}
-			for _, n := range b.targets {
-				fd.Target = append(fd.Target, n)
-			}
-			sort.Sort(ByTicket(fd.Target))
-			for _, parent := range b.parents {
-				if err := b.Output(ctx, parent, fd); err != nil {
-					return err
-				}
-			}
-			b.decor = nil
-			b.targets = make(map[string]*srvpb.Node)
+	if b.kindFilter != nil && !b.kindFilter.Contains(e.Kind) {
+		return nil
+	}
+	b.decor = append(b.decor, &srvpb.FileDecorations_Decoration{
+		Anchor: b.anchor,
+		Kind:   e.Kind,
+		Target: e.Target.Ticket,
+	})
+	if b.progress != nil {
+		b.progress.OnDecoration()
+	}
+
+	if _, ok := b.targets[e.Target.Ticket]; !ok {
+		b.targets[e.Target.Ticket] = e.Target
+	}
+
+	if !b.BufferDecorations {
+		return b.emitDecorations(ctx)
+	}
+	return nil
+}
+
+// addParent adds the given file as a parent of the current anchor, if it is
+// not already one.
+func (b *DecorationFragmentBuilder) addParent(file string) {
+	for _, p := range b.parents {
+		if p == file {
+			return
 		}
 	}
+	b.parents = append(b.parents, file)
+}
+
+// emitDecorations outputs the current anchor's decorations (and their targets)
+// to each of the anchor's parents.  If the anchor has no known parents, the
+// decorations are kept until some are found.
+func (b *DecorationFragmentBuilder) emitDecorations(ctx context.Context) error {
+	if len(b.decor) == 0 || len(b.parents) == 0 {
+		return nil
+	}
 
+	var emitted int
+	for _, parent := range b.parents {
+		decor := b.limitDecorations(parent, b.decor)
+		if len(decor) == 0 {
+			continue
+		} else if len(decor) > emitted {
+			emitted = len(decor)
+		}
+		fd := &srvpb.FileDecorations{Decoration: decor}
+		if len(decor) == len(b.decor) {
+			for _, n := range b.targets {
+				fd.Target = append(fd.Target, n)
+			}
+		} else {
+			seen := stringset.New()
+			for _, d := range decor {
+				if !seen.Contains(d.Target) {
+					seen.Add(d.Target)
+					fd.Target = append(fd.Target, b.targets[d.Target])
+				}
+			}
+		}
+		sort.Sort(ByTicket(fd.Target))
+		if err := b.Output(ctx, parent, fd); err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&b.metrics.DecorationsEmitted, int64(emitted))
+	atomic.AddInt64(&b.metrics.DecorationsDropped, int64(len(b.decor)-emitted))
+	b.decor = nil
+	b.targets = make(map[string]*srvpb.Node)
 	return nil
 }
 
+// limitDecorations returns the prefix of decor that may still be output to the
+// given parent file under the limit given to SetMaxDecorationsPerFile.  The
+// remaining decorations are counted as dropped for the file.
+func (b *DecorationFragmentBuilder) limitDecorations(file string, decor []*srvpb.FileDecorations_Decoration) []*srvpb.FileDecorations_Decoration {
+	if b.maxDecorations <= 0 {
+		return decor
+	}
+	if b.fileDecorations == nil {
+		b.fileDecorations = make(map[string]int)
+	}
+	if n := b.maxDecorations - b.fileDecorations[file]; n < len(decor) {
+		if n < 0 {
+			n = 0
+		}
+		if b.dropped == nil {
+			b.dropped = make(map[string]int)
+		}
+		b.dropped[file] += len(decor) - n
+		decor = decor[:n]
+	}
+	b.fileDecorations[file] += len(decor)
+	return decor
+}
+
+// invalidEdge reports an edge that indicates a bug in the pipeline.  The
+// message is logged unless b.PanicOnInvalidEdge is set.
+func (b *DecorationFragmentBuilder) invalidEdge(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if b.PanicOnInvalidEdge {
+		panic(msg)
+	}
+	log.Println(msg)
+}
+
 // Flush outputs any remaining fragments that are being built.  It is safe, but usually unnecessary,
 // to call Flush in between sets of Edges with the same Source.  This also means that
 // DecorationFragmentBuilder can be used to construct decoration fragments in parallel by
 // partitioning edges along the same boundaries.
+//
+// Flush also reports, to OnOverflow, the total number of decorations dropped
+// for each file since the previous call to Flush and then resets the per-file
+// counts used by SetMaxDecorationsPerFile.  Since anchors for a file may be
+// interleaved with those of other files, a file's total is only known once
+// every edge has been added; when Flush is only called after the final AddEdge,
+// each file's total is reported exactly once.
 func (b *DecorationFragmentBuilder) Flush(ctx context.Context) error {
+	if err := b.flush(ctx); err != nil {
+		return err
+	}
+
+	if len(b.dropped) > 0 {
+		if b.OnOverflow != nil {
+			files := make([]string, 0, len(b.dropped))
+			for file := range b.dropped {
+				files = append(files, file)
+			}
+			sort.Strings(files)
+			for _, file := range files {
+				b.OnOverflow(file, b.dropped[file])
+			}
+		}
+	}
+	b.dropped, b.fileDecorations = nil, nil
+	return nil
+}
+
+// flush outputs any decorations for the current anchor.  It is called at the
+// start of each Source.
+func (b *DecorationFragmentBuilder) flush(ctx context.Context) error {
 	defer func() {
 		b.anchor = nil
 		b.decor = nil
 		b.parents = nil
 	}()
 
-	if len(b.decor) > 0 && len(b.parents) > 0 {
-		fd := &srvpb.FileDecorations{Decoration: b.decor}
-		for _, parent := range b.parents {
-			if err := b.Output(ctx, parent, fd); err != nil {
-				return err
-			}
-		}
+	if err := b.emitDecorations(ctx); err != nil {
+		return err
 	}
+	// Any remaining decorations have no known parent file.
+	atomic.AddInt64(&b.metrics.DecorationsDropped, int64(len(b.decor)))
 	return nil
 }
 
@@ -363,6 +1294,197 @@ func (s ByOffset) Less(i, j int) bool {
 	return s[i].Anchor.StartOffset < s[j].Anchor.StartOffset
 }
 
+// GroupDecorationsByKind returns a map from edge kind to the decorations in ds
+// with that kind, each in its original order.  When all decorations of a kind
+// are adjacent in ds, their group is a sub-slice of ds; otherwise, the group is
+// a newly allocated slice.
+func GroupDecorationsByKind(ds []*srvpb.FileDecorations_Decoration) map[string][]*srvpb.FileDecorations_Decoration {
+	type span struct{ first, last, count int }
+	spans := make(map[string]*span)
+	for i, d := range ds {
+		if s, ok := spans[d.Kind]; ok {
+			s.last = i
+			s.count++
+		} else {
+			spans[d.Kind] = &span{first: i, last: i, count: 1}
+		}
+	}
+
+	groups := make(map[string][]*srvpb.FileDecorations_Decoration, len(spans))
+	for kind, s := range spans {
+		if s.last-s.first+1 == s.count {
+			groups[kind] = ds[s.first : s.last+1 : s.last+1]
+			continue
+		}
+		g := make([]*srvpb.FileDecorations_Decoration, 0, s.count)
+		for _, d := range ds[s.first : s.last+1] {
+			if d.Kind == kind {
+				g = append(g, d)
+			}
+		}
+		groups[kind] = g
+	}
+	return groups
+}
+
+// DecorationKinds returns the sorted set of distinct edge kinds in ds.
+func DecorationKinds(ds []*srvpb.FileDecorations_Decoration) []string {
+	seen := make(map[string]bool)
+	var kinds []string
+	for _, d := range ds {
+		if !seen[d.Kind] {
+			seen[d.Kind] = true
+			kinds = append(kinds, d.Kind)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// DecorationsInRange returns the decorations of fd whose anchors overlap the
+// byte range [start, end), in their original order.  fd.Decoration must be
+// sorted by ByOffset.  The result is a sub-slice of fd.Decoration when the
+// overlapping decorations are adjacent.  An empty range overlaps nothing.
+func DecorationsInRange(fd *srvpb.FileDecorations, start, end int32) []*srvpb.FileDecorations_Decoration {
+	if start >= end {
+		return nil
+	}
+	ds := fd.Decoration
+	// Decorations at or after hi start past the range.
+	hi := sort.Search(len(ds), func(i int) bool { return ds[i].Anchor.StartOffset >= end })
+	overlaps := func(d *srvpb.FileDecorations_Decoration) bool { return d.Anchor.EndOffset > start }
+
+	lo := 0
+	for lo < hi && !overlaps(ds[lo]) {
+		lo++
+	}
+	for i := lo; i < hi; i++ {
+		if !overlaps(ds[i]) {
+			// A decoration ending before start is interleaved with overlapping
+			// decorations; copy only those overlapping.
+			res := make([]*srvpb.FileDecorations_Decoration, 0, hi-lo)
+			for _, d := range ds[lo:hi] {
+				if overlaps(d) {
+					res = append(res, d)
+				}
+			}
+			return res
+		}
+	}
+	if lo == hi {
+		return nil
+	}
+	return ds[lo:hi:hi]
+}
+
+// MergeDecorationFragments combines the FileDecorations fragments emitted by a
+// DecorationFragmentBuilder for the given file ticket.  Exactly one fragment
+// must carry the File, and its ticket must match.  The result's decorations
+// are sorted by ByOffset and its targets are deduplicated and sorted by
+// ByTicket.
+func MergeDecorationFragments(ticket string, fragments []*srvpb.FileDecorations) (*srvpb.FileDecorations, error) {
+	res := &srvpb.FileDecorations{}
+	targets := make(map[string]*srvpb.Node)
+	for _, fragment := range fragments {
+		if fragment.File != nil {
+			if res.File != nil {
+				return nil, fmt.Errorf("multiple file fragments for %q", ticket)
+			} else if fragment.File.Ticket != ticket {
+				return nil, fmt.Errorf("mismatched file fragment: expected %q; found %q", ticket, fragment.File.Ticket)
+			}
+			res.File = fragment.File
+		}
+		res.Decoration = append(res.Decoration, fragment.Decoration...)
+		for _, n := range fragment.Target {
+			targets[n.Ticket] = n
+		}
+	}
+	if res.File == nil {
+		return nil, fmt.Errorf("missing file fragment for %q", ticket)
+	}
+
+	sort.Sort(ByOffset(res.Decoration))
+	for _, n := range targets {
+		res.Target = append(res.Target, n)
+	}
+	sort.Sort(ByTicket(res.Target))
+	return res, nil
+}
+
+// ValidateFileDecorations returns every inconsistency found in fd: a missing
+// File for a non-empty set of decorations, decorations missing an anchor or
+// target, anchor spans outside of the file's text, and decorations that are
+// out of ByOffset order or duplicate their predecessor.
+func ValidateFileDecorations(fd *srvpb.FileDecorations) []error {
+	var errs []error
+	if fd.File == nil && len(fd.Decoration) > 0 {
+		errs = append(errs, errors.New("missing file for decorations"))
+	}
+
+	ds := ByOffset(fd.Decoration)
+	for i, d := range ds {
+		if d.Target == "" {
+			errs = append(errs, fmt.Errorf("decoration %d: missing target", i))
+		}
+		if d.Anchor == nil {
+			errs = append(errs, fmt.Errorf("decoration %d: %v", i, ErrNilAnchor))
+			continue
+		}
+		if fd.File != nil {
+			if err := checkSpan(len(fd.File.Text), d.Anchor.StartOffset, d.Anchor.EndOffset); err != nil {
+				errs = append(errs, fmt.Errorf("decoration %d: invalid anchor offsets: %v", i, err))
+			}
+		}
+		if i == 0 || ds[i-1].Anchor == nil {
+			continue
+		}
+		if ds.Less(i, i-1) {
+			errs = append(errs, fmt.Errorf("decoration %d: out of order", i))
+		} else if !ds.Less(i-1, i) {
+			errs = append(errs, fmt.Errorf("decoration %d: duplicate of previous decoration", i))
+		}
+	}
+	return errs
+}
+
+// SplitLargeFileDecorations splits fd into chunks, each of whose encoded size
+// is at most maxProtoBytes, unless a single decoration alone exceeds it.  The
+// first chunk carries all of fd's fields other than its decorations (including
+// the File); every later chunk carries only the next batch of decorations.  If
+// fd is small enough, it is returned as the sole chunk.
+//
+// Consumers can reassemble the original FileDecorations by merging the chunks
+// read for a file (see MergeDecorationFragments).
+func SplitLargeFileDecorations(fd *srvpb.FileDecorations, maxProtoBytes int64) []*srvpb.FileDecorations {
+	if int64(proto.Size(fd)) <= maxProtoBytes {
+		return []*srvpb.FileDecorations{fd}
+	}
+
+	chunk := &srvpb.FileDecorations{
+		File:              fd.File,
+		Target:            fd.Target,
+		TargetDefinitions: fd.TargetDefinitions,
+		TargetOverride:    fd.TargetOverride,
+	}
+	size := int64(proto.Size(chunk))
+	chunks := []*srvpb.FileDecorations{chunk}
+	for _, d := range fd.Decoration {
+		n := proto.Size(d)
+		// Each repeated field element is prefixed by its 1-byte tag and length.
+		dsize := int64(1 + proto.SizeVarint(uint64(n)) + n)
+		// An oversized decoration is given a chunk of its own rather than
+		// leaving an empty chunk behind.
+		if size+dsize > maxProtoBytes && (len(chunk.Decoration) > 0 || len(chunks) == 1) {
+			chunk = &srvpb.FileDecorations{}
+			chunks = append(chunks, chunk)
+			size = 0
+		}
+		chunk.Decoration = append(chunk.Decoration, d)
+		size += dsize
+	}
+	return chunks
+}
+
 // ByTicket sorts nodes by their ticket.
 type ByTicket []*srvpb.Node
 
@@ -370,6 +1492,25 @@ func (s ByTicket) Len() int           { return len(s) }
 func (s ByTicket) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s ByTicket) Less(i, j int) bool { return s[i].Ticket < s[j].Ticket }
 
+// SortNodes stably sorts nodes in place by ticket and returns it.
+func SortNodes(nodes []*srvpb.Node) []*srvpb.Node {
+	sort.Stable(ByTicket(nodes))
+	return nodes
+}
+
+// DeduplicateNodes removes each node of the sorted slice nodes whose ticket
+// duplicates that of a preceding node.  The result reuses the backing array of
+// nodes.
+func DeduplicateNodes(nodes []*srvpb.Node) []*srvpb.Node {
+	res := nodes[:0]
+	for i := 0; i < len(nodes); {
+		res = append(res, nodes[i])
+		ticket := nodes[i].Ticket
+		i += sort.Search(len(nodes)-i, func(j int) bool { return nodes[i+j].Ticket > ticket })
+	}
+	return res
+}
+
 // ByAnchorTicket sorts anchors by their ticket.
 type ByAnchorTicket []*srvpb.ExpandedAnchor
 
@@ -393,20 +1534,67 @@ type EdgeSetBuilder struct {
 	// attempted.
 	MaxEdgePageSize int
 
+	// MaxEdgePages is the maximum number of EdgePages that may be emitted for a
+	// single PagedEdgeSet.  If exceeded, AddGroup will return
+	// ErrEdgePageLimitExceeded.  If MaxEdgePages <= 0, there is no limit.
+	MaxEdgePages int
+
 	// Output is used to emit each PagedEdgeSet constructed.
 	Output func(context.Context, *srvpb.PagedEdgeSet) error
 	// OutputPage is used to emit each EdgePage constructed.
 	OutputPage func(context.Context, *srvpb.EdgePage) error
 
-	pager *pager.SetPager
+	pager       *pager.SetPager
+	stats       EdgeSetStats
+	pageKeyFunc func(sourceTicket string, pageIndex int) string
+	current     string
+	progress    ProgressTracker
+}
+
+// EdgeSetStats are cumulative statistics about the PagedEdgeSets and EdgePages
+// emitted by an EdgeSetBuilder.
+type EdgeSetStats struct {
+	TotalSets        int // number of PagedEdgeSets emitted
+	TotalInlineEdges int // number of edges stored directly in PagedEdgeSets
+	TotalPagedEdges  int // number of edges stored in EdgePages
+	TotalPages       int // number of EdgePages emitted
+	MaxEdgesPerSet   int // largest TotalEdges of any PagedEdgeSet
+}
+
+// Stats returns the statistics for each PagedEdgeSet emitted so far.
+func (b *EdgeSetBuilder) Stats() EdgeSetStats { return b.stats }
+
+// SetPageKeyFunc sets the function used to generate the key of each EdgePage
+// given its source ticket and its index within the PagedEdgeSet.  By default,
+// keys are of the form "<ticket>.<index>".
+func (b *EdgeSetBuilder) SetPageKeyFunc(fn func(sourceTicket string, pageIndex int) string) {
+	b.pageKeyFunc = fn
+}
+
+// SetProgressTracker sets the ProgressTracker notified of each edge set started
+// and each edge added.  If t is nil, no progress is reported.
+func (b *EdgeSetBuilder) SetProgressTracker(t ProgressTracker) { b.progress = t }
+
+func (b *EdgeSetBuilder) pageKey(src string, n int) string {
+	if b.pageKeyFunc != nil {
+		return b.pageKeyFunc(src, n)
+	}
+	return newPageKey(src, n)
 }
 
+// ErrEdgePageLimitExceeded is returned by EdgeSetBuilder.AddGroup when a
+// PagedEdgeSet would require more than MaxEdgePages EdgePages.
+var ErrEdgePageLimitExceeded = errors.New("edge page limit exceeded")
+
+func nodeTicket(hd pager.Head) string { return hd.(*srvpb.Node).Ticket }
+
 func (b *EdgeSetBuilder) constructPager() *pager.SetPager {
 	// Head:  *srvpb.Node
 	// Set:   *srvpb.PagedEdgeSet
 	// Group: *srvpb.EdgeGroup
 	return &pager.SetPager{
 		MaxPageSize: b.MaxEdgePageSize,
+		HeadKey:     nodeTicket,
 
 		NewSet: func(hd pager.Head) pager.Set {
 			return &srvpb.PagedEdgeSet{
@@ -445,57 +1633,653 @@ func (b *EdgeSetBuilder) constructPager() *pager.SetPager {
 			sort.Sort(byPageKind(pes.PageIndex))
 			pes.TotalEdges = int32(total)
 
+			var inline int
+			for _, g := range pes.Group {
+				inline += len(g.Edge)
+			}
+			b.stats.TotalSets++
+			b.stats.TotalInlineEdges += inline
+			b.stats.TotalPagedEdges += total - inline
+			b.stats.TotalPages += len(pes.PageIndex)
+			if total > b.stats.MaxEdgesPerSet {
+				b.stats.MaxEdgesPerSet = total
+			}
+
 			return b.Output(ctx, pes)
 		},
 		OutputPage: func(ctx context.Context, s pager.Set, g pager.Group) error {
 			pes := s.(*srvpb.PagedEdgeSet)
 			eviction := g.(*srvpb.EdgeGroup)
 
+			if b.MaxEdgePages > 0 && len(pes.PageIndex) >= b.MaxEdgePages {
+				return ErrEdgePageLimitExceeded
+			}
+
 			src := pes.Source.Ticket
-			key := newPageKey(src, len(pes.PageIndex))
+			key := b.pageKey(src, len(pes.PageIndex))
+
+			// Output the EdgePage and add it to the page indices
+			if err := b.OutputPage(ctx, &srvpb.EdgePage{
+				PageKey:      key,
+				SourceTicket: src,
+				EdgesGroup:   eviction,
+			}); err != nil {
+				return fmt.Errorf("error emitting EdgePage: %v", err)
+			}
+			pes.PageIndex = append(pes.PageIndex, &srvpb.PageIndex{
+				PageKey:   key,
+				EdgeKind:  eviction.Kind,
+				EdgeCount: int32(len(eviction.Edge)),
+			})
+			return nil
+		},
+	}
+}
+
+// StartEdgeSet begins a new EdgeSet for the given source node, possibly
+// emitting a PagedEdgeSet for the previous EdgeSet.  Each following call to
+// AddGroup adds the group to this new EdgeSet until another call to
+// StartEdgeSet is made.
+func (b *EdgeSetBuilder) StartEdgeSet(ctx context.Context, src *srvpb.Node) error {
+	if b.pager == nil {
+		b.pager = b.constructPager()
+	}
+	b.current = src.Ticket
+	if b.progress != nil {
+		b.progress.OnSource(src.Ticket)
+	}
+	return b.pager.StartSet(ctx, src)
+}
+
+// CurrentSource returns the ticket of the source node given to the latest call
+// to StartEdgeSet.
+func (b *EdgeSetBuilder) CurrentSource() string { return b.current }
+
+// AddGroup adds a EdgeSet_Group to current EdgeSet being built, possibly
+// emitting a new PagedEdgeSet and/or EdgePage.  StartEdgeSet must be called
+// before any calls to this method.  See EdgeSetBuilder's documentation for the
+// assumed order of the groups and this method's relation to StartEdgeSet.
+// Duplicate edges within the group are dropped (see EdgeGroupDeduplicate).
+func (b *EdgeSetBuilder) AddGroup(ctx context.Context, eg *srvpb.EdgeGroup) error {
+	if deduped, n := EdgeGroupDeduplicate(eg); n > 0 {
+		eg = deduped
+	}
+	if b.progress != nil {
+		for range eg.Edge {
+			b.progress.OnEdge()
+		}
+	}
+	return b.pager.AddGroup(ctx, eg)
+}
+
+// EdgeCountByKind returns the number of edges of each kind in the given
+// PagedEdgeSet, including both its inline groups and its EdgePages.
+func EdgeCountByKind(pes *srvpb.PagedEdgeSet) map[string]int {
+	counts := make(map[string]int)
+	for _, g := range pes.Group {
+		counts[g.Kind] += len(g.Edge)
+	}
+	for _, idx := range pes.PageIndex {
+		counts[idx.EdgeKind] += int(idx.EdgeCount)
+	}
+	return counts
+}
+
+// EdgeSetForKind returns the inline group of pes with the given edge kind.  If
+// there is no such group but pes has an EdgePage of that kind, a nil group is
+// returned with paged set to true; the page keys can then be found in
+// pes.PageIndex.  If pes has no edges of the given kind, (nil, false) is
+// returned.
+func EdgeSetForKind(pes *srvpb.PagedEdgeSet, kind string) (group *srvpb.EdgeGroup, paged bool) {
+	for _, g := range pes.Group {
+		if g.Kind == kind {
+			return g, false
+		}
+	}
+	for _, idx := range pes.PageIndex {
+		if idx.EdgeKind == kind {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// EdgeSetHasKind reports whether pes has any inline group or EdgePage with the
+// given edge kind.
+func EdgeSetHasKind(pes *srvpb.PagedEdgeSet, kind string) bool {
+	g, paged := EdgeSetForKind(pes, kind)
+	return g != nil || paged
+}
+
+// PageIndexToMap returns the PageIndex entries of pes grouped by edge kind,
+// retaining their order within each kind.  The result is never nil, even for a
+// nil pes.
+func PageIndexToMap(pes *srvpb.PagedEdgeSet) map[string][]*srvpb.PageIndex {
+	m := make(map[string][]*srvpb.PageIndex)
+	for _, idx := range pes.GetPageIndex() {
+		m[idx.EdgeKind] = append(m[idx.EdgeKind], idx)
+	}
+	return m
+}
+
+// CrossRefPageIndexToMap returns the PageIndex entries of xs grouped by kind,
+// retaining their order within each kind.  The result is never nil, even for a
+// nil xs.
+func CrossRefPageIndexToMap(xs *srvpb.PagedCrossReferences) map[string][]*srvpb.PagedCrossReferences_PageIndex {
+	m := make(map[string][]*srvpb.PagedCrossReferences_PageIndex)
+	for _, idx := range xs.GetPageIndex() {
+		m[idx.Kind] = append(m[idx.Kind], idx)
+	}
+	return m
+}
+
+// ValidatePagedEdgeSet returns every inconsistency found in pes: a missing or
+// unparseable source ticket, empty inline groups, PageIndex entries missing an
+// edge kind or page key, duplicate page keys, and a TotalEdges that differs
+// from the number of edges in its inline groups and pages.
+func ValidatePagedEdgeSet(pes *srvpb.PagedEdgeSet) []error {
+	var errs []error
+	if pes.Source == nil {
+		errs = append(errs, errors.New("missing source node"))
+	} else if _, err := kytheuri.Parse(pes.Source.Ticket); err != nil || pes.Source.Ticket == "" {
+		errs = append(errs, fmt.Errorf("invalid source ticket %q", pes.Source.Ticket))
+	}
+
+	var total int
+	for i, g := range pes.Group {
+		if len(g.Edge) == 0 {
+			errs = append(errs, fmt.Errorf("group %d (%q): no edges", i, g.Kind))
+		}
+		total += len(g.Edge)
+	}
+	keys := make(map[string]bool, len(pes.PageIndex))
+	for i, idx := range pes.PageIndex {
+		if idx.EdgeKind == "" {
+			errs = append(errs, fmt.Errorf("page index %d: missing edge kind", i))
+		}
+		if idx.PageKey == "" {
+			errs = append(errs, fmt.Errorf("page index %d: missing page key", i))
+		} else if keys[idx.PageKey] {
+			errs = append(errs, fmt.Errorf("page index %d: duplicate page key %q", i, idx.PageKey))
+		}
+		keys[idx.PageKey] = true
+		total += int(idx.EdgeCount)
+	}
+	if int(pes.TotalEdges) != total {
+		errs = append(errs, fmt.Errorf("TotalEdges is %d; found %d edges", pes.TotalEdges, total))
+	}
+	return errs
+}
+
+// ValidatePagedCrossReferences returns every inconsistency found in xs: a
+// missing or unparseable source ticket, inline groups without a kind,
+// PageIndex entries missing a kind or page key, duplicate page keys, and a
+// TotalReferences that differs from the number of anchors in its inline groups
+// and pages.  Since xs does not carry its source node's facts, the Incomplete
+// flag is not checked.
+func ValidatePagedCrossReferences(xs *srvpb.PagedCrossReferences) []error {
+	var errs []error
+	if _, err := kytheuri.Parse(xs.SourceTicket); err != nil || xs.SourceTicket == "" {
+		errs = append(errs, fmt.Errorf("invalid source ticket %q", xs.SourceTicket))
+	}
+
+	var total int
+	for i, g := range xs.Group {
+		if g == nil || g.Kind == "" {
+			errs = append(errs, fmt.Errorf("group %d: missing kind", i))
+			continue
+		}
+		total += len(g.Anchor)
+	}
+	keys := make(map[string]bool, len(xs.PageIndex))
+	for i, idx := range xs.PageIndex {
+		if idx.Kind == "" {
+			errs = append(errs, fmt.Errorf("page index %d: missing kind", i))
+		}
+		if idx.PageKey == "" {
+			errs = append(errs, fmt.Errorf("page index %d: missing page key", i))
+		} else if keys[idx.PageKey] {
+			errs = append(errs, fmt.Errorf("page index %d: duplicate page key %q", i, idx.PageKey))
+		}
+		keys[idx.PageKey] = true
+		total += int(idx.Count)
+	}
+	if int(xs.TotalReferences) != total {
+		errs = append(errs, fmt.Errorf("TotalReferences is %d; found %d references", xs.TotalReferences, total))
+	}
+	return errs
+}
+
+// EdgeGroupDeduplicate returns eg without any edges sharing the
+// (Target.Ticket, Ordinal) pair of an earlier edge in the group along with the
+// number of edges removed.  If eg has no duplicates, eg itself is returned;
+// otherwise, a copy is returned and eg is not modified.
+func EdgeGroupDeduplicate(eg *srvpb.EdgeGroup) (*srvpb.EdgeGroup, int) {
+	if edgesStrictlySorted(eg.Edge) {
+		// Duplicates would be adjacent; there are none.
+		return eg, 0
+	}
+
+	type key struct {
+		ticket  string
+		ordinal int32
+	}
+	seen := make(map[key]bool, len(eg.Edge))
+	var res *srvpb.EdgeGroup
+	for i, e := range eg.Edge {
+		k := key{e.GetTarget().GetTicket(), e.Ordinal}
+		if seen[k] {
+			if res == nil {
+				res = &srvpb.EdgeGroup{
+					Kind: eg.Kind,
+					Edge: make([]*srvpb.EdgeGroup_Edge, i, len(eg.Edge)),
+				}
+				copy(res.Edge, eg.Edge[:i])
+			}
+			continue
+		}
+		seen[k] = true
+		if res != nil {
+			res.Edge = append(res.Edge, e)
+		}
+	}
+	if res == nil {
+		return eg, 0
+	}
+	return res, len(eg.Edge) - len(res.Edge)
+}
+
+// edgesStrictlySorted reports whether es is strictly increasing by either
+// (Ordinal, Target.Ticket) or (Target.Ticket, Ordinal).
+func edgesStrictlySorted(es []*srvpb.EdgeGroup_Edge) bool {
+	byOrdinal, byTicket := true, true
+	for i := 1; i < len(es) && (byOrdinal || byTicket); i++ {
+		po, pt := es[i-1].Ordinal, es[i-1].GetTarget().GetTicket()
+		co, ct := es[i].Ordinal, es[i].GetTarget().GetTicket()
+		byOrdinal = byOrdinal && (po < co || (po == co && pt < ct))
+		byTicket = byTicket && (pt < ct || (pt == ct && po < co))
+	}
+	return byOrdinal || byTicket
+}
+
+// Flush signals the end of the current PagedEdgeSet being built, flushing it,
+// and its EdgeSet_Groups to the output function.  This should be called after
+// the final call to AddGroup.  Manually calling Flush at any other time is
+// unnecessary.
+func (b *EdgeSetBuilder) Flush(ctx context.Context) error { return b.pager.Flush(ctx) }
+
+// CheckpointableEdgeSetBuilder wraps an EdgeSetBuilder so that an interrupted
+// build can be resumed.  As each PagedEdgeSet and EdgePage is emitted, a record
+// of it is appended to a checkpoint.  Given a previous checkpoint, any source
+// already recorded in it is skipped.
+//
+// A checkpoint is a sequence of lines, each either "set <ticket>" or
+// "page <key>".  Each new checkpoint begins with a copy of the previous
+// checkpoint's records, so it should be written to a fresh file rather than
+// appended to the previous one.  Since an EdgePage is emitted before its PagedEdgeSet, a
+// source whose set was not recorded may have some of its pages recorded; such
+// sources are rebuilt in full.
+type CheckpointableEdgeSetBuilder struct {
+	esb        *EdgeSetBuilder
+	checkpoint io.Writer
+
+	done     stringset.Set
+	pageKeys []string
+	skipping string
+	skipped  int
+}
+
+const (
+	checkpointSet  = "set "
+	checkpointPage = "page "
+)
+
+// NewCheckpointableEdgeSetBuilder returns a CheckpointableEdgeSetBuilder
+// wrapping esb, whose Output and OutputPage functions are replaced by
+// recording versions.  If prev is non-nil, it is read as a previous
+// checkpoint and its records are copied to checkpoint.  New checkpoint records
+// are then written to checkpoint as they are emitted.
+func NewCheckpointableEdgeSetBuilder(esb *EdgeSetBuilder, prev io.Reader, checkpoint io.Writer) (*CheckpointableEdgeSetBuilder, error) {
+	b := &CheckpointableEdgeSetBuilder{
+		esb:        esb,
+		checkpoint: checkpoint,
+		done:       stringset.New(),
+	}
+	if prev != nil {
+		var records bytes.Buffer
+		s := bufio.NewScanner(prev)
+		for s.Scan() {
+			switch line := s.Text(); {
+			case strings.HasPrefix(line, checkpointSet):
+				b.done.Add(strings.TrimPrefix(line, checkpointSet))
+			case strings.HasPrefix(line, checkpointPage):
+				b.pageKeys = append(b.pageKeys, strings.TrimPrefix(line, checkpointPage))
+			case line == "":
+				continue
+			default:
+				return nil, fmt.Errorf("invalid checkpoint record: %q", line)
+			}
+			records.WriteString(s.Text())
+			records.WriteByte('\n')
+		}
+		if err := s.Err(); err != nil {
+			return nil, fmt.Errorf("error reading checkpoint: %v", err)
+		}
+		if _, err := checkpoint.Write(records.Bytes()); err != nil {
+			return nil, fmt.Errorf("error writing checkpoint: %v", err)
+		}
+	}
+
+	output, outputPage := esb.Output, esb.OutputPage
+	esb.Output = func(ctx context.Context, pes *srvpb.PagedEdgeSet) error {
+		if err := output(ctx, pes); err != nil {
+			return err
+		}
+		return b.record(checkpointSet, pes.Source.Ticket)
+	}
+	esb.OutputPage = func(ctx context.Context, ep *srvpb.EdgePage) error {
+		if err := outputPage(ctx, ep); err != nil {
+			return err
+		}
+		return b.record(checkpointPage, ep.PageKey)
+	}
+	return b, nil
+}
+
+func (b *CheckpointableEdgeSetBuilder) record(prefix, key string) error {
+	if _, err := io.WriteString(b.checkpoint, prefix+key+"\n"); err != nil {
+		return fmt.Errorf("error writing checkpoint: %v", err)
+	}
+	return nil
+}
+
+// PageKeys returns the key of each EdgePage recorded in the previous
+// checkpoint.
+func (b *CheckpointableEdgeSetBuilder) PageKeys() []string { return b.pageKeys }
+
+// Skipped returns the number of sources skipped because they were recorded in
+// the previous checkpoint.
+func (b *CheckpointableEdgeSetBuilder) Skipped() int { return b.skipped }
+
+// CurrentSource returns the ticket of the source node given to the latest call
+// to StartEdgeSet, whether or not it is being skipped.
+func (b *CheckpointableEdgeSetBuilder) CurrentSource() string {
+	if b.skipping != "" {
+		return b.skipping
+	}
+	return b.esb.CurrentSource()
+}
+
+// StartEdgeSet begins a new EdgeSet for the given source node (see
+// EdgeSetBuilder.StartEdgeSet) unless the source was recorded in the previous
+// checkpoint.  In that case, the source's groups are ignored until the next
+// call to StartEdgeSet.
+func (b *CheckpointableEdgeSetBuilder) StartEdgeSet(ctx context.Context, src *srvpb.Node) error {
+	if b.done.Contains(src.Ticket) {
+		b.skipping = src.Ticket
+		b.skipped++
+		return nil
+	}
+	b.skipping = ""
+	return b.esb.StartEdgeSet(ctx, src)
+}
+
+// AddGroup adds a group to the current EdgeSet (see EdgeSetBuilder.AddGroup)
+// unless its source is being skipped.
+func (b *CheckpointableEdgeSetBuilder) AddGroup(ctx context.Context, eg *srvpb.EdgeGroup) error {
+	if b.skipping != "" {
+		return nil
+	}
+	return b.esb.AddGroup(ctx, eg)
+}
+
+// Flush flushes the underlying EdgeSetBuilder (see EdgeSetBuilder.Flush),
+// recording its final PagedEdgeSet and EdgePages in the checkpoint.
+func (b *CheckpointableEdgeSetBuilder) Flush(ctx context.Context) error {
+	if b.esb.pager == nil {
+		return nil
+	}
+	return b.esb.Flush(ctx)
+}
+
+// MergePagedEdgeSets combines two PagedEdgeSets for the same source node.  The
+// groups of each set, including those of its existing EdgePages (as retrieved
+// by loader), are merged by edge kind, dropping any duplicate edges, and the
+// facts of both source nodes are merged (see MergeNodes).  If the merged edges
+// exceed maxEdgePageSize (and maxEdgePageSize > 0), the excess edges are
+// re-paged into EdgePages which are emitted using output; otherwise, every
+// edge is kept inline.  The returned PagedEdgeSet has a new PageIndex and its
+// TotalEdges matches its contents.
+//
+// New EdgePages are given keys unused by a and b, so the existing EdgePages
+// are no longer referenced by the merged PagedEdgeSet and may be deleted once
+// it is written.
+func MergePagedEdgeSets(ctx context.Context, a, b *srvpb.PagedEdgeSet, maxEdgePageSize int, loader func(key string) (*srvpb.EdgePage, error), output func(context.Context, *srvpb.EdgePage) error) (*srvpb.PagedEdgeSet, error) {
+	if a.GetSource() == nil || b.GetSource() == nil {
+		return nil, errors.New("PagedEdgeSet missing source node")
+	}
+	src, err := MergeNodes(a.Source, b.Source)
+	if err != nil {
+		return nil, fmt.Errorf("error merging PagedEdgeSet sources: %v", err)
+	}
+
+	type edgeKey struct {
+		target  string
+		ordinal int32
+	}
+	groups := make(map[string]*srvpb.EdgeGroup)
+	seenEdges := make(map[string]map[edgeKey]bool)
+	pageKeys := make(map[string]bool)
+	for _, pes := range []*srvpb.PagedEdgeSet{a, b} {
+		flattened, err := FlattenPagedEdgeSet(pes, loader)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range flattened {
+			eg, ok := groups[g.Kind]
+			if !ok {
+				eg = &srvpb.EdgeGroup{Kind: g.Kind}
+				groups[g.Kind] = eg
+				seenEdges[g.Kind] = make(map[edgeKey]bool)
+			}
+			for _, e := range g.Edge {
+				k := edgeKey{e.Target.GetTicket(), e.Ordinal}
+				if !seenEdges[g.Kind][k] {
+					seenEdges[g.Kind][k] = true
+					eg.Edge = append(eg.Edge, e)
+				}
+			}
+		}
+		for _, idx := range pes.PageIndex {
+			pageKeys[idx.PageKey] = true
+		}
+	}
+
+	var merged *srvpb.PagedEdgeSet
+	esb := &EdgeSetBuilder{
+		MaxEdgePageSize: maxEdgePageSize,
+		Output: func(_ context.Context, pes *srvpb.PagedEdgeSet) error {
+			merged = pes
+			return nil
+		},
+		OutputPage: output,
+	}
+	var nextPage int
+	esb.SetPageKeyFunc(func(src string, _ int) string {
+		// Ensure new page keys do not collide with those of the existing pages.
+		for {
+			key := newPageKey(src, nextPage)
+			nextPage++
+			if !pageKeys[key] {
+				pageKeys[key] = true
+				return key
+			}
+		}
+	})
+
+	sorted := make([]*srvpb.EdgeGroup, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Sort(byEdgeKind(sorted))
+
+	if err := esb.StartEdgeSet(ctx, src); err != nil {
+		return nil, err
+	}
+	for _, g := range sorted {
+		if err := esb.AddGroup(ctx, g); err != nil {
+			return nil, err
+		}
+	}
+	if err := esb.Flush(ctx); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// FlattenPagedEdgeSet returns every EdgeGroup of pes: its inline groups along
+// with the group of each EdgePage in its PageIndex, as retrieved by loader.
+// Groups are not merged; they are stably sorted by edge kind.
+func FlattenPagedEdgeSet(pes *srvpb.PagedEdgeSet, loader func(key string) (*srvpb.EdgePage, error)) ([]*srvpb.EdgeGroup, error) {
+	groups := make([]*srvpb.EdgeGroup, 0, len(pes.Group)+len(pes.PageIndex))
+	groups = append(groups, pes.Group...)
+	for _, idx := range pes.PageIndex {
+		pg, err := loader(idx.PageKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading EdgePage %q: %v", idx.PageKey, err)
+		} else if pg.EdgesGroup == nil {
+			return nil, fmt.Errorf("EdgePage %q has no edges", idx.PageKey)
+		}
+		groups = append(groups, pg.EdgesGroup)
+	}
+	sort.Stable(byEdgeKind(groups))
+	return groups, nil
+}
+
+// FlattenPagedCrossReferences returns every group of xs: its inline groups
+// along with the group of each page in its PageIndex, as retrieved by loader.
+// Groups are not merged; they are stably sorted by kind.
+func FlattenPagedCrossReferences(xs *srvpb.PagedCrossReferences, loader func(key string) (*srvpb.PagedCrossReferences_Page, error)) ([]*srvpb.PagedCrossReferences_Group, error) {
+	groups := make([]*srvpb.PagedCrossReferences_Group, 0, len(xs.Group)+len(xs.PageIndex))
+	groups = append(groups, xs.Group...)
+	for _, idx := range xs.PageIndex {
+		pg, err := loader(idx.PageKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading PagedCrossReferences_Page %q: %v", idx.PageKey, err)
+		} else if pg.Group == nil {
+			return nil, fmt.Errorf("PagedCrossReferences_Page %q has no group", idx.PageKey)
+		}
+		groups = append(groups, pg.Group)
+	}
+	sort.Stable(byRefKind(groups))
+	return groups, nil
+}
+
+// ExtractDefinitions returns the anchors of each inline group of xs whose kind
+// is a variant of edges.Defines (in either direction).  Paged groups are not
+// included; see FlattenPagedCrossReferences.
+func ExtractDefinitions(xs *srvpb.PagedCrossReferences) []*srvpb.ExpandedAnchor {
+	return extractAnchors(xs, edges.Defines)
+}
+
+// ExtractReferences returns the anchors of each inline group of xs whose kind
+// is a variant of edges.Ref (in either direction).  Paged groups are not
+// included; see FlattenPagedCrossReferences.
+func ExtractReferences(xs *srvpb.PagedCrossReferences) []*srvpb.ExpandedAnchor {
+	return extractAnchors(xs, edges.Ref)
+}
+
+func extractAnchors(xs *srvpb.PagedCrossReferences, kind string) []*srvpb.ExpandedAnchor {
+	var anchors []*srvpb.ExpandedAnchor
+	for _, g := range xs.Group {
+		if edges.IsVariant(edges.Canonical(g.Kind), kind) {
+			anchors = append(anchors, g.Anchor...)
+		}
+	}
+	return anchors
+}
 
-			// Output the EdgePage and add it to the page indices
-			if err := b.OutputPage(ctx, &srvpb.EdgePage{
-				PageKey:      key,
-				SourceTicket: src,
-				EdgesGroup:   eviction,
-			}); err != nil {
-				return fmt.Errorf("error emitting EdgePage: %v", err)
-			}
-			pes.PageIndex = append(pes.PageIndex, &srvpb.PageIndex{
-				PageKey:   key,
-				EdgeKind:  eviction.Kind,
-				EdgeCount: int32(len(eviction.Edge)),
-			})
-			return nil
-		},
+// GroupCrossReferencesByKind groups the TargetAnchor of each of the given
+// cross-references by the anchor's Kind.  Anchors keep their relative order
+// within each group and the groups are sorted by kind.  Cross-references
+// without a TargetAnchor are skipped.
+func GroupCrossReferencesByKind(refs []*ipb.CrossReference) []*srvpb.PagedCrossReferences_Group {
+	byKind := make(map[string]*srvpb.PagedCrossReferences_Group)
+	var groups []*srvpb.PagedCrossReferences_Group
+	for _, ref := range refs {
+		ea := ref.TargetAnchor
+		if ea == nil {
+			continue
+		}
+		g, ok := byKind[ea.Kind]
+		if !ok {
+			g = &srvpb.PagedCrossReferences_Group{Kind: ea.Kind}
+			byKind[ea.Kind] = g
+			groups = append(groups, g)
+		}
+		g.Anchor = append(g.Anchor, ea)
 	}
+	sort.Sort(byRefKind(groups))
+	return groups
 }
 
-// StartEdgeSet begins a new EdgeSet for the given source node, possibly
-// emitting a PagedEdgeSet for the previous EdgeSet.  Each following call to
-// AddGroup adds the group to this new EdgeSet until another call to
-// StartEdgeSet is made.
-func (b *EdgeSetBuilder) StartEdgeSet(ctx context.Context, src *srvpb.Node) error {
-	if b.pager == nil {
-		b.pager = b.constructPager()
+// CrossReferencesByFile groups the given cross-references by the file ticket
+// of their TargetAnchor (see tickets.AnchorFile).  Since ExpandedAnchors do not
+// record their parent file, it is derived from each anchor's ticket; any
+// cross-reference whose file cannot be derived is grouped under "".  Each
+// group is stably sorted by the starting line number of its anchors.
+func CrossReferencesByFile(refs []*ipb.CrossReference) map[string][]*ipb.CrossReference {
+	byFile := make(map[string][]*ipb.CrossReference)
+	for _, ref := range refs {
+		file, err := tickets.AnchorFile(ref.GetTargetAnchor().GetTicket())
+		if err != nil {
+			file = ""
+		}
+		byFile[file] = append(byFile[file], ref)
 	}
-	return b.pager.StartSet(ctx, src)
+	for _, refs := range byFile {
+		sort.Stable(byAnchorLine(refs))
+	}
+	return byFile
 }
 
-// AddGroup adds a EdgeSet_Group to current EdgeSet being built, possibly
-// emitting a new PagedEdgeSet and/or EdgePage.  StartEdgeSet must be called
-// before any calls to this method.  See EdgeSetBuilder's documentation for the
-// assumed order of the groups and this method's relation to StartEdgeSet.
-func (b *EdgeSetBuilder) AddGroup(ctx context.Context, eg *srvpb.EdgeGroup) error {
-	return b.pager.AddGroup(ctx, eg)
+// byAnchorLine sorts cross-references by the starting line of their
+// TargetAnchor.
+type byAnchorLine []*ipb.CrossReference
+
+func (s byAnchorLine) Len() int      { return len(s) }
+func (s byAnchorLine) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byAnchorLine) Less(i, j int) bool {
+	return s[i].GetTargetAnchor().GetSpan().GetStart().GetLineNumber() <
+		s[j].GetTargetAnchor().GetSpan().GetStart().GetLineNumber()
 }
 
-// Flush signals the end of the current PagedEdgeSet being built, flushing it,
-// and its EdgeSet_Groups to the output function.  This should be called after
-// the final call to AddGroup.  Manually calling Flush at any other time is
-// unnecessary.
-func (b *EdgeSetBuilder) Flush(ctx context.Context) error { return b.pager.Flush(ctx) }
+// TruncateCrossReferences returns the given cross-references limited to the
+// first maxPerKind of each TargetAnchor kind, in their original order, and
+// whether any were dropped.  If nothing is dropped, refs itself is returned.
+// A maxPerKind <= 0 means no limit, as with SetMaxAnchorsPerKind.
+func TruncateCrossReferences(refs []*ipb.CrossReference, maxPerKind int) ([]*ipb.CrossReference, bool) {
+	if maxPerKind <= 0 {
+		return refs, false
+	}
+	counts := make(map[string]int)
+	var res []*ipb.CrossReference
+	for i, ref := range refs {
+		kind := ref.GetTargetAnchor().GetKind()
+		if counts[kind] < maxPerKind {
+			counts[kind]++
+			if res != nil {
+				res = append(res, ref)
+			}
+		} else if res == nil {
+			res = append(make([]*ipb.CrossReference, 0, len(refs)-1), refs[:i]...)
+		}
+	}
+	if res == nil {
+		return refs, false
+	}
+	return res, true
+}
 
 // CrossReferencesBuilder is a type wrapper around a pager.SetPager that emits
 // *srvpb.PagedCrossReferences and *srvpb.PagedCrossReferences_Pages.  Each
@@ -509,7 +2293,87 @@ type CrossReferencesBuilder struct {
 	Output     func(context.Context, *srvpb.PagedCrossReferences) error
 	OutputPage func(context.Context, *srvpb.PagedCrossReferences_Page) error
 
-	pager *pager.SetPager
+	pager       *pager.SetPager
+	stats       CrossRefBuildStats
+	pageKeyFunc func(sourceTicket string, pageIndex int) string
+
+	dedupAnchors bool
+	seenAnchors  map[string]stringset.Set // kind -> anchor tickets
+
+	filter       func(*srvpb.PagedCrossReferences_Group) bool
+	isIncomplete func(*srvpb.Node) bool
+	anchorLess   func(a, b *srvpb.ExpandedAnchor) bool
+
+	maxPerKind int
+	kindCounts map[string]int // kind -> anchors added to the current set
+
+	progress ProgressTracker
+}
+
+// SetDeduplicateAnchors determines whether an anchor added more than once for
+// the same kind within a set will be dropped after its first occurrence.
+// Anchors are compared by ticket.
+func (b *CrossReferencesBuilder) SetDeduplicateAnchors(dedup bool) { b.dedupAnchors = dedup }
+
+// SetFilter sets a predicate evaluated against each group passed to AddGroup.
+// Groups for which fn returns false are dropped.  A nil fn keeps every group.
+func (b *CrossReferencesBuilder) SetFilter(fn func(*srvpb.PagedCrossReferences_Group) bool) {
+	b.filter = fn
+}
+
+// SetIncompleteness sets the predicate used to determine whether a source
+// node's PagedCrossReferences is marked as Incomplete.  By default, a node is
+// incomplete if it has a facts.Complete value other than "definition".  This
+// must be called before the first call to StartSet.
+func (b *CrossReferencesBuilder) SetIncompleteness(fn func(*srvpb.Node) bool) {
+	b.isIncomplete = fn
+}
+
+// SetAnchorComparator sets the ordering of anchors within each group emitted by
+// the builder, including those emitted in pages.  fn should report whether a
+// sorts before b.  By default, anchors are kept in the order they were added.
+// This must be called before the first call to StartSet.
+func (b *CrossReferencesBuilder) SetAnchorComparator(fn func(a, b *srvpb.ExpandedAnchor) bool) {
+	b.anchorLess = fn
+}
+
+// SetMaxAnchorsPerKind limits the number of anchors of each kind in every
+// PagedCrossReferences to n; once the limit is reached, further anchors of the
+// kind are dropped (see TruncateCrossReferences).  A value of n <= 0 disables
+// the limit.
+func (b *CrossReferencesBuilder) SetMaxAnchorsPerKind(n int) { b.maxPerKind = n }
+
+// SetProgressTracker sets the ProgressTracker notified of each set started and
+// each cross-reference added.  If t is nil, no progress is reported.
+func (b *CrossReferencesBuilder) SetProgressTracker(t ProgressTracker) { b.progress = t }
+
+// CrossRefBuildStats are cumulative statistics about the PagedCrossReferences
+// and PagedCrossReferences_Pages emitted by a CrossReferencesBuilder.
+type CrossRefBuildStats struct {
+	TotalSets             int // number of PagedCrossReferences emitted
+	TotalInlineReferences int // number of anchors stored directly in PagedCrossReferences
+	TotalPagedReferences  int // number of anchors stored in pages
+	TotalPages            int // number of PagedCrossReferences_Pages emitted
+	MaxReferencesPerSet   int // largest TotalReferences of any PagedCrossReferences
+	DroppedGroups         int // number of groups rejected by the builder's filter
+	TruncatedReferences   int // number of anchors dropped by SetMaxAnchorsPerKind
+}
+
+// Stats returns the statistics for each PagedCrossReferences emitted so far.
+func (b *CrossReferencesBuilder) Stats() CrossRefBuildStats { return b.stats }
+
+// SetPageKeyFunc sets the function used to generate the key of each
+// PagedCrossReferences_Page given its source ticket and its index within the
+// PagedCrossReferences.  By default, keys are of the form "<ticket>.<index>".
+func (b *CrossReferencesBuilder) SetPageKeyFunc(fn func(sourceTicket string, pageIndex int) string) {
+	b.pageKeyFunc = fn
+}
+
+func (b *CrossReferencesBuilder) pageKey(src string, n int) string {
+	if b.pageKeyFunc != nil {
+		return b.pageKeyFunc(src, n)
+	}
+	return newPageKey(src, n)
 }
 
 func (b *CrossReferencesBuilder) constructPager() *pager.SetPager {
@@ -517,20 +2381,20 @@ func (b *CrossReferencesBuilder) constructPager() *pager.SetPager {
 	// Set:   *srvpb.PagedCrossReferences
 	// Group: *srvpb.PagedCrossReferences_Group
 	// Page:  *srvpb.PagedCrossReferences_Page
+	isIncomplete := b.isIncomplete
+	if isIncomplete == nil {
+		isIncomplete = defaultIncompleteness
+	}
+	less := b.anchorLess
 	return &pager.SetPager{
 		MaxPageSize: b.MaxPageSize,
+		HeadKey:     nodeTicket,
 
 		NewSet: func(hd pager.Head) pager.Set {
 			n := hd.(*srvpb.Node)
-			var incomplete bool
-			for _, f := range n.Fact {
-				if f.Name == facts.Complete && string(f.Value) != "definition" {
-					incomplete = true
-				}
-			}
 			return &srvpb.PagedCrossReferences{
 				SourceTicket: n.Ticket,
-				Incomplete:   incomplete,
+				Incomplete:   isIncomplete(n),
 			}
 		},
 		Combine: func(l, r pager.Group) pager.Group {
@@ -538,7 +2402,11 @@ func (b *CrossReferencesBuilder) constructPager() *pager.SetPager {
 			if lg.Kind != rg.Kind {
 				return nil
 			}
-			lg.Anchor = append(lg.Anchor, rg.Anchor...)
+			if less != nil {
+				lg.Anchor = mergeAnchors(lg.Anchor, rg.Anchor, less)
+			} else {
+				lg.Anchor = append(lg.Anchor, rg.Anchor...)
+			}
 			return lg
 		},
 		Split: func(sz int, g pager.Group) (l, r pager.Group) {
@@ -565,12 +2433,24 @@ func (b *CrossReferencesBuilder) constructPager() *pager.SetPager {
 			sort.Sort(byRefPageKind(xs.PageIndex))
 			xs.TotalReferences = int32(total)
 
+			var inline int
+			for _, g := range xs.Group {
+				inline += len(g.Anchor)
+			}
+			b.stats.TotalSets++
+			b.stats.TotalInlineReferences += inline
+			b.stats.TotalPagedReferences += total - inline
+			b.stats.TotalPages += len(xs.PageIndex)
+			if total > b.stats.MaxReferencesPerSet {
+				b.stats.MaxReferencesPerSet = total
+			}
+
 			return b.Output(ctx, xs)
 		},
 		OutputPage: func(ctx context.Context, s pager.Set, g pager.Group) error {
 			xs, xg := s.(*srvpb.PagedCrossReferences), g.(*srvpb.PagedCrossReferences_Group)
 
-			key := newPageKey(xs.SourceTicket, len(xs.PageIndex))
+			key := b.pageKey(xs.SourceTicket, len(xs.PageIndex))
 
 			pg := &srvpb.PagedCrossReferences_Page{
 				PageKey:      key,
@@ -587,12 +2467,28 @@ func (b *CrossReferencesBuilder) constructPager() *pager.SetPager {
 	}
 }
 
+// defaultIncompleteness reports whether n has a facts.Complete value other than
+// "definition".
+func defaultIncompleteness(n *srvpb.Node) bool {
+	for _, f := range n.Fact {
+		if f.Name == facts.Complete && string(f.Value) != "definition" {
+			return true
+		}
+	}
+	return false
+}
+
 // StartSet begins a new *srvpb.PagedCrossReferences.  As a side-effect, a
 // previously-built srvpb.PagedCrossReferences may be emitted.
 func (b *CrossReferencesBuilder) StartSet(ctx context.Context, src *srvpb.Node) error {
 	if b.pager == nil {
 		b.pager = b.constructPager()
 	}
+	b.seenAnchors = nil
+	b.kindCounts = nil
+	if b.progress != nil {
+		b.progress.OnSource(src.Ticket)
+	}
 	return b.pager.StartSet(ctx, src)
 }
 
@@ -600,15 +2496,199 @@ func (b *CrossReferencesBuilder) StartSet(ctx context.Context, src *srvpb.Node)
 // *srvpb.PagedCrossReferences.  The group should share the same source ticket
 // as given to the mostly recent invocation to StartSet.
 func (b *CrossReferencesBuilder) AddGroup(ctx context.Context, g *srvpb.PagedCrossReferences_Group) error {
+	if b.filter != nil && !b.filter(g) {
+		b.stats.DroppedGroups++
+		return nil
+	}
+	if b.dedupAnchors {
+		// Duplicates are removed before the group reaches the pager so that the
+		// pager's size accounting remains consistent with the groups it holds.
+		g = b.deduplicate(g)
+	}
+	if b.maxPerKind > 0 {
+		if g = b.truncate(g); len(g.Anchor) == 0 {
+			return nil
+		}
+	}
+	if b.anchorLess != nil {
+		// Each group is sorted before reaching the pager so that Combine only needs
+		// to merge already-sorted anchors.
+		anchors := make([]*srvpb.ExpandedAnchor, len(g.Anchor))
+		copy(anchors, g.Anchor)
+		sort.Stable(byAnchorLess{anchors, b.anchorLess})
+		g = &srvpb.PagedCrossReferences_Group{Kind: g.Kind, Anchor: anchors}
+	}
+	if b.progress != nil {
+		for range g.Anchor {
+			b.progress.OnCrossReference()
+		}
+	}
 	return b.pager.AddGroup(ctx, g)
 }
 
+// mergeAnchors merges the sorted anchors in r into the sorted anchors in l.
+// Anchors from l precede equivalent anchors from r.
+func mergeAnchors(l, r []*srvpb.ExpandedAnchor, less func(a, b *srvpb.ExpandedAnchor) bool) []*srvpb.ExpandedAnchor {
+	res := make([]*srvpb.ExpandedAnchor, 0, len(l)+len(r))
+	for len(l) > 0 && len(r) > 0 {
+		if less(r[0], l[0]) {
+			res, r = append(res, r[0]), r[1:]
+		} else {
+			res, l = append(res, l[0]), l[1:]
+		}
+	}
+	res = append(res, l...)
+	return append(res, r...)
+}
+
+// deduplicate returns a copy of g without any anchors previously seen for the
+// group's kind in the current set.
+func (b *CrossReferencesBuilder) deduplicate(g *srvpb.PagedCrossReferences_Group) *srvpb.PagedCrossReferences_Group {
+	if b.seenAnchors == nil {
+		b.seenAnchors = make(map[string]stringset.Set)
+	}
+	seen, ok := b.seenAnchors[g.Kind]
+	if !ok {
+		seen = stringset.New()
+		b.seenAnchors[g.Kind] = seen
+	}
+
+	res := &srvpb.PagedCrossReferences_Group{Kind: g.Kind}
+	for _, a := range g.Anchor {
+		if !seen.Contains(a.Ticket) {
+			seen.Add(a.Ticket)
+			res.Anchor = append(res.Anchor, a)
+		}
+	}
+	return res
+}
+
+// truncate returns g limited to the anchors that fit within the builder's
+// per-kind limit for the current set.
+func (b *CrossReferencesBuilder) truncate(g *srvpb.PagedCrossReferences_Group) *srvpb.PagedCrossReferences_Group {
+	if b.kindCounts == nil {
+		b.kindCounts = make(map[string]int)
+	}
+	remaining := b.maxPerKind - b.kindCounts[g.Kind]
+	if remaining < 0 {
+		remaining = 0
+	}
+	if len(g.Anchor) > remaining {
+		b.stats.TruncatedReferences += len(g.Anchor) - remaining
+		g = &srvpb.PagedCrossReferences_Group{Kind: g.Kind, Anchor: g.Anchor[:remaining:remaining]}
+	}
+	b.kindCounts[g.Kind] += len(g.Anchor)
+	return g
+}
+
 // Flush emits any *srvpb.PagedCrossReferences and
 // *srvpb.PagedCrossReferences_Page currently being built.
 func (b *CrossReferencesBuilder) Flush(ctx context.Context) error { return b.pager.Flush(ctx) }
 
 func newPageKey(src string, n int) string { return fmt.Sprintf("%s.%.10d", src, n) }
 
+// pageIndexDigits is the minimum number of digits in a page index formatted by
+// newPageKey.
+const pageIndexDigits = 10
+
+// PageKeyToSource parses a page key in the default format used by
+// EdgeSetBuilder and CrossReferencesBuilder, returning its source ticket and
+// page index.  It is the inverse of the builders' default page key function.
+func PageKeyToSource(key string) (sourceTicket string, pageIndex int, err error) {
+	i := strings.LastIndex(key, ".")
+	if i < 0 {
+		return "", 0, fmt.Errorf("page key missing '.' separator: %q", key)
+	}
+	suffix := key[i+1:]
+	if len(suffix) < pageIndexDigits {
+		return "", 0, fmt.Errorf("page key index too short: %q", key)
+	}
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return "", 0, fmt.Errorf("non-numeric page key index: %q", key)
+		}
+	}
+	pageIndex, err = strconv.Atoi(suffix)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid page key index %q: %v", key, err)
+	}
+	return key[:i], pageIndex, nil
+}
+
+// ValidatePageKey returns an error if key is not a valid page key (see
+// PageKeyToSource) embedding a valid Kythe URI.
+func ValidatePageKey(key string) error {
+	ticket, _, err := PageKeyToSource(key)
+	if err != nil {
+		return err
+	} else if _, err := kytheuri.Parse(ticket); err != nil || ticket == "" {
+		return fmt.Errorf("page key has invalid source ticket %q", ticket)
+	}
+	return nil
+}
+
+// NormalizerCache is a fixed-size cache of *xrefs.Normalizers keyed by file
+// ticket.  When full, the least recently used Normalizer is evicted.  A
+// NormalizerCache is safe for concurrent use.
+type NormalizerCache struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+}
+
+type normalizerCacheEntry struct {
+	ticket string
+	norm   *xrefs.Normalizer
+}
+
+// NewNormalizerCache returns a NormalizerCache holding at most capacity
+// Normalizers.  If capacity <= 0, the cache is unbounded.
+func NewNormalizerCache(capacity int) *NormalizerCache {
+	return &NormalizerCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Get returns the Normalizer for the given file, constructing it if it is not
+// already cached.
+func (c *NormalizerCache) Get(file *srvpb.File) *xrefs.Normalizer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[file.Ticket]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*normalizerCacheEntry).norm
+	}
+
+	norm := xrefs.NewNormalizer(file.Text)
+	c.entries[file.Ticket] = c.lru.PushFront(&normalizerCacheEntry{file.Ticket, norm})
+	if c.capacity > 0 && c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*normalizerCacheEntry).ticket)
+	}
+	return norm
+}
+
+// Purge removes the Normalizer for the given file ticket from the cache, if
+// present.
+func (c *NormalizerCache) Purge(ticket string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[ticket]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, ticket)
+	}
+}
+
+// ErrNilAnchor is returned by CrossReference when given a decoration without
+// an anchor.
+var ErrNilAnchor = errors.New("assemble: decoration has nil anchor")
+
 // CrossReference returns a (Referent, TargetAnchor) *ipb.CrossReference
 // equivalent to the given decoration.  The decoration's anchor is expanded
 // given its parent file and associated Normalizer.
@@ -617,37 +2697,311 @@ func CrossReference(file *srvpb.File, norm *xrefs.Normalizer, d *srvpb.FileDecor
 		return nil, errors.New("missing decoration's parent file")
 	}
 
-	ea, err := ExpandAnchor(d.Anchor, file, norm, edges.Mirror(d.Kind))
+	return crossReference(file, norm, norm.ByteRange, d, tgt)
+}
+
+// CrossReferences returns the *ipb.CrossReference equivalent of each given
+// decoration along with a parallel slice of errors (nil for each decoration
+// successfully converted).  Unlike CrossReference, the referents of the
+// returned CrossReferences have no facts.  Normalized offsets are shared
+// between the decorations' anchors.
+func CrossReferences(file *srvpb.File, norm *xrefs.Normalizer, ds []*srvpb.FileDecorations_Decoration) ([]*ipb.CrossReference, []error) {
+	refs := make([]*ipb.CrossReference, len(ds))
+	errs := make([]error, len(ds))
+	if file == nil || norm == nil {
+		for i := range errs {
+			errs[i] = errors.New("missing decoration's parent file")
+		}
+		return refs, errs
+	}
+
+	byteRange := cachedByteRange(file, norm)
+	for i, d := range ds {
+		refs[i], errs[i] = crossReference(file, norm, byteRange, d, nil)
+	}
+	return refs, errs
+}
+
+// cachedByteRange returns a byteRangeFunc for file that normalizes each
+// distinct offset only once.
+func cachedByteRange(file *srvpb.File, norm *xrefs.Normalizer) byteRangeFunc {
+	points := make(map[int32]*xpb.Location_Point)
+	byteOffset := func(offset int32) *xpb.Location_Point {
+		p, ok := points[offset]
+		if !ok {
+			p = norm.ByteOffset(offset)
+			points[offset] = p
+		}
+		return p
+	}
+	return func(start, end int32) (*xpb.Location_Point, *xpb.Location_Point, error) {
+		if err := checkSpan(len(file.Text), start, end); err != nil {
+			return nil, nil, err
+		}
+		return byteOffset(start), byteOffset(end), nil
+	}
+}
+
+func crossReference(file *srvpb.File, norm *xrefs.Normalizer, byteRange byteRangeFunc, d *srvpb.FileDecorations_Decoration, tgt *srvpb.Node) (*ipb.CrossReference, error) {
+	if d.Anchor == nil {
+		return nil, ErrNilAnchor
+	}
+	kind := edges.Mirror(d.Kind)
+	ea, err := expandAnchor(d.Anchor, file, norm, byteRange, kind)
 	if err != nil {
 		return nil, fmt.Errorf("error expanding anchor {%+v}: %v", d.Anchor, err)
 	}
+	referent := &srvpb.Node{Ticket: d.Target, Fact: tgt.GetFact()}
+	return ConvertToInternalCrossReference(ea, referent, kind), nil
+}
+
+// ConvertToInternalCrossReference returns a (Referent, TargetAnchor)
+// *ipb.CrossReference for an already expanded anchor.  The TargetAnchor is ea
+// with its Kind set to kind; ea itself is not modified.  Only the referent's
+// ticket and facts.Complete fact are kept.
+func ConvertToInternalCrossReference(ea *srvpb.ExpandedAnchor, referent *srvpb.Node, kind string) *ipb.CrossReference {
+	if ea.Kind != kind {
+		anchor := *ea
+		anchor.Kind = kind
+		ea = &anchor
+	}
 	// Throw away most of the referent's facts.  They are not needed.
 	var selected []*cpb.Fact
-	if tgt != nil {
-		for _, fact := range tgt.Fact {
-			if fact.Name == facts.Complete {
-				selected = append(selected, fact)
-			}
+	for _, fact := range referent.Fact {
+		if fact.Name == facts.Complete {
+			selected = append(selected, fact)
 		}
 	}
 	return &ipb.CrossReference{
 		Referent: &srvpb.Node{
-			Ticket: d.Target,
+			Ticket: referent.Ticket,
 			Fact:   selected,
 		},
 		TargetAnchor: ea,
-	}, nil
+	}
 }
 
 // ExpandAnchor returns the ExpandedAnchor equivalent of the given RawAnchor
 // where file (and its associated Normalizer) must be the anchor's parent file.
+// Zero-length anchors (e.g. insertion points) are valid and expand to an
+// ExpandedAnchor with empty Text and a Span whose Start and End are equal.
 func ExpandAnchor(anchor *srvpb.RawAnchor, file *srvpb.File, norm *xrefs.Normalizer, kind string) (*srvpb.ExpandedAnchor, error) {
+	return expandAnchor(anchor, file, norm, norm.ByteRange, kind)
+}
+
+// ExpandAnchorWithContext returns the ExpandedAnchor equivalent of the given
+// RawAnchor, like ExpandAnchor, but with a line-based snippet.  If contextLines
+// >= 0, the snippet consists of every line spanned by the anchor along with up
+// to contextLines additional lines above and below; any snippet offsets given
+// by the indexer are ignored.  If contextLines < 0, this is equivalent to
+// ExpandAnchor.
+func ExpandAnchorWithContext(anchor *srvpb.RawAnchor, file *srvpb.File, norm *xrefs.Normalizer, kind string, contextLines int) (*srvpb.ExpandedAnchor, error) {
+	ea, err := ExpandAnchor(anchor, file, norm, kind)
+	if err != nil || contextLines < 0 {
+		return ea, err
+	}
+
+	startLine := ea.Span.Start.LineNumber - int32(contextLines)
+	if startLine < 1 {
+		startLine = 1
+	}
+	ssp := norm.Point(&xpb.Location_Point{LineNumber: startLine})
+
+	endLine := ea.Span.End.LineNumber + int32(contextLines)
+	var end int32
+	if nextLine := norm.Point(&xpb.Location_Point{LineNumber: endLine + 1}); nextLine.LineNumber == endLine+1 {
+		end = nextLine.ByteOffset - 1
+	} else {
+		// The snippet ends on the file's final line.
+		end = int32(len(file.Text))
+		if end > 0 && file.Text[end-1] == '\n' {
+			end--
+		}
+	}
+	if end < ssp.ByteOffset {
+		end = ssp.ByteOffset
+	}
+	sep := norm.ByteOffset(end)
+
+	snippet, err := getText(ssp, sep, file)
+	if err != nil {
+		return nil, fmt.Errorf("error getting text for line snippet: %v", err)
+	}
+	ea.Snippet = snippet
+	ea.SnippetSpan = &cpb.Span{
+		Start: p2p(ssp),
+		End:   p2p(sep),
+	}
+	return ea, nil
+}
+
+// ExpandAnchorDetectEncoding returns the ExpandedAnchor equivalent of the
+// given RawAnchor, like ExpandAnchor, except that if file has no declared
+// encoding, its encoding is detected from its text using text.Detect.  If
+// detection fails, this is equivalent to ExpandAnchor.
+func ExpandAnchorDetectEncoding(anchor *srvpb.RawAnchor, file *srvpb.File, norm *xrefs.Normalizer, kind string) (*srvpb.ExpandedAnchor, error) {
+	if file.Encoding == "" {
+		if enc, err := text.Detect(file.Text); err == nil {
+			file = &srvpb.File{
+				Ticket:   file.Ticket,
+				Text:     file.Text,
+				Encoding: enc.Name,
+			}
+		}
+	}
+	return ExpandAnchor(anchor, file, norm, kind)
+}
+
+// ExpandAnchorFromLocation returns the ExpandedAnchor spanning the given
+// Location where file (and its associated Normalizer) must be the location's
+// parent file.  The resulting ExpandedAnchor's Ticket is the Location's ticket.
+// A FILE Location spans the entirety of the file's text.
+func ExpandAnchorFromLocation(loc *xpb.Location, file *srvpb.File, norm *xrefs.Normalizer, kind string) (*srvpb.ExpandedAnchor, error) {
+	if loc == nil {
+		return nil, errors.New("missing location")
+	}
+	anchor := &srvpb.RawAnchor{Ticket: loc.Ticket}
+	if loc.Kind == xpb.Location_FILE {
+		anchor.EndOffset = int32(len(file.Text))
+	} else {
+		anchor.StartOffset = loc.GetStart().GetByteOffset()
+		anchor.EndOffset = loc.GetEnd().GetByteOffset()
+	}
+	return ExpandAnchor(anchor, file, norm, kind)
+}
+
+// SnippetErrors is the error returned by BuildSnippetIndex, holding an error
+// for each anchor whose snippet could not be built.
+type SnippetErrors []error
+
+// Error implements part of the error interface.
+func (e SnippetErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d snippet errors: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// BuildSnippetIndex returns a map from anchor ticket to the snippet that
+// ExpandAnchor would produce for each of the given anchors, all of which must
+// belong to file.  The file is normalized once and line-based snippets are
+// shared by every anchor on the same line.  If any snippet could not be
+// built, the returned error is a SnippetErrors and the map holds only the
+// successfully built snippets.
+func BuildSnippetIndex(file *srvpb.File, anchors []*srvpb.RawAnchor) (map[string]string, error) {
+	norm := xrefs.NewNormalizer(file.Text)
+	byteRange := cachedByteRange(file, norm)
+
+	sorted := make([]*srvpb.RawAnchor, len(anchors))
+	copy(sorted, anchors)
+	sort.Sort(byRawAnchorOffset(sorted))
+
+	snippets := make(map[string]string, len(sorted))
+	lines := make(map[int32]string)
+	var errs SnippetErrors
+	for _, anchor := range sorted {
+		sp, _, err := byteRange(anchor.StartOffset, anchor.EndOffset)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("anchor %q: invalid text offsets: %v", anchor.Ticket, err))
+			continue
+		}
+
+		if anchor.SnippetStart != 0 || anchor.SnippetEnd != 0 {
+			ssp, sep, err := byteRange(anchor.SnippetStart, anchor.SnippetEnd)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("anchor %q: invalid snippet offsets: %v", anchor.Ticket, err))
+				continue
+			}
+			snippet, err := getText(ssp, sep, file)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("anchor %q: error getting text for snippet: %v", anchor.Ticket, err))
+				continue
+			}
+			snippets[anchor.Ticket] = snippet
+		} else if snippet, ok := lines[sp.LineNumber]; ok {
+			snippets[anchor.Ticket] = snippet
+		} else {
+			_, _, snippet, err := lineSnippet(sp, file, norm)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("anchor %q: %v", anchor.Ticket, err))
+				continue
+			}
+			lines[sp.LineNumber] = snippet
+			snippets[anchor.Ticket] = snippet
+		}
+	}
+	if len(errs) > 0 {
+		return snippets, errs
+	}
+	return snippets, nil
+}
+
+// byRawAnchorOffset sorts RawAnchors by their starting offsets.
+type byRawAnchorOffset []*srvpb.RawAnchor
+
+func (s byRawAnchorOffset) Len() int           { return len(s) }
+func (s byRawAnchorOffset) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byRawAnchorOffset) Less(i, j int) bool { return s[i].StartOffset < s[j].StartOffset }
+
+// AnchorText returns the text spanned by the given RawAnchor where file must
+// be the anchor's parent file.  Unlike ExpandAnchor, no offsets are normalized
+// and no snippet is computed.
+func AnchorText(anchor *srvpb.RawAnchor, file *srvpb.File) (string, error) {
 	if err := checkSpan(len(file.Text), anchor.StartOffset, anchor.EndOffset); err != nil {
-		return nil, fmt.Errorf("invalid text offsets: %v", err)
+		return "", fmt.Errorf("invalid text offsets: %v", err)
+	}
+	txt, err := text.ToUTF8(file.Encoding, file.Text[anchor.StartOffset:anchor.EndOffset])
+	if err != nil {
+		return "", fmt.Errorf("unable to decode file text: %v", err)
+	}
+	return txt, nil
+}
+
+// ExpandedAnchorToRaw returns the RawAnchor from which ea could have been
+// expanded.  Only the anchor's ticket and the byte offsets of its span and
+// snippet span are kept; a missing span yields zero offsets.
+func ExpandedAnchorToRaw(ea *srvpb.ExpandedAnchor) *srvpb.RawAnchor {
+	return &srvpb.RawAnchor{
+		Ticket:       ea.Ticket,
+		StartOffset:  ea.GetSpan().GetStart().GetByteOffset(),
+		EndOffset:    ea.GetSpan().GetEnd().GetByteOffset(),
+		SnippetStart: ea.GetSnippetSpan().GetStart().GetByteOffset(),
+		SnippetEnd:   ea.GetSnippetSpan().GetEnd().GetByteOffset(),
 	}
+}
+
+// RawAnchorKey returns a string of the form "<ticket>:<start>-<end>"
+// identifying both the anchor's ticket and its span.  It is meant for keying
+// deduplication maps; the key is not a Kythe URI and must not be stored in any
+// serving data.
+func RawAnchorKey(anchor *srvpb.RawAnchor) string {
+	return fmt.Sprintf("%s:%d-%d", anchor.Ticket, anchor.StartOffset, anchor.EndOffset)
+}
+
+// OverlapAnchors reports whether the spans of a and b share at least one byte.
+// Adjacent spans (where one ends at the other's start) do not overlap.
+func OverlapAnchors(a, b *srvpb.RawAnchor) bool {
+	return a.StartOffset < b.EndOffset && b.StartOffset < a.EndOffset
+}
+
+// ContainsAnchor reports whether the span of inner lies entirely within the
+// span of outer.  Every anchor contains itself.
+func ContainsAnchor(outer, inner *srvpb.RawAnchor) bool {
+	return inner.StartOffset >= outer.StartOffset && inner.EndOffset <= outer.EndOffset
+}
+
+// A byteRangeFunc validates and normalizes a span of byte offsets (see
+// xrefs.Normalizer.ByteRange).
+type byteRangeFunc func(start, end int32) (sp, ep *xpb.Location_Point, err error)
 
-	sp := norm.ByteOffset(anchor.StartOffset)
-	ep := norm.ByteOffset(anchor.EndOffset)
+// expandAnchor implements ExpandAnchor using byteRange to normalize each of
+// the anchor's spans.  The returned points must not be modified.
+func expandAnchor(anchor *srvpb.RawAnchor, file *srvpb.File, norm *xrefs.Normalizer, byteRange byteRangeFunc, kind string) (*srvpb.ExpandedAnchor, error) {
+	sp, ep, err := byteRange(anchor.StartOffset, anchor.EndOffset)
+	if err != nil {
+		return nil, fmt.Errorf("invalid text offsets: %v", err)
+	}
 	txt, err := getText(sp, ep, file)
 	if err != nil {
 		return nil, fmt.Errorf("error getting anchor text: %v", err)
@@ -656,34 +3010,19 @@ func ExpandAnchor(anchor *srvpb.RawAnchor, file *srvpb.File, norm *xrefs.Normali
 	var snippet string
 	var ssp, sep *xpb.Location_Point
 	if anchor.SnippetStart != 0 || anchor.SnippetEnd != 0 {
-		if err := checkSpan(len(file.Text), anchor.SnippetStart, anchor.SnippetEnd); err != nil {
+		ssp, sep, err = byteRange(anchor.SnippetStart, anchor.SnippetEnd)
+		if err != nil {
 			return nil, fmt.Errorf("invalid snippet offsets: %v", err)
 		}
-
-		ssp = norm.ByteOffset(anchor.SnippetStart)
-		sep = norm.ByteOffset(anchor.SnippetEnd)
 		snippet, err = getText(ssp, sep, file)
 		if err != nil {
 			return nil, fmt.Errorf("error getting text for snippet: %v", err)
 		}
 	} else {
 		// fallback to a line-based snippet if the indexer did not provide its own snippet offsets
-		ssp = &xpb.Location_Point{
-			ByteOffset: sp.ByteOffset - sp.ColumnOffset,
-			LineNumber: sp.LineNumber,
-		}
-		nextLine := norm.Point(&xpb.Location_Point{LineNumber: sp.LineNumber + 1})
-		if nextLine.ByteOffset <= ssp.ByteOffset { // double-check ssp != EOF
-			return nil, errors.New("anchor past EOF")
-		}
-		sep = &xpb.Location_Point{
-			ByteOffset:   nextLine.ByteOffset - 1,
-			LineNumber:   sp.LineNumber,
-			ColumnOffset: sp.ColumnOffset + (nextLine.ByteOffset - sp.ByteOffset - 1),
-		}
-		snippet, err = getText(ssp, sep, file)
+		ssp, sep, snippet, err = lineSnippet(sp, file, norm)
 		if err != nil {
-			return nil, fmt.Errorf("error getting text for line snippet: %v", err)
+			return nil, err
 		}
 	}
 
@@ -705,6 +3044,32 @@ func ExpandAnchor(anchor *srvpb.RawAnchor, file *srvpb.File, norm *xrefs.Normali
 	}, nil
 }
 
+// lineSnippet returns the span and text of the line containing sp.
+func lineSnippet(sp *xpb.Location_Point, file *srvpb.File, norm *xrefs.Normalizer) (ssp, sep *xpb.Location_Point, snippet string, err error) {
+	ssp = &xpb.Location_Point{
+		ByteOffset:   sp.ByteOffset - sp.ColumnOffset,
+		LineNumber:   sp.LineNumber,
+		ColumnOffset: 0,
+	}
+	if int(ssp.ByteOffset) == len(file.Text) {
+		// A zero-length anchor at EOF begins an empty final line.
+		return ssp, ssp, "", nil
+	} else if norm.IsEOF(ssp.ByteOffset) {
+		return nil, nil, "", errors.New("anchor past EOF")
+	}
+	nextLine := norm.Point(&xpb.Location_Point{LineNumber: sp.LineNumber + 1})
+	sep = &xpb.Location_Point{
+		ByteOffset:   nextLine.ByteOffset - 1,
+		LineNumber:   sp.LineNumber,
+		ColumnOffset: sp.ColumnOffset + (nextLine.ByteOffset - sp.ByteOffset - 1),
+	}
+	snippet, err = getText(ssp, sep, file)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("error getting text for line snippet: %v", err)
+	}
+	return ssp, sep, snippet, nil
+}
+
 func checkSpan(textLen int, start, end int32) error {
 	if int(end) > textLen {
 		return fmt.Errorf("span past EOF %d: [%d, %d)", textLen, start, end)
@@ -802,14 +3167,82 @@ func (s byRefKind) Len() int           { return len(s) }
 func (s byRefKind) Less(i, j int) bool { return edgeKindLess(s[i].Kind, s[j].Kind) }
 func (s byRefKind) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 
+// byAnchorLess sorts anchors using an arbitrary less function
+type byAnchorLess struct {
+	anchors []*srvpb.ExpandedAnchor
+	less    func(a, b *srvpb.ExpandedAnchor) bool
+}
+
+func (s byAnchorLess) Len() int           { return len(s.anchors) }
+func (s byAnchorLess) Swap(i, j int)      { s.anchors[i], s.anchors[j] = s.anchors[j], s.anchors[i] }
+func (s byAnchorLess) Less(i, j int) bool { return s.less(s.anchors[i], s.anchors[j]) }
+
+// RenumberOrdinals returns a copy of targets, sorted by CompareEdges, with
+// their ordinals reassigned to 0, 1, 2, ... in that order.  Edges sharing an
+// ordinal are numbered by their target ticket.  The given slice and its edges
+// are not modified.
+func RenumberOrdinals(targets []*ipb.Source_Edge) []*ipb.Source_Edge {
+	res := make([]*ipb.Source_Edge, len(targets))
+	for i, e := range targets {
+		res[i] = &ipb.Source_Edge{Ticket: e.Ticket, Ordinal: e.Ordinal}
+	}
+	sort.Stable(byOrdinal(res))
+	for i, e := range res {
+		e.Ordinal = int32(i)
+	}
+	return res
+}
+
+// EdgeTargetsToProto returns an EdgeGroup of the given kind with an edge to
+// each of targets, in order.  Each edge's Target node has only its ticket set.
+func EdgeTargetsToProto(kind string, targets []*ipb.Source_Edge) *srvpb.EdgeGroup {
+	eg := &srvpb.EdgeGroup{
+		Kind: kind,
+		Edge: make([]*srvpb.EdgeGroup_Edge, len(targets)),
+	}
+	for i, t := range targets {
+		eg.Edge[i] = &srvpb.EdgeGroup_Edge{
+			Target:  &srvpb.Node{Ticket: t.Ticket},
+			Ordinal: t.Ordinal,
+		}
+	}
+	return eg
+}
+
+// ProtoToEdgeTargets is the inverse of EdgeTargetsToProto; any facts of the
+// group's target nodes are dropped.
+func ProtoToEdgeTargets(eg *srvpb.EdgeGroup) (kind string, targets []*ipb.Source_Edge) {
+	targets = make([]*ipb.Source_Edge, len(eg.Edge))
+	for i, e := range eg.Edge {
+		targets[i] = &ipb.Source_Edge{
+			Ticket:  e.Target.GetTicket(),
+			Ordinal: e.Ordinal,
+		}
+	}
+	return eg.Kind, targets
+}
+
 // byOrdinal sorts edges by their ordinals
 type byOrdinal []*ipb.Source_Edge
 
-func (s byOrdinal) Len() int      { return len(s) }
-func (s byOrdinal) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
-func (s byOrdinal) Less(i, j int) bool {
-	if s[i].Ordinal == s[j].Ordinal {
-		return s[i].Ticket < s[j].Ticket
+func (s byOrdinal) Len() int           { return len(s) }
+func (s byOrdinal) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byOrdinal) Less(i, j int) bool { return CompareEdges(s[i], s[j]) < 0 }
+
+// CompareEdges returns -1, 0, or +1 if a is ordered before, equivalent to, or
+// after b, respectively.  Edges are ordered by their ordinal and then by their
+// target ticket.
+func CompareEdges(a, b *ipb.Source_Edge) int {
+	switch {
+	case a.Ordinal < b.Ordinal:
+		return -1
+	case a.Ordinal > b.Ordinal:
+		return 1
+	case a.Ticket < b.Ticket:
+		return -1
+	case a.Ticket > b.Ticket:
+		return 1
+	default:
+		return 0
 	}
-	return s[i].Ordinal < s[j].Ordinal
 }
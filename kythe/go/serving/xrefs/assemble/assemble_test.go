@@ -17,14 +17,28 @@
 package assemble
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 
+	"kythe.io/kythe/go/services/xrefs"
 	"kythe.io/kythe/go/test/testutil"
+	"kythe.io/kythe/go/util/schema/edges"
+	"kythe.io/kythe/go/util/schema/facts"
+	"kythe.io/kythe/go/util/schema/nodes"
 
+	cpb "kythe.io/kythe/proto/common_proto"
 	ipb "kythe.io/kythe/proto/internal_proto"
 	srvpb "kythe.io/kythe/proto/serving_proto"
 	spb "kythe.io/kythe/proto/storage_proto"
+	xpb "kythe.io/kythe/proto/xref_proto"
 
 	"github.com/golang/protobuf/proto"
 )
@@ -105,6 +119,150 @@ func TestAppendEntry(t *testing.T) {
 	}
 }
 
+func TestSourceFromEntriesFiltered(t *testing.T) {
+	entries := []*spb.Entry{
+		fact("/kythe/node/kind", "file"),
+		fact("/kythe/text", "some large text"),
+		edge("/kythe/edge/childof", "parent"),
+	}
+	for _, e := range entries {
+		e.Source = &spb.VName{Signature: "source"}
+	}
+
+	src := SourceFromEntriesFiltered(entries, map[string]struct{}{
+		"/kythe/node/kind": {},
+	})
+	expected := &ipb.Source{
+		Ticket: "kythe:#source",
+		Facts:  map[string][]byte{"/kythe/node/kind": []byte("file")},
+		EdgeGroups: map[string]*ipb.Source_EdgeGroup{
+			"/kythe/edge/childof": {
+				Edges: []*ipb.Source_Edge{{Ticket: "kythe:#parent"}},
+			},
+		},
+	}
+	if err := testutil.DeepEqual(expected, src); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSourceFromEntriesStrictFacts(t *testing.T) {
+	entries := []*spb.Entry{
+		fact("/kythe/node/kind", "anchor"),
+		fact("/kythe/node/kind", "anchor"),
+		fact("/kythe/loc/start", "1"),
+		fact("/kythe/loc/start", "2"),
+	}
+
+	if _, err := SourceFromEntriesWithOptions(entries, SourceFromEntriesOptions{}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := SourceFromEntriesWithOptions(entries[:3], SourceFromEntriesOptions{StrictFacts: true}); err != nil {
+		t.Errorf("Unexpected error for duplicate equal facts: %v", err)
+	}
+	if _, err := SourceFromEntriesWithOptions(entries, SourceFromEntriesOptions{StrictFacts: true}); err == nil {
+		t.Error("Expected error for conflicting facts")
+	}
+}
+
+func TestBatchSourceFromEntries(t *testing.T) {
+	withSource := func(sig string, entries ...*spb.Entry) []*spb.Entry {
+		for _, e := range entries {
+			e.Source = &spb.VName{Signature: sig}
+		}
+		return entries
+	}
+
+	var batches [][]*spb.Entry
+	for i := 0; i < 20; i++ {
+		batches = append(batches, withSource(strconv.Itoa(i), fact("fact", strconv.Itoa(i))))
+	}
+	srcs, err := BatchSourceFromEntries(ctx, batches)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if len(srcs) != len(batches) {
+		t.Fatalf("Expected %d Sources; found %d", len(batches), len(srcs))
+	}
+	for i, src := range srcs {
+		if expected := strconv.Itoa(i); string(src.Facts["fact"]) != expected {
+			t.Errorf("Source %d: expected fact %q; found %v", i, expected, src)
+		}
+	}
+
+	batches = [][]*spb.Entry{
+		withSource("a", fact("fact", "1")),
+		withSource("b", fact("fact", "1"), fact("fact", "2")),
+		append(withSource("c", fact("fact", "1")), withSource("d", fact("fact", "1"))...),
+		nil,
+	}
+	srcs, err = BatchSourceFromEntries(ctx, batches)
+	if err == nil || !strings.Contains(err.Error(), "3 of 4 batches failed") {
+		t.Errorf("Expected error for 3 failed batches; found %v", err)
+	}
+	if srcs[0] == nil || srcs[1] != nil || srcs[2] != nil || srcs[3] != nil {
+		t.Errorf("Unexpected Sources: %v", srcs)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if srcs, err := BatchSourceFromEntries(canceled, batches[:1]); err == nil || srcs[0] != nil {
+		t.Errorf("Expected cancellation error; found %v, %v", srcs, err)
+	}
+}
+
+func TestMergeEntrySources(t *testing.T) {
+	if src, err := MergeEntrySources(nil); err != nil || src != nil {
+		t.Errorf("MergeEntrySources(nil): {%v, %v}; expected {nil, nil}", src, err)
+	}
+
+	single := &ipb.Source{
+		Ticket: "kythe:#source",
+		Facts:  map[string][]byte{"fact": []byte("value")},
+		EdgeGroups: map[string]*ipb.Source_EdgeGroup{
+			"kind": {Edges: []*ipb.Source_Edge{{Ticket: "kythe:#target"}}},
+		},
+	}
+	if src, err := MergeEntrySources([]*ipb.Source{single}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if err := testutil.DeepEqual(single, src); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := MergeEntrySources([]*ipb.Source{single, {
+		Ticket: "kythe:#source",
+		Facts:  map[string][]byte{"fact": []byte("another value")},
+	}}); err == nil {
+		t.Error("Expected error merging conflicting facts")
+	}
+
+	src, err := MergeEntrySources([]*ipb.Source{single, {
+		Ticket: "kythe:#source",
+		Facts:  map[string][]byte{"fact": []byte("value"), "blah": []byte("blah")},
+		EdgeGroups: map[string]*ipb.Source_EdgeGroup{
+			"kind": {Edges: []*ipb.Source_Edge{
+				{Ticket: "kythe:#target", Ordinal: 1},
+				{Ticket: "kythe:#target"},
+			}},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := &ipb.Source{
+		Ticket: "kythe:#source",
+		Facts:  map[string][]byte{"fact": []byte("value"), "blah": []byte("blah")},
+		EdgeGroups: map[string]*ipb.Source_EdgeGroup{
+			"kind": {Edges: []*ipb.Source_Edge{
+				{Ticket: "kythe:#target"},
+				{Ticket: "kythe:#target", Ordinal: 1},
+			}},
+		},
+	}
+	if err := testutil.DeepEqual(expected, src); err != nil {
+		t.Error(err)
+	}
+}
+
 var ctx = context.Background()
 
 type testESB struct {
@@ -379,4 +537,2881 @@ func TestEdgeSetBuilder(t *testing.T) {
 			t.Fatalf("Unexpected EdgePage(s): %v", tESB.EdgePages[edgePages:])
 		}
 	}
+
+	expectedStats := EdgeSetStats{
+		TotalSets:        3,
+		TotalInlineEdges: 7,
+		TotalPagedEdges:  12,
+		TotalPages:       4,
+		MaxEdgesPerSet:   15,
+	}
+	if err := testutil.DeepEqual(expectedStats, tESB.Stats()); err != nil {
+		t.Errorf("Stats: %v", err)
+	}
+}
+
+func TestEdgeSetBuilderMaxEdgePages(t *testing.T) {
+	tESB := newTestESB(&EdgeSetBuilder{
+		MaxEdgePageSize: 1,
+		MaxEdgePages:    2,
+	})
+	testutil.FatalOnErrT(t, "Failure to StartEdgeSet: %v",
+		tESB.StartEdgeSet(ctx, getNode("someSource")))
+
+	targets := []string{"kythe:#a", "kythe:#b", "kythe:#c", "kythe:#d"}
+	for i, tgt := range targets {
+		err := tESB.AddGroup(ctx, &srvpb.EdgeGroup{
+			Kind: "someEdgeKind",
+			Edge: getEdgeTargets(tgt),
+		})
+		if i < len(targets)-1 {
+			testutil.FatalOnErrT(t, "Failure to AddGroup: %v", err)
+		} else if err != ErrEdgePageLimitExceeded {
+			t.Fatalf("Expected ErrEdgePageLimitExceeded; found: %v", err)
+		}
+	}
+	if len(tESB.EdgePages) != 2 {
+		t.Errorf("Found %d EdgePages; expected 2", len(tESB.EdgePages))
+	}
+}
+
+func TestEdgeSetBuilderPageKeyFunc(t *testing.T) {
+	const worker = 42
+	tESB := newTestESB(&EdgeSetBuilder{MaxEdgePageSize: 1})
+	tESB.SetPageKeyFunc(func(src string, n int) string {
+		return fmt.Sprintf("worker%d/%s.%d", worker, src, n)
+	})
+
+	testutil.FatalOnErrT(t, "Failure to StartEdgeSet: %v",
+		tESB.StartEdgeSet(ctx, getNode("someSource")))
+	testutil.FatalOnErrT(t, "Failure to AddGroup: %v", tESB.AddGroup(ctx, &srvpb.EdgeGroup{
+		Kind: "someEdgeKind",
+		Edge: getEdgeTargets("kythe:#a", "kythe:#b"),
+	}))
+	testutil.FatalOnErrT(t, "Failure to Flush: %v", tESB.Flush(ctx))
+
+	if len(tESB.EdgePages) != 1 {
+		t.Fatalf("Found %d EdgePages; expected 1", len(tESB.EdgePages))
+	} else if key := tESB.EdgePages[0].PageKey; key != "worker42/someSource.0" {
+		t.Errorf("Unexpected PageKey: %q", key)
+	}
+	if len(tESB.PagedEdgeSets) != 1 {
+		t.Fatalf("Found %d PagedEdgeSets; expected 1", len(tESB.PagedEdgeSets))
+	} else if idx := tESB.PagedEdgeSets[0].PageIndex; len(idx) != 1 || idx[0].PageKey != "worker42/someSource.0" {
+		t.Errorf("Unexpected PageIndex: %v", idx)
+	}
+}
+
+func TestMergePagedEdgeSets(t *testing.T) {
+	existing := map[string]*srvpb.EdgePage{
+		"someSource.0000000000": {
+			PageKey:      "someSource.0000000000",
+			SourceTicket: "someSource",
+			EdgesGroup: &srvpb.EdgeGroup{
+				Kind: "kindA",
+				Edge: getEdgeTargets("kythe:#y", "kythe:#w"),
+			},
+		},
+		"someSource.0000000001": {
+			PageKey:      "someSource.0000000001",
+			SourceTicket: "someSource",
+			EdgesGroup: &srvpb.EdgeGroup{
+				Kind: "kindB",
+				Edge: getEdgeTargets("kythe:#v"),
+			},
+		},
+	}
+	loader := func(pages map[string]*srvpb.EdgePage) func(string) (*srvpb.EdgePage, error) {
+		return func(key string) (*srvpb.EdgePage, error) {
+			if pg, ok := pages[key]; ok {
+				return pg, nil
+			}
+			return nil, fmt.Errorf("no such page: %q", key)
+		}
+	}
+
+	a := &srvpb.PagedEdgeSet{
+		Source: &srvpb.Node{
+			Ticket: "someSource",
+			Fact:   []*cpb.Fact{{Name: "/kythe/node/kind", Value: []byte("record")}},
+		},
+		Group: []*srvpb.EdgeGroup{{
+			Kind: "kindA",
+			Edge: getEdgeTargets("kythe:#x"),
+		}},
+		PageIndex: []*srvpb.PageIndex{{
+			PageKey:   "someSource.0000000000",
+			EdgeKind:  "kindA",
+			EdgeCount: 2,
+		}},
+		TotalEdges: 3,
+	}
+	b := &srvpb.PagedEdgeSet{
+		Source: &srvpb.Node{
+			Ticket: "someSource",
+			Fact:   []*cpb.Fact{{Name: "/kythe/subkind", Value: []byte("class")}},
+		},
+		// kythe:#y is inline here but paged in a; it should only be kept once.
+		Group: []*srvpb.EdgeGroup{{
+			Kind: "kindA",
+			Edge: getEdgeTargets("kythe:#x", "kythe:#y"),
+		}, {
+			Kind: "kindB",
+			Edge: getEdgeTargets("kythe:#z"),
+		}},
+		PageIndex: []*srvpb.PageIndex{{
+			PageKey:   "someSource.0000000000",
+			EdgeKind:  "kindA",
+			EdgeCount: 2,
+		}, {
+			PageKey:   "someSource.0000000001",
+			EdgeKind:  "kindB",
+			EdgeCount: 1,
+		}},
+		TotalEdges: 5,
+	}
+	expectedSource := &srvpb.Node{
+		Ticket: "someSource",
+		Fact: []*cpb.Fact{
+			{Name: "/kythe/node/kind", Value: []byte("record")},
+			{Name: "/kythe/subkind", Value: []byte("class")},
+		},
+	}
+
+	var pages []*srvpb.EdgePage
+	merged, err := MergePagedEdgeSets(ctx, a, b, 0, loader(existing), func(_ context.Context, pg *srvpb.EdgePage) error {
+		pages = append(pages, pg)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("MergePagedEdgeSets error: %v", err)
+	}
+
+	// Without a page size limit, the existing pages are merged inline.
+	expected := &srvpb.PagedEdgeSet{
+		Source: expectedSource,
+		Group: []*srvpb.EdgeGroup{{
+			Kind: "kindA",
+			Edge: getEdgeTargets("kythe:#x", "kythe:#y", "kythe:#w"),
+		}, {
+			Kind: "kindB",
+			Edge: getEdgeTargets("kythe:#z", "kythe:#v"),
+		}},
+		TotalEdges: 5,
+	}
+	if !proto.Equal(expected, merged) {
+		t.Errorf("Expected PagedEdgeSet: %v; found: %v", expected, merged)
+	}
+	if len(pages) != 0 {
+		t.Errorf("Unexpected EdgePages: %v", pages)
+	}
+
+	// Re-paginate the merged edges.
+	pages = nil
+	merged, err = MergePagedEdgeSets(ctx, a, b, 2, loader(existing), func(_ context.Context, pg *srvpb.EdgePage) error {
+		pages = append(pages, pg)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("MergePagedEdgeSets error: %v", err)
+	}
+	if !proto.Equal(expectedSource, merged.Source) {
+		t.Errorf("Expected source %v; found %v", expectedSource, merged.Source)
+	}
+	if merged.TotalEdges != 5 {
+		t.Errorf("TotalEdges: %d; expected 5", merged.TotalEdges)
+	}
+	if len(pages) == 0 || len(pages) != len(merged.PageIndex) {
+		t.Fatalf("Expected an EdgePage for each of %d PageIndex entries; found %d", len(merged.PageIndex), len(pages))
+	}
+	emitted := make(map[string]*srvpb.EdgePage)
+	for _, pg := range pages {
+		if _, ok := existing[pg.PageKey]; ok {
+			t.Errorf("New EdgePage reuses existing key %q", pg.PageKey)
+		}
+		emitted[pg.PageKey] = pg
+	}
+	groups, err := FlattenPagedEdgeSet(merged, loader(emitted))
+	if err != nil {
+		t.Fatalf("FlattenPagedEdgeSet error: %v", err)
+	}
+	targets := make(map[string][]string)
+	for _, g := range groups {
+		for _, e := range g.Edge {
+			targets[g.Kind] = append(targets[g.Kind], e.Target.Ticket)
+		}
+	}
+	for _, ts := range targets {
+		sort.Strings(ts)
+	}
+	if err := testutil.DeepEqual(map[string][]string{
+		"kindA": {"kythe:#w", "kythe:#x", "kythe:#y"},
+		"kindB": {"kythe:#v", "kythe:#z"},
+	}, targets); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := MergePagedEdgeSets(ctx, a, b, 0, loader(nil), nil); err == nil {
+		t.Error("Expected error for a missing EdgePage")
+	}
+	if _, err := MergePagedEdgeSets(ctx, a, &srvpb.PagedEdgeSet{Source: getNode("otherSource")}, 0, loader(existing), nil); err == nil {
+		t.Error("Expected error merging PagedEdgeSets with different sources")
+	}
+	if _, err := MergePagedEdgeSets(ctx, a, &srvpb.PagedEdgeSet{Source: &srvpb.Node{
+		Ticket: "someSource",
+		Fact:   []*cpb.Fact{{Name: "/kythe/node/kind", Value: []byte("function")}},
+	}}, 0, loader(existing), nil); err == nil {
+		t.Error("Expected error merging PagedEdgeSets with conflicting source facts")
+	}
+	if _, err := MergePagedEdgeSets(ctx, a, &srvpb.PagedEdgeSet{}, 0, loader(existing), nil); err == nil {
+		t.Error("Expected error merging PagedEdgeSet without a source")
+	}
+	if _, err := MergePagedEdgeSets(ctx, &srvpb.PagedEdgeSet{}, &srvpb.PagedEdgeSet{}, 0, loader(existing), nil); err == nil {
+		t.Error("Expected error merging PagedEdgeSets without sources")
+	}
+}
+
+type testCRB struct {
+	*CrossReferencesBuilder
+
+	PagedCrossReferences []*srvpb.PagedCrossReferences
+	Pages                []*srvpb.PagedCrossReferences_Page
+}
+
+func newTestCRB(crb *CrossReferencesBuilder) *testCRB {
+	if crb == nil {
+		crb = new(CrossReferencesBuilder)
+	}
+
+	t := &testCRB{
+		CrossReferencesBuilder: crb,
+	}
+	t.Output = func(_ context.Context, xs *srvpb.PagedCrossReferences) error {
+		t.PagedCrossReferences = append(t.PagedCrossReferences, xs)
+		return nil
+	}
+	t.OutputPage = func(_ context.Context, pg *srvpb.PagedCrossReferences_Page) error {
+		t.Pages = append(t.Pages, pg)
+		return nil
+	}
+	return t
+}
+
+func getAnchors(tickets ...string) []*srvpb.ExpandedAnchor {
+	as := make([]*srvpb.ExpandedAnchor, len(tickets))
+	for i, t := range tickets {
+		as[i] = &srvpb.ExpandedAnchor{Ticket: t}
+	}
+	return as
+}
+
+func TestCrossReferencesBuilderStats(t *testing.T) {
+	b := newTestCRB(&CrossReferencesBuilder{MaxPageSize: 2})
+
+	testutil.FatalOnErrT(t, "StartSet error: %v", b.StartSet(ctx, getNode("kythe:#source1")))
+	testutil.FatalOnErrT(t, "AddGroup error: %v", b.AddGroup(ctx, &srvpb.PagedCrossReferences_Group{
+		Kind:   edges.Ref,
+		Anchor: getAnchors("kythe:#a1", "kythe:#a2", "kythe:#a3"),
+	}))
+	testutil.FatalOnErrT(t, "StartSet error: %v", b.StartSet(ctx, getNode("kythe:#source2")))
+	testutil.FatalOnErrT(t, "AddGroup error: %v", b.AddGroup(ctx, &srvpb.PagedCrossReferences_Group{
+		Kind:   edges.Ref,
+		Anchor: getAnchors("kythe:#a4"),
+	}))
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+
+	expected := CrossRefBuildStats{
+		TotalSets:             2,
+		TotalInlineReferences: 2,
+		TotalPagedReferences:  2,
+		TotalPages:            1,
+		MaxReferencesPerSet:   3,
+	}
+	if err := testutil.DeepEqual(expected, b.Stats()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCrossReferencesBuilderAnchorComparator(t *testing.T) {
+	b := newTestCRB(nil)
+	b.MaxPageSize = 4
+	b.SetAnchorComparator(func(x, y *srvpb.ExpandedAnchor) bool { return x.Ticket < y.Ticket })
+
+	testutil.FatalOnErrT(t, "StartSet error: %v", b.StartSet(ctx, getNode("kythe:#source")))
+	for _, anchors := range [][]string{{"kythe:#e", "kythe:#b"}, {"kythe:#d", "kythe:#a"}, {"kythe:#c"}} {
+		testutil.FatalOnErrT(t, "AddGroup error: %v", b.AddGroup(ctx, &srvpb.PagedCrossReferences_Group{
+			Kind:   edges.Ref,
+			Anchor: getAnchors(anchors...),
+		}))
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+
+	if len(b.Pages) != 1 {
+		t.Fatalf("Expected 1 page; found %d", len(b.Pages))
+	}
+	if err := testutil.DeepEqual(getAnchors("kythe:#a", "kythe:#b", "kythe:#c", "kythe:#d"), b.Pages[0].Group.Anchor); err != nil {
+		t.Errorf("Page anchors: %v", err)
+	}
+	if len(b.PagedCrossReferences) != 1 {
+		t.Fatalf("Expected 1 PagedCrossReferences; found %d", len(b.PagedCrossReferences))
+	}
+	if err := testutil.DeepEqual([]*srvpb.PagedCrossReferences_Group{{
+		Kind:   edges.Ref,
+		Anchor: getAnchors("kythe:#e"),
+	}}, b.PagedCrossReferences[0].Group); err != nil {
+		t.Errorf("Inline groups: %v", err)
+	}
+}
+
+func TestCrossReferencesBuilderIncompleteness(t *testing.T) {
+	b := newTestCRB(nil)
+	b.SetIncompleteness(func(n *srvpb.Node) bool {
+		for _, f := range n.Fact {
+			if f.Name == facts.Complete {
+				return string(f.Value) == "incomplete"
+			}
+		}
+		return true
+	})
+
+	nodes := []*srvpb.Node{
+		{Ticket: "kythe:#unknown"},
+		{Ticket: "kythe:#incomplete", Fact: []*cpb.Fact{{Name: facts.Complete, Value: []byte("incomplete")}}},
+		{Ticket: "kythe:#complete", Fact: []*cpb.Fact{{Name: facts.Complete, Value: []byte("complete")}}},
+	}
+	for _, n := range nodes {
+		testutil.FatalOnErrT(t, "StartSet error: %v", b.StartSet(ctx, n))
+		testutil.FatalOnErrT(t, "AddGroup error: %v", b.AddGroup(ctx, &srvpb.PagedCrossReferences_Group{
+			Kind:   edges.Ref,
+			Anchor: getAnchors("kythe:#anchor"),
+		}))
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+
+	expected := map[string]bool{
+		"kythe:#unknown":    true,
+		"kythe:#incomplete": true,
+		"kythe:#complete":   false,
+	}
+	if len(b.PagedCrossReferences) != len(expected) {
+		t.Fatalf("Expected %d PagedCrossReferences; found %d", len(expected), len(b.PagedCrossReferences))
+	}
+	for _, xs := range b.PagedCrossReferences {
+		if xs.Incomplete != expected[xs.SourceTicket] {
+			t.Errorf("%s: expected Incomplete %v; found %v", xs.SourceTicket, expected[xs.SourceTicket], xs.Incomplete)
+		}
+	}
+}
+
+func TestCrossReferencesBuilderFilter(t *testing.T) {
+	b := newTestCRB(nil)
+	b.SetFilter(func(g *srvpb.PagedCrossReferences_Group) bool { return g.Kind != edges.RefCall })
+
+	testutil.FatalOnErrT(t, "StartSet error: %v", b.StartSet(ctx, getNode("kythe:#source")))
+	for _, kind := range []string{edges.Ref, edges.RefCall, edges.Defines} {
+		testutil.FatalOnErrT(t, "AddGroup error: %v", b.AddGroup(ctx, &srvpb.PagedCrossReferences_Group{
+			Kind:   kind,
+			Anchor: getAnchors("kythe:#" + kind),
+		}))
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+
+	expected := []*srvpb.PagedCrossReferences{{
+		SourceTicket: "kythe:#source",
+		Group: []*srvpb.PagedCrossReferences_Group{{
+			Kind:   edges.Defines,
+			Anchor: getAnchors("kythe:#" + edges.Defines),
+		}, {
+			Kind:   edges.Ref,
+			Anchor: getAnchors("kythe:#" + edges.Ref),
+		}},
+		TotalReferences: 2,
+	}}
+	if err := testutil.DeepEqual(expected, b.PagedCrossReferences); err != nil {
+		t.Error(err)
+	}
+	if dropped := b.Stats().DroppedGroups; dropped != 1 {
+		t.Errorf("DroppedGroups: expected 1; found %d", dropped)
+	}
+}
+
+func TestCrossReferencesBuilderDeduplicateAnchors(t *testing.T) {
+	b := newTestCRB(nil)
+	b.SetDeduplicateAnchors(true)
+
+	testutil.FatalOnErrT(t, "StartSet error: %v", b.StartSet(ctx, getNode("kythe:#source")))
+	for _, anchors := range [][]string{{"kythe:#a1", "kythe:#a2"}, {"kythe:#a1"}} {
+		testutil.FatalOnErrT(t, "AddGroup error: %v", b.AddGroup(ctx, &srvpb.PagedCrossReferences_Group{
+			Kind:   edges.Ref,
+			Anchor: getAnchors(anchors...),
+		}))
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+
+	expected := []*srvpb.PagedCrossReferences{{
+		SourceTicket: "kythe:#source",
+		Group: []*srvpb.PagedCrossReferences_Group{{
+			Kind:   edges.Ref,
+			Anchor: getAnchors("kythe:#a1", "kythe:#a2"),
+		}},
+		TotalReferences: 2,
+	}}
+	if err := testutil.DeepEqual(expected, b.PagedCrossReferences); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCrossReferencesBuilderMaxAnchorsPerKind(t *testing.T) {
+	b := newTestCRB(nil)
+	b.SetMaxAnchorsPerKind(2)
+
+	for _, src := range []string{"kythe:#source1", "kythe:#source2"} {
+		testutil.FatalOnErrT(t, "StartSet error: %v", b.StartSet(ctx, getNode(src)))
+		for _, g := range []*srvpb.PagedCrossReferences_Group{
+			{Kind: edges.Ref, Anchor: getAnchors("kythe:#r1")},
+			{Kind: edges.Defines, Anchor: getAnchors("kythe:#d1")},
+			{Kind: edges.Ref, Anchor: getAnchors("kythe:#r2", "kythe:#r3")},
+			{Kind: edges.Ref, Anchor: getAnchors("kythe:#r4")},
+		} {
+			testutil.FatalOnErrT(t, "AddGroup error: %v", b.AddGroup(ctx, g))
+		}
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+
+	var expected []*srvpb.PagedCrossReferences
+	for _, src := range []string{"kythe:#source1", "kythe:#source2"} {
+		expected = append(expected, &srvpb.PagedCrossReferences{
+			SourceTicket: src,
+			// Non-adjacent groups of the same kind are not combined.
+			Group: []*srvpb.PagedCrossReferences_Group{{
+				Kind:   edges.Defines,
+				Anchor: getAnchors("kythe:#d1"),
+			}, {
+				Kind:   edges.Ref,
+				Anchor: getAnchors("kythe:#r1"),
+			}, {
+				Kind:   edges.Ref,
+				Anchor: getAnchors("kythe:#r2"),
+			}},
+			TotalReferences: 3,
+		})
+	}
+	if err := testutil.DeepEqual(expected, b.PagedCrossReferences); err != nil {
+		t.Error(err)
+	}
+	if truncated := b.Stats().TruncatedReferences; truncated != 4 {
+		t.Errorf("TruncatedReferences: expected 4; found %d", truncated)
+	}
+}
+
+func TestTruncateCrossReferences(t *testing.T) {
+	ref := func(anchor, kind string) *ipb.CrossReference {
+		return &ipb.CrossReference{TargetAnchor: &srvpb.ExpandedAnchor{Ticket: anchor, Kind: kind}}
+	}
+	refs := []*ipb.CrossReference{
+		ref("kythe:#r1", edges.Ref),
+		ref("kythe:#d1", edges.Defines),
+		ref("kythe:#r2", edges.Ref),
+		ref("kythe:#r3", edges.Ref),
+		ref("kythe:#d2", edges.Defines),
+	}
+
+	for _, max := range []int{3, 0, -1} {
+		if found, truncated := TruncateCrossReferences(refs, max); truncated || len(found) != len(refs) {
+			t.Errorf("Expected no truncation for max %d; found %v, %v", max, found, truncated)
+		}
+	}
+
+	found, truncated := TruncateCrossReferences(refs, 1)
+	if !truncated {
+		t.Error("Expected truncation")
+	}
+	if err := testutil.DeepEqual([]*ipb.CrossReference{refs[0], refs[1]}, found); err != nil {
+		t.Error(err)
+	}
+}
+
+type testDFB struct {
+	*DecorationFragmentBuilder
+
+	Fragments map[string][]*srvpb.FileDecorations
+}
+
+func newTestDFB(dfb *DecorationFragmentBuilder) *testDFB {
+	if dfb == nil {
+		dfb = new(DecorationFragmentBuilder)
+	}
+
+	t := &testDFB{
+		DecorationFragmentBuilder: dfb,
+		Fragments:                 make(map[string][]*srvpb.FileDecorations),
+	}
+	t.Output = func(_ context.Context, file string, fd *srvpb.FileDecorations) error {
+		t.Fragments[file] = append(t.Fragments[file], fd)
+		return nil
+	}
+	return t
+}
+
+func anchorNode(ticket string, start, end int) *srvpb.Node {
+	return &srvpb.Node{
+		Ticket: ticket,
+		Fact: []*cpb.Fact{
+			{Name: facts.AnchorEnd, Value: []byte(strconv.Itoa(end))},
+			{Name: facts.AnchorStart, Value: []byte(strconv.Itoa(start))},
+			{Name: facts.NodeKind, Value: []byte(nodes.Anchor)},
+		},
+	}
+}
+
+func TestDecorationFragmentBuilderPanicOnInvalidEdge(t *testing.T) {
+	badOffset := anchorNode("kythe://corpus?path=file#badOffset", 0, 1)
+	badOffset.Fact[0].Value = []byte("NaN")
+	invalid := map[string]*srvpb.Node{
+		"crossed span":    anchorNode("kythe://corpus?path=file#crossed", 5, 2),
+		"negative span":   anchorNode("kythe://corpus?path=file#negative", -1, 2),
+		"bad offset":      badOffset,
+		"no parent file":  anchorNode("kythe:#%zz", 0, 1),
+		"missing offsets": {Ticket: "kythe://corpus?path=file#missing", Fact: anchorNode("", 0, 0).Fact[2:]},
+	}
+
+	for name, anchor := range invalid {
+		func() {
+			b := newTestDFB(&DecorationFragmentBuilder{PanicOnInvalidEdge: true})
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected panic for %s", name)
+				}
+			}()
+			b.AddEdge(ctx, &srvpb.Edge{Source: anchor})
+		}()
+
+		// Without PanicOnInvalidEdge, the anchor is skipped.
+		b := newTestDFB(&DecorationFragmentBuilder{})
+		testutil.FatalOnErrT(t, "AddEdge error: %v", b.AddEdge(ctx, &srvpb.Edge{Source: anchor}))
+		testutil.FatalOnErrT(t, "AddEdge error: %v", b.AddEdge(ctx, &srvpb.Edge{
+			Source: anchor,
+			Kind:   edges.Ref,
+			Target: &srvpb.Node{Ticket: "kythe:#t"},
+		}))
+		testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+		if len(b.Fragments) != 0 {
+			t.Errorf("Expected %s anchor to be skipped; found %v", name, b.Fragments)
+		}
+	}
+}
+
+func TestDecorationFragmentBuilderMaxDecorationsPerFile(t *testing.T) {
+	const file = "kythe://corpus?path=file"
+	var overflow int
+	b := newTestDFB(&DecorationFragmentBuilder{})
+	b.SetMaxDecorationsPerFile(3)
+	b.OnOverflow = func(f string, dropped int) {
+		if f != file {
+			t.Errorf("Unexpected overflow file: %q", f)
+		}
+		overflow += dropped
+	}
+
+	for i := 0; i < 3; i++ {
+		anchor := anchorNode(file+"#a"+strconv.Itoa(i), i, i+1)
+		testutil.FatalOnErrT(t, "AddEdge error: %v", b.AddEdge(ctx, &srvpb.Edge{Source: anchor}))
+		for _, tgt := range []string{"kythe:#t1", "kythe:#t2"} {
+			testutil.FatalOnErrT(t, "AddEdge error: %v", b.AddEdge(ctx, &srvpb.Edge{
+				Source: anchor,
+				Kind:   edges.Ref,
+				Target: &srvpb.Node{Ticket: tgt},
+			}))
+		}
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+
+	var emitted int
+	for _, fd := range b.Fragments[file] {
+		emitted += len(fd.Decoration)
+	}
+	if emitted != 3 {
+		t.Errorf("Emitted %d decorations; expected 3", emitted)
+	}
+	if overflow != 3 {
+		t.Errorf("Dropped %d decorations; expected 3", overflow)
+	}
+}
+
+func TestDecorationFragmentBuilderMaxDecorationsInterleavedFiles(t *testing.T) {
+	const fileA, fileB = "kythe://corpus?path=a", "kythe://corpus?path=b"
+	overflow := make(map[string][]int)
+	b := newTestDFB(&DecorationFragmentBuilder{})
+	b.SetMaxDecorationsPerFile(2)
+	b.OnOverflow = func(f string, dropped int) { overflow[f] = append(overflow[f], dropped) }
+
+	// Anchors alternate between files so that neither file's anchors are
+	// contiguous.
+	for i := 0; i < 4; i++ {
+		for _, file := range []string{fileA, fileB} {
+			anchor := anchorNode(file+"#a"+strconv.Itoa(i), i, i+1)
+			testutil.FatalOnErrT(t, "AddEdge error: %v", b.AddEdge(ctx, &srvpb.Edge{Source: anchor}))
+			testutil.FatalOnErrT(t, "AddEdge error: %v", b.AddEdge(ctx, &srvpb.Edge{
+				Source: anchor,
+				Kind:   edges.Ref,
+				Target: &srvpb.Node{Ticket: "kythe:#t"},
+			}))
+		}
+	}
+	if len(overflow) != 0 {
+		t.Errorf("OnOverflow called before Flush: %v", overflow)
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+
+	for _, file := range []string{fileA, fileB} {
+		var emitted int
+		for _, fd := range b.Fragments[file] {
+			emitted += len(fd.Decoration)
+		}
+		if emitted != 2 {
+			t.Errorf("Emitted %d decorations for %q; expected 2", emitted, file)
+		}
+	}
+	if err := testutil.DeepEqual(map[string][]int{fileA: {2}, fileB: {2}}, overflow); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecorationFragmentBuilderMaxDecorationsBufferedParents(t *testing.T) {
+	const fileA, fileB = "kythe://corpus?path=a", "kythe://corpus?path=b"
+	overflow := make(map[string][]int)
+	b := newTestDFB(&DecorationFragmentBuilder{BufferDecorations: true})
+	b.SetMaxDecorationsPerFile(2)
+	b.OnOverflow = func(f string, dropped int) { overflow[f] = append(overflow[f], dropped) }
+
+	addAnchor := func(i int) {
+		anchor := anchorNode(fileA+"#a"+strconv.Itoa(i), i, i+1)
+		for _, e := range []*srvpb.Edge{
+			{Source: anchor},
+			{Source: anchor, Kind: edges.ChildOf, Target: &srvpb.Node{Ticket: fileB}},
+			{Source: anchor, Kind: edges.Ref, Target: &srvpb.Node{Ticket: "kythe:#t"}},
+		} {
+			testutil.FatalOnErrT(t, "AddEdge error: %v", b.AddEdge(ctx, e))
+		}
+	}
+	emitted := func() map[string]int {
+		counts := make(map[string]int)
+		for file, fds := range b.Fragments {
+			for _, fd := range fds {
+				counts[file] += len(fd.Decoration)
+			}
+		}
+		return counts
+	}
+
+	// Each anchor is output to both its ticket's file and its childof parent;
+	// the limit applies to each separately.
+	for i := 0; i < 3; i++ {
+		addAnchor(i)
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+	if err := testutil.DeepEqual(map[string]int{fileA: 2, fileB: 2}, emitted()); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.DeepEqual(map[string][]int{fileA: {1}, fileB: {1}}, overflow); err != nil {
+		t.Error(err)
+	}
+
+	// Flush resets the per-file counts.
+	addAnchor(3)
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+	if err := testutil.DeepEqual(map[string]int{fileA: 3, fileB: 3}, emitted()); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.DeepEqual(map[string][]int{fileA: {1}, fileB: {1}}, overflow); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProgressTracker(t *testing.T) {
+	tracker := &LogProgressTracker{Interval: 2}
+
+	dfb := newTestDFB(&DecorationFragmentBuilder{})
+	dfb.SetProgressTracker(tracker)
+	anchor := anchorNode("kythe://corpus?path=file#a0", 0, 1)
+	testutil.FatalOnErrT(t, "AddEdge error: %v", dfb.AddEdge(ctx, &srvpb.Edge{Source: anchor}))
+	for _, tgt := range []string{"kythe:#t1", "kythe:#t2"} {
+		testutil.FatalOnErrT(t, "AddEdge error: %v", dfb.AddEdge(ctx, &srvpb.Edge{
+			Source: anchor,
+			Kind:   edges.Ref,
+			Target: &srvpb.Node{Ticket: tgt},
+		}))
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", dfb.Flush(ctx))
+
+	esb := newTestESB(nil)
+	esb.SetProgressTracker(tracker)
+	testutil.FatalOnErrT(t, "Failure to StartEdgeSet: %v", esb.StartEdgeSet(ctx, getNode("kythe:#t1")))
+	testutil.FatalOnErrT(t, "Failure to AddGroup: %v", esb.AddGroup(ctx, &srvpb.EdgeGroup{
+		Kind: edges.Param,
+		Edge: getEdgeTargets("kythe:#p0", "kythe:#p1", "kythe:#p2"),
+	}))
+	testutil.FatalOnErrT(t, "Failure to Flush: %v", esb.Flush(ctx))
+
+	crb := newTestCRB(nil)
+	crb.SetProgressTracker(tracker)
+	testutil.FatalOnErrT(t, "Failure to StartSet: %v", crb.StartSet(ctx, getNode("kythe:#t1")))
+	testutil.FatalOnErrT(t, "Failure to AddGroup: %v", crb.AddGroup(ctx, &srvpb.PagedCrossReferences_Group{
+		Kind:   edges.Ref,
+		Anchor: getAnchors("kythe:#a0", "kythe:#a1", "kythe:#a2", "kythe:#a3"),
+	}))
+	testutil.FatalOnErrT(t, "Failure to Flush: %v", crb.Flush(ctx))
+
+	found := []int64{tracker.sources, tracker.edges, tracker.decorations, tracker.crossRefs, tracker.events}
+	if err := testutil.DeepEqual([]int64{3, 3, 2, 4, 12}, found); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecorationFragmentBuilderEdgeKindFilter(t *testing.T) {
+	const file = "kythe://corpus?path=file"
+	b := newTestDFB(nil)
+	b.SetEdgeKindFilter([]string{edges.Ref})
+
+	anchor := anchorNode(file+"#a", 0, 1)
+	for _, e := range []*srvpb.Edge{
+		{Source: anchor},
+		{Source: anchor, Kind: edges.ChildOf, Target: &srvpb.Node{Ticket: file}},
+		{Source: anchor, Kind: edges.Defines, Target: &srvpb.Node{Ticket: "kythe:#def"}},
+		{Source: anchor, Kind: edges.Ref, Target: &srvpb.Node{Ticket: "kythe:#ref"}},
+	} {
+		testutil.FatalOnErrT(t, "AddEdge error: %v", b.AddEdge(ctx, e))
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+
+	var kinds []string
+	for _, fd := range b.Fragments[file] {
+		for _, d := range fd.Decoration {
+			kinds = append(kinds, d.Kind)
+		}
+	}
+	if err := testutil.DeepEqual([]string{edges.Ref}, kinds); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecorationFragmentBuilderBufferedChildOf(t *testing.T) {
+	const file = "kythe://corpus?path=file"
+	b := newTestDFB(&DecorationFragmentBuilder{BufferDecorations: true})
+
+	// The anchor's parent file cannot be derived from its ticket; it is only
+	// known once its childof edge is seen.
+	anchor := anchorNode("kythe:#%zz", 0, 1)
+	for _, e := range []*srvpb.Edge{
+		{Source: anchor},
+		{Source: anchor, Kind: edges.Ref, Target: &srvpb.Node{Ticket: "kythe:#ref"}},
+		{Source: anchor, Kind: edges.ChildOf, Target: &srvpb.Node{Ticket: file}},
+	} {
+		testutil.FatalOnErrT(t, "AddEdge error: %v", b.AddEdge(ctx, e))
+	}
+	if len(b.Fragments) != 0 {
+		t.Fatalf("Unexpected fragments before Flush: %v", b.Fragments)
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+
+	expected := map[string][]*srvpb.FileDecorations{
+		file: {{
+			Decoration: []*srvpb.FileDecorations_Decoration{{
+				Anchor: &srvpb.RawAnchor{
+					Ticket:      "kythe:#%zz",
+					StartOffset: 0,
+					EndOffset:   1,
+				},
+				Kind:   edges.Ref,
+				Target: "kythe:#ref",
+			}},
+			Target: []*srvpb.Node{{Ticket: "kythe:#ref"}},
+		}},
+	}
+	if err := testutil.DeepEqual(expected, b.Fragments); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecorationFragmentBuilderMetrics(t *testing.T) {
+	const file = "kythe://corpus?path=file"
+	b := newTestDFB(nil)
+
+	implicit := anchorNode(file+"#implicit", 0, 1)
+	implicit.Fact = append(implicit.Fact, &cpb.Fact{Name: facts.Subkind, Value: []byte(nodes.Implicit)})
+	anchor := anchorNode(file+"#a", 0, 1)
+	orphan := anchorNode("kythe:#%zz", 1, 2)
+	for _, e := range []*srvpb.Edge{
+		{Source: &srvpb.Node{
+			Ticket: file,
+			Fact:   []*cpb.Fact{{Name: facts.NodeKind, Value: []byte(nodes.File)}},
+		}},
+		{Source: implicit},
+		{Source: implicit, Kind: edges.Ref, Target: &srvpb.Node{Ticket: "kythe:#ref"}},
+		{Source: anchor},
+		{Source: anchor, Kind: edges.Ref, Target: &srvpb.Node{Ticket: "kythe:#ref"}},
+		{Source: anchor, Kind: edges.Defines, Target: &srvpb.Node{Ticket: "kythe:#def"}},
+		{Source: orphan},
+		{Source: orphan, Kind: edges.Ref, Target: &srvpb.Node{Ticket: "kythe:#ref"}},
+	} {
+		testutil.FatalOnErrT(t, "AddEdge error: %v", b.AddEdge(ctx, e))
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+
+	expected := DecorationMetrics{
+		AnchorsProcessed:       2,
+		DecorationsEmitted:     2,
+		DecorationsDropped:     1,
+		FilesEmitted:           1,
+		ImplicitAnchorsSkipped: 1,
+	}
+	if err := testutil.DeepEqual(expected, b.Metrics()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecorationFragmentBuilderAnchorFilter(t *testing.T) {
+	const file = "kythe://corpus?path=file"
+	b := newTestDFB(nil)
+	b.SetAnchorFilter(func(a *srvpb.RawAnchor) bool {
+		return a.StartOffset >= 10 && a.EndOffset <= 20
+	})
+
+	for _, span := range [][2]int{{0, 5}, {10, 15}, {18, 25}} {
+		anchor := anchorNode(fmt.Sprintf("%s#%d", file, span[0]), span[0], span[1])
+		testutil.FatalOnErrT(t, "AddEdge error: %v", b.AddEdge(ctx, &srvpb.Edge{Source: anchor}))
+		testutil.FatalOnErrT(t, "AddEdge error: %v", b.AddEdge(ctx, &srvpb.Edge{
+			Source: anchor,
+			Kind:   edges.Ref,
+			Target: &srvpb.Node{Ticket: "kythe:#ref"},
+		}))
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", b.Flush(ctx))
+
+	var anchors []string
+	for _, fd := range b.Fragments[file] {
+		for _, d := range fd.Decoration {
+			anchors = append(anchors, d.Anchor.Ticket)
+		}
+	}
+	if err := testutil.DeepEqual([]string{file + "#10"}, anchors); err != nil {
+		t.Error(err)
+	}
+	if dropped := b.Metrics().DecorationsDropped; dropped != 2 {
+		t.Errorf("DecorationsDropped: %d; expected 2", dropped)
+	}
+}
+
+func TestCrossReferences(t *testing.T) {
+	file := &srvpb.File{Text: []byte("first line\nsecond line\n")}
+	norm := xrefs.NewNormalizer(file.Text)
+	ds := []*srvpb.FileDecorations_Decoration{{
+		Anchor: &srvpb.RawAnchor{Ticket: "kythe:#a1", StartOffset: 0, EndOffset: 5},
+		Kind:   edges.Ref,
+		Target: "kythe:#t1",
+	}, {
+		Anchor: &srvpb.RawAnchor{Ticket: "kythe:#a2", StartOffset: 11, EndOffset: 17},
+		Kind:   edges.Defines,
+		Target: "kythe:#t2",
+	}, {
+		Anchor: &srvpb.RawAnchor{Ticket: "kythe:#a3", StartOffset: 0, EndOffset: 100},
+		Kind:   edges.Ref,
+		Target: "kythe:#t3",
+	}, {
+		Anchor: &srvpb.RawAnchor{Ticket: "kythe:#a4", StartOffset: 11, EndOffset: 17},
+		Kind:   edges.Ref,
+		Target: "kythe:#t1",
+	}}
+
+	refs, errs := CrossReferences(file, norm, ds)
+	if len(refs) != len(ds) || len(errs) != len(ds) {
+		t.Fatalf("Expected %d results; found %d references and %d errors", len(ds), len(refs), len(errs))
+	}
+	for i, d := range ds {
+		expected, err := CrossReference(file, norm, d, nil)
+		if (err == nil) != (errs[i] == nil) {
+			t.Errorf("Decoration %d: expected error %v; found %v", i, err, errs[i])
+		} else if !proto.Equal(expected, refs[i]) {
+			t.Errorf("Decoration %d: expected %v; found %v", i, expected, refs[i])
+		}
+	}
+}
+
+func TestCrossReferenceNilAnchor(t *testing.T) {
+	file := &srvpb.File{Text: []byte("some text\n")}
+	d := &srvpb.FileDecorations_Decoration{Kind: edges.Ref, Target: "kythe:#target"}
+	if ref, err := CrossReference(file, xrefs.NewNormalizer(file.Text), d, nil); err != ErrNilAnchor {
+		t.Errorf("Expected ErrNilAnchor; found %v (result: %v)", err, ref)
+	}
+}
+
+func TestExpandAnchorFromLocation(t *testing.T) {
+	file := &srvpb.File{Text: []byte("first line\nsecond line\n")}
+	norm := xrefs.NewNormalizer(file.Text)
+
+	loc := &xpb.Location{
+		Ticket: "kythe:#loc",
+		Kind:   xpb.Location_SPAN,
+		Start:  &xpb.Location_Point{ByteOffset: 18},
+		End:    &xpb.Location_Point{ByteOffset: 22},
+	}
+	ea, err := ExpandAnchorFromLocation(loc, file, norm, edges.Ref)
+	testutil.FatalOnErrT(t, "ExpandAnchorFromLocation error: %v", err)
+
+	expected := &cpb.Span{
+		Start: &cpb.Point{ByteOffset: 18, LineNumber: 2, ColumnOffset: 7},
+		End:   &cpb.Point{ByteOffset: 22, LineNumber: 2, ColumnOffset: 11},
+	}
+	if ea.Ticket != loc.Ticket {
+		t.Errorf("Expected ticket %q; found %q", loc.Ticket, ea.Ticket)
+	}
+	if ea.Text != "line" {
+		t.Errorf("Expected text %q; found %q", "line", ea.Text)
+	}
+	if !proto.Equal(expected, ea.Span) {
+		t.Errorf("Expected span %v; found %v", expected, ea.Span)
+	}
+
+	loc.Ticket = ""
+	ea, err = ExpandAnchorFromLocation(loc, file, norm, edges.Ref)
+	testutil.FatalOnErrT(t, "ExpandAnchorFromLocation error: %v", err)
+	if ea.Ticket != "" {
+		t.Errorf("Expected empty ticket; found %q", ea.Ticket)
+	}
+}
+
+func TestExpandAnchorWithContext(t *testing.T) {
+	file := &srvpb.File{Text: []byte("line one\nline two\nline three\nline four\n")}
+	norm := xrefs.NewNormalizer(file.Text)
+	// Spans "two\nline three"
+	anchor := &srvpb.RawAnchor{Ticket: "kythe:#anchor", StartOffset: 14, EndOffset: 28}
+
+	tests := []struct {
+		contextLines int
+		snippet      string
+	}{
+		{-1, "line two"},
+		{0, "line two\nline three"},
+		{1, "line one\nline two\nline three\nline four"},
+		{5, "line one\nline two\nline three\nline four"},
+	}
+
+	for _, test := range tests {
+		ea, err := ExpandAnchorWithContext(anchor, file, norm, edges.Ref, test.contextLines)
+		if err != nil {
+			t.Errorf("ExpandAnchorWithContext(%d) error: %v", test.contextLines, err)
+			continue
+		}
+		if ea.Text != "two\nline three" {
+			t.Errorf("ExpandAnchorWithContext(%d): unexpected text %q", test.contextLines, ea.Text)
+		}
+		if ea.Snippet != test.snippet {
+			t.Errorf("ExpandAnchorWithContext(%d): expected snippet %q; found %q", test.contextLines, test.snippet, ea.Snippet)
+		}
+		start, end := ea.SnippetSpan.Start.ByteOffset, ea.SnippetSpan.End.ByteOffset
+		if found := string(file.Text[start:end]); found != ea.Snippet {
+			t.Errorf("ExpandAnchorWithContext(%d): snippet span %q does not match snippet %q", test.contextLines, found, ea.Snippet)
+		}
+	}
+}
+
+func TestExpandAnchorLineSnippetStart(t *testing.T) {
+	file := &srvpb.File{Text: []byte("first line\nsecond line\n")}
+	// "line" on the second line; no snippet offsets are given
+	anchor := &srvpb.RawAnchor{Ticket: "kythe:#anchor", StartOffset: 18, EndOffset: 22}
+
+	ea, err := ExpandAnchor(anchor, file, xrefs.NewNormalizer(file.Text), edges.Ref)
+	testutil.FatalOnErrT(t, "ExpandAnchor error: %v", err)
+
+	expected := &cpb.Point{ByteOffset: 11, LineNumber: 2, ColumnOffset: 0}
+	if !proto.Equal(expected, ea.SnippetSpan.Start) {
+		t.Errorf("Expected snippet start %v; found %v", expected, ea.SnippetSpan.Start)
+	}
+	if ea.Snippet != "second line" {
+		t.Errorf("Expected snippet %q; found %q", "second line", ea.Snippet)
+	}
+}
+
+func TestExpandAnchorZeroLength(t *testing.T) {
+	tests := []struct {
+		text    string
+		offset  int32
+		snippet string
+	}{
+		{"first line\nsecond line\n", 17, "second line"},
+		// A zero-length anchor at EOF has an empty line snippet.
+		{"first line\nsecond line\n", 23, ""},
+	}
+
+	for _, test := range tests {
+		file := &srvpb.File{Text: []byte(test.text)}
+		anchor := &srvpb.RawAnchor{Ticket: "kythe:#anchor", StartOffset: test.offset, EndOffset: test.offset}
+
+		ea, err := ExpandAnchor(anchor, file, xrefs.NewNormalizer(file.Text), edges.Ref)
+		if err != nil {
+			t.Errorf("ExpandAnchor error for offset %d in %q: %v", test.offset, test.text, err)
+			continue
+		}
+
+		if ea.Text != "" {
+			t.Errorf("Expected empty text; found %q", ea.Text)
+		}
+		if !proto.Equal(ea.Span.Start, ea.Span.End) {
+			t.Errorf("Expected empty span; found %v", ea.Span)
+		} else if ea.Span.Start.ByteOffset != test.offset {
+			t.Errorf("Expected span at offset %d; found %v", test.offset, ea.Span)
+		}
+		if ea.Snippet != test.snippet {
+			t.Errorf("Expected snippet %q; found %q", test.snippet, ea.Snippet)
+		}
+	}
+}
+
+func TestExpandAnchorDetectEncoding(t *testing.T) {
+	file := &srvpb.File{Text: []byte("caf\xe9 au lait\n")}
+	norm := xrefs.NewNormalizer(file.Text)
+	anchor := &srvpb.RawAnchor{Ticket: "kythe:#anchor", StartOffset: 0, EndOffset: 4}
+
+	ea, err := ExpandAnchor(anchor, file, norm, edges.Ref)
+	testutil.FatalOnErrT(t, "ExpandAnchor error: %v", err)
+	if ea.Text != "caf\uFFFD" {
+		t.Errorf("ExpandAnchor: expected text %q; found %q", "caf\uFFFD", ea.Text)
+	}
+
+	ea, err = ExpandAnchorDetectEncoding(anchor, file, norm, edges.Ref)
+	testutil.FatalOnErrT(t, "ExpandAnchorDetectEncoding error: %v", err)
+	if ea.Text != "café" {
+		t.Errorf("ExpandAnchorDetectEncoding: expected text %q; found %q", "café", ea.Text)
+	}
+	if file.Encoding != "" {
+		t.Errorf("ExpandAnchorDetectEncoding modified file encoding: %q", file.Encoding)
+	}
+}
+
+func TestConvertToInternalCrossReference(t *testing.T) {
+	file := &srvpb.File{Text: []byte("first line\nsecond line\n")}
+	norm := xrefs.NewNormalizer(file.Text)
+	d := &srvpb.FileDecorations_Decoration{
+		Anchor: &srvpb.RawAnchor{Ticket: "kythe:#anchor", StartOffset: 6, EndOffset: 10},
+		Kind:   edges.Ref,
+		Target: "kythe:#target",
+	}
+	tgt := &srvpb.Node{
+		Ticket: "kythe:#target",
+		Fact: []*cpb.Fact{
+			{Name: facts.Complete, Value: []byte("definition")},
+			{Name: facts.NodeKind, Value: []byte("record")},
+		},
+	}
+
+	expected, err := CrossReference(file, norm, d, tgt)
+	testutil.FatalOnErrT(t, "CrossReference error: %v", err)
+
+	ea, err := ExpandAnchor(d.Anchor, file, norm, "")
+	testutil.FatalOnErrT(t, "ExpandAnchor error: %v", err)
+	found := ConvertToInternalCrossReference(ea, tgt, edges.Mirror(edges.Ref))
+	if !proto.Equal(expected, found) {
+		t.Errorf("Expected %v; found %v", expected, found)
+	}
+	if ea.Kind != "" {
+		t.Errorf("ConvertToInternalCrossReference modified its anchor: %v", ea)
+	}
+}
+
+func TestGroupCrossReferencesByKind(t *testing.T) {
+	ref := func(anchor, kind string) *ipb.CrossReference {
+		return &ipb.CrossReference{
+			Referent:     &srvpb.Node{Ticket: "kythe:#target"},
+			TargetAnchor: &srvpb.ExpandedAnchor{Ticket: anchor, Kind: kind},
+		}
+	}
+	refs := []*ipb.CrossReference{
+		ref("kythe:#a1", edges.ChildOf),
+		ref("kythe:#a2", edges.Ref),
+		ref("kythe:#a3", edges.Defines),
+		ref("kythe:#a4", edges.Ref),
+		{Referent: &srvpb.Node{Ticket: "kythe:#target"}},
+	}
+
+	groups := GroupCrossReferencesByKind(refs)
+	expected := []*srvpb.PagedCrossReferences_Group{{
+		Kind:   edges.Defines,
+		Anchor: []*srvpb.ExpandedAnchor{refs[2].TargetAnchor},
+	}, {
+		Kind:   edges.Ref,
+		Anchor: []*srvpb.ExpandedAnchor{refs[1].TargetAnchor, refs[3].TargetAnchor},
+	}, {
+		Kind:   edges.ChildOf,
+		Anchor: []*srvpb.ExpandedAnchor{refs[0].TargetAnchor},
+	}}
+	if err := testutil.DeepEqual(expected, groups); err != nil {
+		t.Error(err)
+	}
+	if !sort.IsSorted(byRefKind(groups)) {
+		t.Errorf("Groups are not sorted: %v", groups)
+	}
+}
+
+func TestPageKeyToSource(t *testing.T) {
+	tests := []struct {
+		ticket string
+		index  int
+	}{
+		{"kythe://corpus?path=file.go#sig", 0},
+		{"kythe:#source", 42},
+		{"kythe://corpus?lang=go?path=a.b.c#d.e", 12345678901},
+	}
+	for _, test := range tests {
+		key := newPageKey(test.ticket, test.index)
+		ticket, index, err := PageKeyToSource(key)
+		if err != nil {
+			t.Errorf("PageKeyToSource(%q) error: %v", key, err)
+		} else if ticket != test.ticket || index != test.index {
+			t.Errorf("PageKeyToSource(%q): expected (%q, %d); found (%q, %d)", key, test.ticket, test.index, ticket, index)
+		}
+		if err := ValidatePageKey(key); err != nil {
+			t.Errorf("ValidatePageKey(%q) error: %v", key, err)
+		}
+	}
+
+	for _, key := range []string{
+		"",
+		"kythe:#source",
+		"kythe:#source.",
+		"kythe:#source.12",
+		"kythe:#source.00000000x1",
+		"kythe:#source.-000000001",
+	} {
+		if ticket, index, err := PageKeyToSource(key); err == nil {
+			t.Errorf("PageKeyToSource(%q): expected error; found (%q, %d)", key, ticket, index)
+		}
+		if err := ValidatePageKey(key); err == nil {
+			t.Errorf("ValidatePageKey(%q): expected error", key)
+		}
+	}
+
+	for _, key := range []string{".0000000000", "kythe:#%zz.0000000001"} {
+		if _, _, err := PageKeyToSource(key); err != nil {
+			t.Errorf("PageKeyToSource(%q) error: %v", key, err)
+		}
+		if err := ValidatePageKey(key); err == nil {
+			t.Errorf("ValidatePageKey(%q): expected invalid ticket error", key)
+		}
+	}
+}
+
+func TestExtractDefinitions(t *testing.T) {
+	xs := &srvpb.PagedCrossReferences{
+		SourceTicket: "kythe:#source",
+		Group: []*srvpb.PagedCrossReferences_Group{
+			{Kind: edges.Mirror(edges.Defines), Anchor: getAnchors("kythe:#d1")},
+			{Kind: edges.DefinesBinding, Anchor: getAnchors("kythe:#d2", "kythe:#d3")},
+			{Kind: edges.Ref, Anchor: getAnchors("kythe:#r1")},
+			{Kind: edges.Mirror(edges.RefCall), Anchor: getAnchors("kythe:#r2")},
+			{Kind: edges.ChildOf, Anchor: getAnchors("kythe:#c1")},
+			{Kind: "/kythe/edge/definesfoo", Anchor: getAnchors("kythe:#x1")},
+		},
+		PageIndex: []*srvpb.PagedCrossReferences_PageIndex{
+			{Kind: edges.Defines, Count: 10, PageKey: "page0"},
+		},
+	}
+
+	if err := testutil.DeepEqual(getAnchors("kythe:#d1", "kythe:#d2", "kythe:#d3"), ExtractDefinitions(xs)); err != nil {
+		t.Errorf("ExtractDefinitions: %v", err)
+	}
+	if err := testutil.DeepEqual(getAnchors("kythe:#r1", "kythe:#r2"), ExtractReferences(xs)); err != nil {
+		t.Errorf("ExtractReferences: %v", err)
+	}
+}
+
+func TestCrossReferencesByFile(t *testing.T) {
+	ref := func(anchor string, line int32) *ipb.CrossReference {
+		return &ipb.CrossReference{
+			Referent: &srvpb.Node{Ticket: "kythe:#target"},
+			TargetAnchor: &srvpb.ExpandedAnchor{
+				Ticket: anchor,
+				Kind:   edges.Ref,
+				Span:   &cpb.Span{Start: &cpb.Point{LineNumber: line}},
+			},
+		}
+	}
+	refs := []*ipb.CrossReference{
+		ref("kythe://corpus?lang=go?path=foo.go#a1", 20),
+		ref("kythe://corpus?lang=go?path=bar.go#a2", 5),
+		ref("kythe://corpus?lang=go?path=foo.go#a3", 10),
+		ref("kythe://corpus?lang=go?path=bar.go#a4", 5),
+		ref("kythe://corpus?lang=go?path=foo.go#a5", 15),
+		ref("bad ticket", 1),
+	}
+
+	expected := map[string][]*ipb.CrossReference{
+		"kythe://corpus?path=foo.go": {refs[2], refs[4], refs[0]},
+		"kythe://corpus?path=bar.go": {refs[1], refs[3]},
+		"":                           {refs[5]},
+	}
+	if err := testutil.DeepEqual(expected, CrossReferencesByFile(refs)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpandedAnchorToRaw(t *testing.T) {
+	file := &srvpb.File{Text: []byte("first line\nsecond line\nthird line\n")}
+	norm := xrefs.NewNormalizer(file.Text)
+	anchors := []*srvpb.RawAnchor{
+		{Ticket: "kythe:#a1", StartOffset: 18, EndOffset: 22, SnippetStart: 11, SnippetEnd: 22},
+		{Ticket: "kythe:#a2", StartOffset: 0, EndOffset: 5, SnippetStart: 0, SnippetEnd: 10},
+		{Ticket: "kythe:#a3", StartOffset: 29, EndOffset: 29, SnippetStart: 23, SnippetEnd: 33},
+	}
+
+	for _, raw := range anchors {
+		ea, err := ExpandAnchor(raw, file, norm, edges.Ref)
+		if err != nil {
+			t.Errorf("ExpandAnchor(%v) error: %v", raw, err)
+			continue
+		}
+		if found := ExpandedAnchorToRaw(ea); !proto.Equal(raw, found) {
+			t.Errorf("Expected %v; found %v", raw, found)
+		}
+	}
+
+	if found := ExpandedAnchorToRaw(&srvpb.ExpandedAnchor{Ticket: "kythe:#empty"}); !proto.Equal(&srvpb.RawAnchor{Ticket: "kythe:#empty"}, found) {
+		t.Errorf("Unexpected RawAnchor for spanless anchor: %v", found)
+	}
+}
+
+func TestAnchorText(t *testing.T) {
+	file := &srvpb.File{Text: []byte("first line\nsecond line\n")}
+	norm := xrefs.NewNormalizer(file.Text)
+	for _, anchor := range []*srvpb.RawAnchor{
+		{StartOffset: 0, EndOffset: 5},
+		{StartOffset: 6, EndOffset: 17},
+		{StartOffset: 11, EndOffset: 11},
+	} {
+		txt, err := AnchorText(anchor, file)
+		testutil.FatalOnErrT(t, "AnchorText error: %v", err)
+		ea, err := ExpandAnchor(anchor, file, norm, edges.Ref)
+		testutil.FatalOnErrT(t, "ExpandAnchor error: %v", err)
+		if txt != ea.Text {
+			t.Errorf("AnchorText(%v): expected %q; found %q", anchor, ea.Text, txt)
+		}
+	}
+
+	for _, anchor := range []*srvpb.RawAnchor{
+		{StartOffset: -1, EndOffset: 5},
+		{StartOffset: 5, EndOffset: 2},
+		{StartOffset: 20, EndOffset: 30},
+	} {
+		if txt, err := AnchorText(anchor, file); err == nil {
+			t.Errorf("AnchorText(%v): expected error; found %q", anchor, txt)
+		}
+	}
+}
+
+func TestBuildSnippetIndex(t *testing.T) {
+	file := &srvpb.File{Text: []byte("first line\nsecond line\nthird line\n")}
+	anchors := []*srvpb.RawAnchor{
+		{Ticket: "kythe:#a3", StartOffset: 23, EndOffset: 28},
+		{Ticket: "kythe:#a1", StartOffset: 0, EndOffset: 5},
+		{Ticket: "kythe:#a2", StartOffset: 6, EndOffset: 10},
+		{Ticket: "kythe:#a4", StartOffset: 11, EndOffset: 17, SnippetStart: 11, SnippetEnd: 28},
+		{Ticket: "kythe:#bad", StartOffset: 30, EndOffset: 50},
+	}
+
+	snippets, err := BuildSnippetIndex(file, anchors)
+	if errs, ok := err.(SnippetErrors); !ok || len(errs) != 1 {
+		t.Errorf("Expected 1 SnippetError; found %v", err)
+	}
+
+	norm := xrefs.NewNormalizer(file.Text)
+	expected := make(map[string]string)
+	for _, a := range anchors[:4] {
+		ea, err := ExpandAnchor(a, file, norm, edges.Ref)
+		testutil.FatalOnErrT(t, "ExpandAnchor error: %v", err)
+		expected[a.Ticket] = ea.Snippet
+	}
+	if err := testutil.DeepEqual(expected, snippets); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := BuildSnippetIndex(file, anchors[:4]); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRawAnchorKey(t *testing.T) {
+	anchor := &srvpb.RawAnchor{Ticket: "kythe://corpus#a", StartOffset: 4, EndOffset: 10, SnippetEnd: 20}
+	if found, expected := RawAnchorKey(anchor), "kythe://corpus#a:4-10"; found != expected {
+		t.Errorf("Expected %q; found %q", expected, found)
+	}
+
+	keys := map[string]bool{RawAnchorKey(anchor): true}
+	for _, other := range []*srvpb.RawAnchor{
+		{Ticket: "kythe://corpus#a", StartOffset: 4, EndOffset: 11},
+		{Ticket: "kythe://corpus#b", StartOffset: 4, EndOffset: 10},
+	} {
+		if keys[RawAnchorKey(other)] {
+			t.Errorf("Key collision between %v and %v", anchor, other)
+		}
+	}
+	if !keys[RawAnchorKey(&srvpb.RawAnchor{Ticket: "kythe://corpus#a", StartOffset: 4, EndOffset: 10})] {
+		t.Errorf("Expected key to ignore snippet offsets")
+	}
+}
+
+func TestAnchorGeometry(t *testing.T) {
+	span := func(start, end int32) *srvpb.RawAnchor {
+		return &srvpb.RawAnchor{StartOffset: start, EndOffset: end}
+	}
+	tests := []struct {
+		a, b              *srvpb.RawAnchor
+		overlap, contains bool
+	}{
+		{span(5, 10), span(5, 10), true, true},    // equal spans
+		{span(5, 10), span(10, 15), false, false}, // adjacent spans
+		{span(10, 15), span(5, 10), false, false}, // adjacent spans (reversed)
+		{span(5, 10), span(5, 7), true, true},     // same start
+		{span(5, 10), span(7, 10), true, true},    // same end
+		{span(5, 7), span(5, 10), true, false},    // same start (reversed)
+		{span(5, 10), span(8, 12), true, false},   // partial overlap
+		{span(5, 10), span(6, 9), true, true},     // strictly nested
+		{span(5, 10), span(11, 12), false, false}, // disjoint
+		{span(5, 10), span(7, 7), true, true},     // empty span within
+		{span(5, 10), span(5, 5), false, true},    // empty span at start
+	}
+	for _, test := range tests {
+		if found := OverlapAnchors(test.a, test.b); found != test.overlap {
+			t.Errorf("OverlapAnchors(%v, %v): expected %v; found %v", test.a, test.b, test.overlap, found)
+		}
+		if found := OverlapAnchors(test.b, test.a); found != test.overlap {
+			t.Errorf("OverlapAnchors(%v, %v): expected %v; found %v", test.b, test.a, test.overlap, found)
+		}
+		if found := ContainsAnchor(test.a, test.b); found != test.contains {
+			t.Errorf("ContainsAnchor(%v, %v): expected %v; found %v", test.a, test.b, test.contains, found)
+		}
+	}
+}
+
+func TestNormalizerCache(t *testing.T) {
+	files := []*srvpb.File{
+		{Ticket: "kythe:#f1", Text: []byte("one\n")},
+		{Ticket: "kythe:#f2", Text: []byte("two\n")},
+		{Ticket: "kythe:#f3", Text: []byte("three\n")},
+	}
+	c := NewNormalizerCache(2)
+
+	n1, n2 := c.Get(files[0]), c.Get(files[1])
+	if c.Get(files[0]) != n1 {
+		t.Error("Expected cached Normalizer for f1")
+	}
+	c.Get(files[2]) // evicts f2, the least recently used
+	if c.Get(files[0]) != n1 {
+		t.Error("Expected f1 to remain cached")
+	}
+	if c.Get(files[1]) == n2 {
+		t.Error("Expected f2 to have been evicted")
+	}
+
+	c.Purge(files[0].Ticket)
+	if c.Get(files[0]) == n1 {
+		t.Error("Expected f1 to have been purged")
+	}
+}
+
+func BenchmarkNormalizerCache(b *testing.B) {
+	var files []*srvpb.File
+	for i := 0; i < 10; i++ {
+		files = append(files, &srvpb.File{
+			Ticket: fmt.Sprintf("kythe:#file%d", i),
+			Text:   []byte(strings.Repeat("some line of text\n", 100)),
+		})
+	}
+	c := NewNormalizerCache(len(files))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, f := range files {
+			c.Get(f)
+		}
+	}
+}
+
+func TestGetFacts(t *testing.T) {
+	fs := []*cpb.Fact{
+		{Name: facts.NodeKind, Value: []byte("function")},
+		{Name: facts.Subkind, Value: []byte("constructor")},
+		{Name: facts.NodeKind, Value: []byte("duplicate")},
+		{Name: facts.Text, Value: []byte("text")},
+	}
+
+	found := GetFacts(fs, facts.NodeKind, facts.Subkind, facts.Complete)
+	expected := map[string][]byte{
+		facts.NodeKind: []byte("function"),
+		facts.Subkind:  []byte("constructor"),
+	}
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Error(err)
+	}
+	for _, name := range []string{facts.NodeKind, facts.Subkind, facts.Complete} {
+		if v := GetFact(fs, name); string(v) != string(found[name]) {
+			t.Errorf("GetFacts disagrees with GetFact(%q): %q vs. %q", name, found[name], v)
+		}
+	}
+}
+
+func TestMapToFacts(t *testing.T) {
+	tests := [][]*cpb.Fact{
+		{},
+		{{Name: facts.NodeKind, Value: []byte("record")}},
+		{
+			{Name: facts.Complete, Value: []byte("definition")},
+			{Name: facts.NodeKind, Value: []byte("record")},
+			{Name: facts.Subkind, Value: []byte("class")},
+			{Name: facts.Text, Value: nil},
+		},
+	}
+
+	for _, fs := range tests {
+		found := MapToFacts(FactsToMap(fs))
+		if len(found) != len(fs) {
+			t.Errorf("MapToFacts(FactsToMap(%v)): expected %d facts; found %v", fs, len(fs), found)
+			continue
+		}
+		for i := range fs {
+			if fs[i].Name != found[i].Name || string(fs[i].Value) != string(found[i].Value) {
+				t.Errorf("MapToFacts(FactsToMap(%v)): expected %v; found %v", fs, fs[i], found[i])
+			}
+		}
+	}
+}
+
+func TestFactDiff(t *testing.T) {
+	a := []*cpb.Fact{
+		{Name: facts.Text, Value: []byte("text")},
+		{Name: facts.Complete, Value: []byte("incomplete")},
+		{Name: facts.NodeKind, Value: []byte("record")},
+	}
+	b := []*cpb.Fact{
+		{Name: facts.Complete, Value: []byte("definition")},
+		{Name: facts.NodeKind, Value: []byte("record")},
+		{Name: facts.Subkind, Value: []byte("class")},
+	}
+
+	added, removed, changed := FactDiff(a, b)
+	if err := testutil.DeepEqual([]*cpb.Fact{b[2]}, added); err != nil {
+		t.Errorf("added: %v", err)
+	}
+	if err := testutil.DeepEqual([]*cpb.Fact{a[0]}, removed); err != nil {
+		t.Errorf("removed: %v", err)
+	}
+	if err := testutil.DeepEqual([]*cpb.Fact{b[0]}, changed); err != nil {
+		t.Errorf("changed: %v", err)
+	}
+	if a[0].Name != facts.Text {
+		t.Error("FactDiff modified its input")
+	}
+}
+
+func TestFactsToMapByNames(t *testing.T) {
+	fs := []*cpb.Fact{
+		{Name: facts.Complete, Value: []byte("definition")},
+		{Name: facts.NodeKind, Value: []byte("record")},
+		{Name: facts.Subkind, Value: []byte("class")},
+		{Name: facts.Text, Value: []byte("text")},
+	}
+
+	expected := map[string][]byte{
+		facts.NodeKind: []byte("record"),
+		facts.Subkind:  []byte("class"),
+	}
+	if err := testutil.DeepEqual(expected, FactsToMapByNames(fs, facts.NodeKind, facts.Subkind, facts.Code)); err != nil {
+		t.Error(err)
+	}
+}
+
+func benchmarkFacts() []*cpb.Fact {
+	fs := []*cpb.Fact{
+		{Name: facts.NodeKind, Value: []byte("record")},
+		{Name: facts.Subkind, Value: []byte("class")},
+	}
+	for i := 0; i < 20; i++ {
+		fs = append(fs, &cpb.Fact{Name: fmt.Sprintf("/kythe/fact%d", i), Value: []byte("value")})
+	}
+	return fs
+}
+
+func BenchmarkFactsToMap(b *testing.B) {
+	fs := benchmarkFacts()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FactsToMap(fs)
+	}
+}
+
+func BenchmarkFactsToMapByNames(b *testing.B) {
+	fs := benchmarkFacts()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FactsToMapByNames(fs, facts.NodeKind, facts.Subkind)
+	}
+}
+
+func TestValidateFact(t *testing.T) {
+	tests := []struct {
+		fact  *cpb.Fact
+		valid bool
+	}{
+		{&cpb.Fact{Name: facts.NodeKind, Value: []byte("record")}, true},
+		{&cpb.Fact{Name: facts.Text, Value: []byte{}}, true},
+		{nil, false},
+		{&cpb.Fact{Value: []byte("value")}, false},
+		{&cpb.Fact{Name: "node/kind", Value: []byte("record")}, false},
+		{&cpb.Fact{Name: "/other/fact", Value: []byte("value")}, false},
+		{&cpb.Fact{Name: "/kythe/bad\x00name", Value: []byte("value")}, false},
+		{&cpb.Fact{Name: facts.NodeKind}, false},
+	}
+
+	for _, test := range tests {
+		if err := ValidateFact(test.fact); (err == nil) != test.valid {
+			t.Errorf("ValidateFact(%v): expected valid: %v; found error: %v", test.fact, test.valid, err)
+		}
+	}
+}
+
+func TestValidateSource(t *testing.T) {
+	src := &ipb.Source{
+		Ticket: "kythe:#valid",
+		Facts: map[string][]byte{
+			facts.NodeKind: []byte("record"),
+		},
+	}
+	if errs := ValidateSource(src); errs != nil {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	src.Ticket = ""
+	src.Facts["invalid"] = []byte("value")
+	if errs := ValidateSource(src); len(errs) != 2 {
+		t.Errorf("Expected 2 errors; found %v", errs)
+	}
+
+	src = &ipb.Source{
+		Ticket: "kythe:#%zz",
+		Facts:  map[string][]byte{facts.NodeKind: nil},
+		EdgeGroups: map[string]*ipb.Source_EdgeGroup{
+			"": {Edges: []*ipb.Source_Edge{{Ticket: "kythe:#t"}}},
+			edges.Param: {Edges: []*ipb.Source_Edge{
+				{Ticket: "kythe:#t", Ordinal: -1},
+				{Ticket: "kythe:#t", Ordinal: 0},
+				{Ticket: "kythe:#u", Ordinal: 0},
+				{Ticket: "kythe:#t", Ordinal: 0},
+			}},
+		},
+	}
+	errs := ValidateSource(src)
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	for _, expected := range []string{"invalid source ticket", "nil value", "empty kind", "negative ordinal", "duplicate"} {
+		if !strings.Contains(strings.Join(msgs, "\n"), expected) {
+			t.Errorf("Missing %q error: %v", expected, msgs)
+		}
+	}
+	if len(errs) != 5 {
+		t.Errorf("Expected 5 errors; found %v", errs)
+	}
+}
+
+func BenchmarkValidateFacts(b *testing.B) {
+	fs := benchmarkFacts()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ValidateFacts(fs)
+	}
+}
+
+func TestCompareEdges(t *testing.T) {
+	es := []*ipb.Source_Edge{
+		{Ticket: "kythe:#a", Ordinal: 0},
+		{Ticket: "kythe:#b", Ordinal: 0},
+		{Ticket: "kythe:#a", Ordinal: 1},
+		{Ticket: "kythe:#a", Ordinal: 1},
+		{Ticket: "kythe:#0", Ordinal: 2},
+	}
+
+	for i, a := range es {
+		for j, b := range es {
+			c := CompareEdges(a, b)
+			if c != -CompareEdges(b, a) {
+				t.Errorf("CompareEdges(%v, %v) is not antisymmetric", a, b)
+			}
+			if less := byOrdinal(es).Less(i, j); less != (c < 0) {
+				t.Errorf("CompareEdges(%v, %v) = %d; inconsistent with byOrdinal.Less = %v", a, b, c, less)
+			}
+			if (c == 0) != proto.Equal(a, b) {
+				t.Errorf("CompareEdges(%v, %v) = %d", a, b, c)
+			}
+		}
+	}
+}
+
+func TestRenumberOrdinals(t *testing.T) {
+	targets := []*ipb.Source_Edge{
+		{Ticket: "kythe:#b", Ordinal: 5},
+		{Ticket: "kythe:#c", Ordinal: 3},
+		{Ticket: "kythe:#a", Ordinal: 5},
+	}
+	orig := proto.Clone(&ipb.Source_EdgeGroup{Edges: targets})
+
+	expected := []*ipb.Source_Edge{
+		{Ticket: "kythe:#c", Ordinal: 0},
+		{Ticket: "kythe:#a", Ordinal: 1},
+		{Ticket: "kythe:#b", Ordinal: 2},
+	}
+	if err := testutil.DeepEqual(expected, RenumberOrdinals(targets)); err != nil {
+		t.Error(err)
+	}
+	if !proto.Equal(orig, &ipb.Source_EdgeGroup{Edges: targets}) {
+		t.Errorf("RenumberOrdinals modified its input: %v", targets)
+	}
+
+	if found := RenumberOrdinals(nil); len(found) != 0 {
+		t.Errorf("RenumberOrdinals(nil): expected empty slice; found %v", found)
+	}
+}
+
+func TestEdgeTargetsToProto(t *testing.T) {
+	tests := [][]*ipb.Source_Edge{
+		{},
+		{{Ticket: "kythe:#a"}},
+		{{Ticket: "kythe:#b", Ordinal: 2}, {Ticket: "kythe:#a", Ordinal: 1}, {Ticket: "kythe:#b", Ordinal: 2}},
+	}
+	for _, targets := range tests {
+		eg := EdgeTargetsToProto(edges.Param, targets)
+		if eg.Kind != edges.Param || len(eg.Edge) != len(targets) {
+			t.Errorf("EdgeTargetsToProto(%v): unexpected group %v", targets, eg)
+			continue
+		}
+		for i, e := range eg.Edge {
+			if e.Target.Ticket != targets[i].Ticket || e.Ordinal != targets[i].Ordinal {
+				t.Errorf("Edge %d: expected %v; found %v", i, targets[i], e)
+			}
+		}
+
+		kind, found := ProtoToEdgeTargets(eg)
+		if kind != edges.Param {
+			t.Errorf("ProtoToEdgeTargets: expected kind %q; found %q", edges.Param, kind)
+		}
+		if err := testutil.DeepEqual(targets, found); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCopySource(t *testing.T) {
+	src := &ipb.Source{
+		Ticket: "kythe:#source",
+		Facts: map[string][]byte{
+			facts.NodeKind: []byte("record"),
+			facts.Text:     []byte{},
+		},
+		EdgeGroups: map[string]*ipb.Source_EdgeGroup{
+			edges.ChildOf: {Edges: []*ipb.Source_Edge{{Ticket: "kythe:#parent"}}},
+			edges.Param:   {Edges: []*ipb.Source_Edge{{Ticket: "kythe:#p0"}, {Ticket: "kythe:#p1", Ordinal: 1}}},
+		},
+	}
+	orig := proto.Clone(src).(*ipb.Source)
+
+	cp := CopySource(src)
+	if !proto.Equal(src, cp) {
+		t.Fatalf("Expected %v; found %v", src, cp)
+	}
+
+	// Concurrently read the original while mutating the copy.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = string(src.Facts[facts.NodeKind])
+			for _, g := range src.EdgeGroups {
+				for _, e := range g.Edges {
+					_ = e.Ticket
+				}
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		cp.Facts[facts.NodeKind][0] = 'R'
+		cp.Facts[fmt.Sprintf("/kythe/fact%d", i)] = []byte("value")
+		cp.EdgeGroups[edges.Param].Edges[0].Ticket = "kythe:#changed"
+		cp.EdgeGroups[edges.Named] = &ipb.Source_EdgeGroup{}
+	}
+	<-done
+
+	if !proto.Equal(orig, src) {
+		t.Errorf("Original Source was modified: %v", src)
+	}
+}
+
+func TestSourceFromNode(t *testing.T) {
+	src := &ipb.Source{
+		Ticket: "kythe:#source",
+		Facts: map[string][]byte{
+			facts.NodeKind: []byte("record"),
+			facts.Subkind:  []byte("class"),
+		},
+		EdgeGroups: map[string]*ipb.Source_EdgeGroup{
+			edges.ChildOf: {Edges: []*ipb.Source_Edge{{Ticket: "kythe:#parent"}}},
+		},
+	}
+
+	n := Node(src)
+	rt := SourceFromNode(n)
+	if found := Node(rt); !proto.Equal(n, found) {
+		t.Errorf("Expected %v; found %v", n, found)
+	}
+	if rt.EdgeGroups == nil || len(rt.EdgeGroups) != 0 {
+		t.Errorf("Expected empty edge groups; found %v", rt.EdgeGroups)
+	}
+}
+
+func TestBuildNodeIndex(t *testing.T) {
+	srcs := make(chan *ipb.Source, 2)
+	srcs <- &ipb.Source{
+		Ticket: "kythe:#file",
+		Facts: map[string][]byte{
+			facts.NodeKind: []byte(nodes.File),
+			facts.Text:     []byte("some text"),
+		},
+	}
+	srcs <- &ipb.Source{
+		Ticket: "kythe:#anchor",
+		Facts: map[string][]byte{
+			facts.NodeKind: []byte(nodes.Anchor),
+			facts.Text:     []byte("more text"),
+		},
+	}
+	close(srcs)
+
+	var found []*srvpb.Node
+	testutil.FatalOnErrT(t, "BuildNodeIndex error: %v", BuildNodeIndex(context.Background(), srcs, func(_ context.Context, n *srvpb.Node) error {
+		found = append(found, n)
+		return nil
+	}))
+
+	expected := []*srvpb.Node{{
+		Ticket: "kythe:#file",
+		Fact: []*cpb.Fact{
+			{Name: facts.NodeKind, Value: []byte(nodes.File)},
+			{Name: facts.Text, Value: []byte("some text")},
+		},
+	}, {
+		Ticket: "kythe:#anchor",
+		Fact:   []*cpb.Fact{{Name: facts.NodeKind, Value: []byte(nodes.Anchor)}},
+	}}
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShardBy(t *testing.T) {
+	const (
+		numShards  = 16
+		numTickets = 10000
+
+		// Critical value of the chi-squared distribution with numShards-1
+		// degrees of freedom at p = 0.001.
+		criticalValue = 37.697
+	)
+
+	r := rand.New(rand.NewSource(0))
+	counts := make([]int, numShards)
+	for i := 0; i < numTickets; i++ {
+		ticket := fmt.Sprintf("kythe://corpus?lang=go?path=pkg/file%d.go#sig%x", r.Intn(numTickets), r.Int63())
+		shard := ShardBy(ticket, numShards)
+		if shard < 0 || shard >= numShards {
+			t.Fatalf("ShardBy(%q, %d) = %d; out of range", ticket, numShards, shard)
+		} else if again := ShardBy(ticket, numShards); again != shard {
+			t.Fatalf("ShardBy(%q, %d) is not deterministic: %d vs. %d", ticket, numShards, shard, again)
+		}
+		counts[shard]++
+	}
+
+	expected := float64(numTickets) / numShards
+	var chiSquared float64
+	for _, c := range counts {
+		d := float64(c) - expected
+		chiSquared += d * d / expected
+	}
+	if chiSquared > criticalValue {
+		t.Errorf("Non-uniform shard distribution (chi-squared = %f): %v", chiSquared, counts)
+	}
+}
+
+func TestAnchorParents(t *testing.T) {
+	src := &ipb.Source{
+		Ticket: "kythe:#anchor",
+		Facts:  map[string][]byte{facts.NodeKind: []byte(nodes.Anchor)},
+		EdgeGroups: map[string]*ipb.Source_EdgeGroup{
+			edges.ChildOf: {Edges: []*ipb.Source_Edge{
+				{Ticket: "kythe:?path=file1"},
+				{Ticket: "kythe:#function"},
+				{Ticket: "kythe:?path=file2"},
+			}},
+			edges.Ref: {Edges: []*ipb.Source_Edge{{Ticket: "kythe:?path=file3"}}},
+		},
+	}
+	kinds := map[string]string{
+		"kythe:?path=file1": nodes.File,
+		"kythe:?path=file2": nodes.File,
+		"kythe:?path=file3": nodes.File,
+		"kythe:#function":   nodes.Function,
+	}
+
+	found := AnchorParents(src, func(ticket string) string { return kinds[ticket] })
+	if err := testutil.DeepEqual([]string{"kythe:?path=file1", "kythe:?path=file2"}, found); err != nil {
+		t.Error(err)
+	}
+
+	if found := AnchorParents(&ipb.Source{Ticket: "kythe:#empty"}, func(string) string { return nodes.File }); len(found) != 0 {
+		t.Errorf("Expected no parents; found %v", found)
+	}
+}
+
+func TestNodeKinds(t *testing.T) {
+	node := func(kind, subkind string) *srvpb.Node {
+		n := &srvpb.Node{Ticket: "kythe:#node"}
+		if kind != "" {
+			n.Fact = append(n.Fact, &cpb.Fact{Name: facts.NodeKind, Value: []byte(kind)})
+		}
+		if subkind != "" {
+			n.Fact = append(n.Fact, &cpb.Fact{Name: facts.Subkind, Value: []byte(subkind)})
+		}
+		return n
+	}
+
+	tests := []struct {
+		node                       *srvpb.Node
+		kind, subkind              string
+		isFile, isAnchor, implicit bool
+	}{
+		{node("", ""), "", "", false, false, false},
+		{node(nodes.File, ""), nodes.File, "", true, false, false},
+		{node(nodes.Anchor, ""), nodes.Anchor, "", false, true, false},
+		{node(nodes.Anchor, nodes.Implicit), nodes.Anchor, nodes.Implicit, false, true, true},
+		{node(nodes.Record, nodes.Implicit), nodes.Record, nodes.Implicit, false, false, false},
+	}
+
+	for _, test := range tests {
+		if found := NodeKind(test.node); found != test.kind {
+			t.Errorf("NodeKind(%v): expected %q; found %q", test.node, test.kind, found)
+		}
+		if found := NodeSubkind(test.node); found != test.subkind {
+			t.Errorf("NodeSubkind(%v): expected %q; found %q", test.node, test.subkind, found)
+		}
+		if found := IsFileNode(test.node); found != test.isFile {
+			t.Errorf("IsFileNode(%v): expected %v; found %v", test.node, test.isFile, found)
+		}
+		if found := IsAnchorNode(test.node); found != test.isAnchor {
+			t.Errorf("IsAnchorNode(%v): expected %v; found %v", test.node, test.isAnchor, found)
+		}
+		if found := IsImplicitAnchorNode(test.node); found != test.implicit {
+			t.Errorf("IsImplicitAnchorNode(%v): expected %v; found %v", test.node, test.implicit, found)
+		}
+	}
+}
+
+func TestFilterImplicitAnchors(t *testing.T) {
+	source := func(ticket, kind, subkind string) *ipb.Source {
+		src := &ipb.Source{Ticket: ticket, Facts: map[string][]byte{facts.NodeKind: []byte(kind)}}
+		if subkind != "" {
+			src.Facts[facts.Subkind] = []byte(subkind)
+		}
+		return src
+	}
+	srcs := []*ipb.Source{
+		source("kythe:#a0", nodes.Anchor, ""),
+		source("kythe:#a1", nodes.Anchor, nodes.Implicit),
+		source("kythe:#r", nodes.Record, nodes.Implicit),
+		source("kythe:#a2", nodes.Anchor, nodes.Implicit),
+		source("kythe:#f", nodes.File, ""),
+	}
+
+	var implicit int
+	for _, src := range srcs {
+		if IsImplicitAnchor(src) {
+			implicit++
+		}
+	}
+	if implicit != 2 {
+		t.Errorf("Expected 2 implicit anchors; found %d", implicit)
+	}
+
+	filtered := FilterImplicitAnchors(srcs)
+	if len(filtered) != 3 {
+		t.Fatalf("Expected 3 Sources; found %d: %v", len(filtered), filtered)
+	}
+	for i, ticket := range []string{"kythe:#a0", "kythe:#r", "kythe:#f"} {
+		if filtered[i].Ticket != ticket {
+			t.Errorf("Source %d: expected %q; found %q", i, ticket, filtered[i].Ticket)
+		}
+	}
+	if len(srcs) != 5 {
+		t.Errorf("FilterImplicitAnchors modified its input: %v", srcs)
+	}
+}
+
+func TestGroupSourcesByKind(t *testing.T) {
+	source := func(ticket, kind string) *ipb.Source {
+		src := &ipb.Source{Ticket: ticket, Facts: map[string][]byte{}}
+		if kind != "" {
+			src.Facts[facts.NodeKind] = []byte(kind)
+		}
+		return src
+	}
+	srcs := []*ipb.Source{
+		source("kythe:#a0", nodes.Anchor),
+		source("kythe:#f", nodes.File),
+		source("kythe:#unknown", ""),
+		source("kythe:#a1", nodes.Anchor),
+		{Ticket: "kythe:#nofacts"},
+	}
+
+	groups := GroupSourcesByKind(srcs)
+	expected := map[string][]string{
+		nodes.Anchor: {"kythe:#a0", "kythe:#a1"},
+		nodes.File:   {"kythe:#f"},
+		"":           {"kythe:#unknown", "kythe:#nofacts"},
+	}
+	found := make(map[string][]string)
+	for kind, srcs := range groups {
+		for _, src := range srcs {
+			found[kind] = append(found[kind], src.Ticket)
+		}
+	}
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Error(err)
+	}
+
+	if groups := GroupSourcesByKind(nil); len(groups) != 0 {
+		t.Errorf("GroupSourcesByKind(nil): expected no groups; found %v", groups)
+	}
+}
+
+func TestDeduplicateNodes(t *testing.T) {
+	node := func(ticket, kind string) *srvpb.Node {
+		return &srvpb.Node{
+			Ticket: ticket,
+			Fact:   []*cpb.Fact{{Name: facts.NodeKind, Value: []byte(kind)}},
+		}
+	}
+	tickets := []string{"kythe:#a", "kythe:#b", "kythe:#b", "kythe:#c", "kythe:#d", "kythe:#d", "kythe:#d"}
+	expected := []*srvpb.Node{
+		node("kythe:#a", "record"),
+		node("kythe:#b", "record"),
+		node("kythe:#c", "record"),
+		node("kythe:#d", "record"),
+	}
+
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 10; i++ {
+		nodes := make([]*srvpb.Node, len(tickets))
+		for j, k := range r.Perm(len(tickets)) {
+			nodes[j] = node(tickets[k], "record")
+		}
+		if err := testutil.DeepEqual(expected, DeduplicateNodes(SortNodes(nodes))); err != nil {
+			t.Fatalf("Shuffle %d: %v", i, err)
+		}
+	}
+
+	// The first of each set of duplicates is kept.
+	found := DeduplicateNodes([]*srvpb.Node{
+		node("kythe:#a", "first"),
+		node("kythe:#a", "second"),
+		node("kythe:#b", "first"),
+	})
+	if err := testutil.DeepEqual([]*srvpb.Node{node("kythe:#a", "first"), node("kythe:#b", "first")}, found); err != nil {
+		t.Error(err)
+	}
+
+	if found := DeduplicateNodes(nil); len(found) != 0 {
+		t.Errorf("Expected no nodes; found %v", found)
+	}
+}
+
+func TestDiffNodes(t *testing.T) {
+	f := func(name, value string) *cpb.Fact { return &cpb.Fact{Name: name, Value: []byte(value)} }
+	a := &srvpb.Node{Ticket: "kythe:#node", Fact: []*cpb.Fact{
+		f(facts.Complete, "incomplete"),
+		f(facts.NodeKind, "record"),
+		f(facts.Subkind, "class"),
+	}}
+	b := &srvpb.Node{Ticket: "kythe:#node", Fact: []*cpb.Fact{
+		f(facts.Complete, "definition"),
+		f(facts.NodeKind, "record"),
+		f(facts.Text, "text"),
+	}}
+
+	if d := DiffNodes(a, a); !d.IsEmpty() || d.String() != "" {
+		t.Errorf("Expected empty diff; found %v", d)
+	}
+
+	d := DiffNodes(a, b)
+	expected := NodeDiff{
+		Added:   []*cpb.Fact{f(facts.Text, "text")},
+		Removed: []*cpb.Fact{f(facts.Subkind, "class")},
+		Changed: []FactChange{{Name: facts.Complete, Old: []byte("incomplete"), New: []byte("definition")}},
+	}
+	if err := testutil.DeepEqual(expected, d); err != nil {
+		t.Error(err)
+	}
+	if d.IsEmpty() {
+		t.Error("Expected non-empty diff")
+	}
+	expectedStr := strings.Join([]string{
+		`+/kythe/text: "text"`,
+		`-/kythe/subkind: "class"`,
+		`~/kythe/complete: "incomplete" -> "definition"`,
+	}, "\n")
+	if d.String() != expectedStr {
+		t.Errorf("Expected:\n%s\nFound:\n%s", expectedStr, d)
+	}
+}
+
+func TestMergeNodes(t *testing.T) {
+	f := func(name, value string) *cpb.Fact { return &cpb.Fact{Name: name, Value: []byte(value)} }
+
+	a := &srvpb.Node{Ticket: "kythe:#node", Fact: []*cpb.Fact{f(facts.NodeKind, "record"), f(facts.Subkind, "class")}}
+	b := &srvpb.Node{Ticket: "kythe:#node", Fact: []*cpb.Fact{f(facts.Complete, "definition"), f(facts.NodeKind, "record")}}
+	merged, err := MergeNodes(a, b)
+	testutil.FatalOnErrT(t, "MergeNodes error: %v", err)
+	expected := &srvpb.Node{
+		Ticket: "kythe:#node",
+		Fact:   []*cpb.Fact{f(facts.Complete, "definition"), f(facts.NodeKind, "record"), f(facts.Subkind, "class")},
+	}
+	if !proto.Equal(expected, merged) {
+		t.Errorf("Expected %v; found %v", expected, merged)
+	}
+
+	empty := &srvpb.Node{Ticket: "kythe:#node"}
+	if merged, err := MergeNodes(empty, empty); err != nil || len(merged.Fact) != 0 {
+		t.Errorf("Expected empty node; found %v, %v", merged, err)
+	}
+	if merged, err := MergeNodes(empty, a); err != nil || !proto.Equal(merged, a) {
+		t.Errorf("Expected %v; found %v, %v", a, merged, err)
+	}
+
+	conflicting := &srvpb.Node{Ticket: "kythe:#node", Fact: []*cpb.Fact{f(facts.Subkind, "struct"), f(facts.NodeKind, "function")}}
+	if merged, err := MergeNodes(a, conflicting); err == nil {
+		t.Errorf("Expected conflict error; found %v", merged)
+	} else if !strings.Contains(err.Error(), facts.NodeKind) || !strings.Contains(err.Error(), facts.Subkind) {
+		t.Errorf("Expected error to list conflicting facts; found %v", err)
+	}
+
+	if merged, err := MergeNodes(a, &srvpb.Node{Ticket: "kythe:#other"}); err == nil {
+		t.Errorf("Expected ticket mismatch error; found %v", merged)
+	}
+}
+
+func TestNodeText(t *testing.T) {
+	src := &ipb.Source{
+		Ticket: "kythe://corpus?path=file",
+		Facts: map[string][]byte{
+			facts.NodeKind:     []byte(nodes.File),
+			facts.Text:         []byte("some text"),
+			facts.TextEncoding: []byte("latin1"),
+		},
+	}
+	text, encoding := NodeText(Node(src))
+	if string(text) != "some text" || encoding != "latin1" {
+		t.Errorf("Expected (%q, %q); found (%q, %q)", "some text", "latin1", text, encoding)
+	}
+
+	text, encoding = NodeText(Node(&ipb.Source{
+		Ticket: "kythe:#anchor",
+		Facts:  map[string][]byte{facts.NodeKind: []byte(nodes.Anchor)},
+	}))
+	if text != nil || encoding != "" {
+		t.Errorf("Expected no text or encoding; found (%q, %q)", text, encoding)
+	}
+}
+
+func TestFactValueInt(t *testing.T) {
+	src := &ipb.Source{
+		Ticket: "kythe:#anchor",
+		Facts: map[string][]byte{
+			facts.AnchorStart: []byte("42"),
+			facts.AnchorEnd:   []byte("not a number"),
+			facts.SnippetEnd:  []byte("4294967296"),
+		},
+	}
+
+	if n, err := FactValueInt32(src, facts.AnchorStart); err != nil || n != 42 {
+		t.Errorf("FactValueInt32(%q): expected 42; found %d, %v", facts.AnchorStart, n, err)
+	}
+	if n, err := FactValueInt64(src, facts.SnippetEnd); err != nil || n != 1<<32 {
+		t.Errorf("FactValueInt64(%q): expected %d; found %d, %v", facts.SnippetEnd, int64(1<<32), n, err)
+	}
+	for _, name := range []string{facts.AnchorEnd, facts.SnippetStart, facts.SnippetEnd} {
+		if n, err := FactValueInt32(src, name); err == nil {
+			t.Errorf("FactValueInt32(%q): expected error; found %d", name, n)
+		} else if !strings.Contains(err.Error(), name) {
+			t.Errorf("FactValueInt32(%q): error does not name the fact: %v", name, err)
+		}
+	}
+	if _, err := FactValueInt64(src, facts.AnchorEnd); err == nil || !strings.Contains(err.Error(), "not a number") {
+		t.Errorf("FactValueInt64(%q): expected error with raw value; found %v", facts.AnchorEnd, err)
+	}
+}
+
+func TestGroupDecorationsByKind(t *testing.T) {
+	decor := func(start int32, kind string) *srvpb.FileDecorations_Decoration {
+		return &srvpb.FileDecorations_Decoration{
+			Anchor: &srvpb.RawAnchor{StartOffset: start, EndOffset: start + 1},
+			Kind:   kind,
+			Target: "kythe:#target",
+		}
+	}
+	ds := []*srvpb.FileDecorations_Decoration{
+		decor(0, edges.Defines),
+		decor(1, edges.Ref),
+		decor(2, edges.Ref),
+		decor(3, edges.DefinesBinding),
+		decor(4, edges.Defines),
+	}
+
+	groups := GroupDecorationsByKind(ds)
+	expected := map[string][]*srvpb.FileDecorations_Decoration{
+		edges.Defines:        {ds[0], ds[4]},
+		edges.Ref:            {ds[1], ds[2]},
+		edges.DefinesBinding: {ds[3]},
+	}
+	if err := testutil.DeepEqual(expected, groups); err != nil {
+		t.Fatal(err)
+	}
+	if &groups[edges.Ref][0] != &ds[1] {
+		t.Errorf("Expected contiguous group to share the input's backing array")
+	}
+
+	if err := testutil.DeepEqual([]string{edges.Defines, edges.DefinesBinding, edges.Ref}, DecorationKinds(ds)); err != nil {
+		t.Error(err)
+	}
+	if kinds := DecorationKinds(nil); len(kinds) != 0 {
+		t.Errorf("Expected no kinds; found %v", kinds)
+	}
+}
+
+func TestDecorationsInRange(t *testing.T) {
+	decor := func(start, end int32) *srvpb.FileDecorations_Decoration {
+		return &srvpb.FileDecorations_Decoration{
+			Anchor: &srvpb.RawAnchor{StartOffset: start, EndOffset: end},
+			Kind:   edges.Ref,
+			Target: "kythe:#target",
+		}
+	}
+	ds := []*srvpb.FileDecorations_Decoration{
+		decor(0, 20), // spans most of the file
+		decor(2, 4),
+		decor(5, 8),
+		decor(8, 10),
+		decor(12, 12), // zero-length
+		decor(15, 30),
+	}
+	fd := &srvpb.FileDecorations{Decoration: ds}
+
+	tests := []struct {
+		start, end int32
+		expected   []*srvpb.FileDecorations_Decoration
+	}{
+		{6, 6, nil},     // empty range
+		{9, 5, nil},     // crossed range
+		{30, 40, nil},   // past every decoration
+		{3, 4, ds[0:2]}, // single nested decoration
+		{8, 9, []*srvpb.FileDecorations_Decoration{ds[0], ds[3]}},
+		{4, 5, ds[0:1]}, // between decorations
+		{7, 13, []*srvpb.FileDecorations_Decoration{ds[0], ds[2], ds[3], ds[4]}},
+		{19, 21, []*srvpb.FileDecorations_Decoration{ds[0], ds[5]}},
+		{20, 21, ds[5:6]}, // boundary: ds[0] ends at 20
+		{0, 15, ds[0:5]},  // boundary: ds[5] starts at 15
+	}
+
+	for _, test := range tests {
+		found := DecorationsInRange(fd, test.start, test.end)
+		if err := testutil.DeepEqual(test.expected, found); err != nil {
+			t.Errorf("DecorationsInRange(%d, %d): %v", test.start, test.end, err)
+		}
+	}
+
+	if found := DecorationsInRange(&srvpb.FileDecorations{}, 0, 10); len(found) != 0 {
+		t.Errorf("Expected no decorations; found %v", found)
+	}
+}
+
+func TestMergeDecorationFragments(t *testing.T) {
+	const ticket = "kythe://corpus?path=file"
+	file := &srvpb.File{Ticket: ticket, Text: []byte("some text")}
+	decor := func(start int32) *srvpb.FileDecorations_Decoration {
+		return &srvpb.FileDecorations_Decoration{
+			Anchor: &srvpb.RawAnchor{StartOffset: start, EndOffset: start + 1},
+			Kind:   edges.Ref,
+			Target: "kythe:#target",
+		}
+	}
+	target := &srvpb.Node{Ticket: "kythe:#target"}
+
+	merged, err := MergeDecorationFragments(ticket, []*srvpb.FileDecorations{
+		{Decoration: []*srvpb.FileDecorations_Decoration{decor(4)}, Target: []*srvpb.Node{target}},
+		{File: file},
+		{Decoration: []*srvpb.FileDecorations_Decoration{decor(2), decor(6)}, Target: []*srvpb.Node{target}},
+	})
+	testutil.FatalOnErrT(t, "MergeDecorationFragments error: %v", err)
+
+	expected := &srvpb.FileDecorations{
+		File:       file,
+		Decoration: []*srvpb.FileDecorations_Decoration{decor(2), decor(4), decor(6)},
+		Target:     []*srvpb.Node{target},
+	}
+	if !proto.Equal(expected, merged) {
+		t.Errorf("Expected %v; found %v", expected, merged)
+	}
+
+	for _, fragments := range [][]*srvpb.FileDecorations{
+		{{Decoration: []*srvpb.FileDecorations_Decoration{decor(0)}}}, // missing File
+		{{File: file}, {File: file}},                                  // multiple Files
+		{{File: &srvpb.File{Ticket: "kythe://corpus?path=other"}}},    // mismatched ticket
+	} {
+		if fd, err := MergeDecorationFragments(ticket, fragments); err == nil {
+			t.Errorf("MergeDecorationFragments(%v): expected error; found %v", fragments, fd)
+		}
+	}
+}
+
+func TestValidateFileDecorations(t *testing.T) {
+	file := &srvpb.File{Ticket: "kythe://corpus?path=file", Text: []byte("0123456789")}
+	decor := func(start, end int32, target string) *srvpb.FileDecorations_Decoration {
+		return &srvpb.FileDecorations_Decoration{
+			Anchor: &srvpb.RawAnchor{StartOffset: start, EndOffset: end},
+			Kind:   edges.Ref,
+			Target: target,
+		}
+	}
+
+	tests := []struct {
+		fd   *srvpb.FileDecorations
+		errs int
+	}{
+		{&srvpb.FileDecorations{}, 0},
+		{&srvpb.FileDecorations{File: file}, 0},
+		{&srvpb.FileDecorations{
+			File:       file,
+			Decoration: []*srvpb.FileDecorations_Decoration{decor(0, 2, "kythe:#a"), decor(2, 10, "kythe:#b")},
+		}, 0},
+		{&srvpb.FileDecorations{
+			Decoration: []*srvpb.FileDecorations_Decoration{decor(0, 2, "kythe:#a")},
+		}, 1}, // missing file
+		{&srvpb.FileDecorations{
+			File:       file,
+			Decoration: []*srvpb.FileDecorations_Decoration{decor(4, 6, "kythe:#a"), decor(0, 2, "kythe:#b")},
+		}, 1}, // out of order
+		{&srvpb.FileDecorations{
+			File:       file,
+			Decoration: []*srvpb.FileDecorations_Decoration{decor(0, 2, "kythe:#a"), decor(0, 2, "kythe:#a")},
+		}, 1}, // duplicate
+		{&srvpb.FileDecorations{
+			File:       file,
+			Decoration: []*srvpb.FileDecorations_Decoration{decor(0, 2, ""), decor(8, 11, "kythe:#b")},
+		}, 2}, // missing target; span past EOF
+		{&srvpb.FileDecorations{
+			File:       file,
+			Decoration: []*srvpb.FileDecorations_Decoration{{Kind: edges.Ref, Target: "kythe:#a"}},
+		}, 1}, // missing anchor
+	}
+
+	for i, test := range tests {
+		if errs := ValidateFileDecorations(test.fd); len(errs) != test.errs {
+			t.Errorf("ValidateFileDecorations(%d): expected %d errors; found %v", i, test.errs, errs)
+		}
+	}
+}
+
+func TestValidatePagedEdgeSet(t *testing.T) {
+	pes := &srvpb.PagedEdgeSet{
+		Source: &srvpb.Node{Ticket: "kythe://corpus#source"},
+		Group: []*srvpb.EdgeGroup{{
+			Kind: edges.ChildOf,
+			Edge: []*srvpb.EdgeGroup_Edge{{Target: &srvpb.Node{Ticket: "kythe://corpus#parent"}}},
+		}},
+		PageIndex: []*srvpb.PageIndex{
+			{EdgeKind: edges.Ref, EdgeCount: 4, PageKey: "page0"},
+			{EdgeKind: edges.Ref, EdgeCount: 2, PageKey: "page1"},
+		},
+		TotalEdges: 7,
+	}
+	if errs := ValidatePagedEdgeSet(pes); len(errs) != 0 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	pes.TotalEdges = 8
+	if errs := ValidatePagedEdgeSet(pes); len(errs) != 1 || !strings.Contains(errs[0].Error(), "TotalEdges") {
+		t.Errorf("Expected TotalEdges mismatch; found %v", errs)
+	}
+
+	bad := &srvpb.PagedEdgeSet{
+		Group: []*srvpb.EdgeGroup{{Kind: edges.Ref}},
+		PageIndex: []*srvpb.PageIndex{
+			{EdgeKind: edges.Ref, EdgeCount: 1, PageKey: "page0"},
+			{EdgeCount: 1, PageKey: "page0"},
+		},
+		TotalEdges: 2,
+	}
+	// missing source; empty group; missing edge kind; duplicate page key
+	if errs := ValidatePagedEdgeSet(bad); len(errs) != 4 {
+		t.Errorf("Expected 4 errors; found %v", errs)
+	}
+}
+
+func TestValidatePagedCrossReferences(t *testing.T) {
+	xs := &srvpb.PagedCrossReferences{
+		SourceTicket: "kythe://corpus#source",
+		Group: []*srvpb.PagedCrossReferences_Group{{
+			Kind:   edges.Ref,
+			Anchor: []*srvpb.ExpandedAnchor{{Ticket: "kythe://corpus#a1"}, {Ticket: "kythe://corpus#a2"}},
+		}},
+		PageIndex: []*srvpb.PagedCrossReferences_PageIndex{
+			{Kind: edges.Ref, Count: 3, PageKey: "page0"},
+		},
+		TotalReferences: 5,
+	}
+	if errs := ValidatePagedCrossReferences(xs); len(errs) != 0 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	xs.TotalReferences = 4
+	if errs := ValidatePagedCrossReferences(xs); len(errs) != 1 || !strings.Contains(errs[0].Error(), "TotalReferences") {
+		t.Errorf("Expected TotalReferences mismatch; found %v", errs)
+	}
+
+	bad := &srvpb.PagedCrossReferences{
+		Group: []*srvpb.PagedCrossReferences_Group{{}},
+		PageIndex: []*srvpb.PagedCrossReferences_PageIndex{
+			{Kind: edges.Ref, Count: 1, PageKey: "page0"},
+			{Kind: edges.Ref, Count: 1, PageKey: "page0"},
+		},
+		TotalReferences: 2,
+	}
+	// missing source ticket; group missing kind; duplicate page key
+	if errs := ValidatePagedCrossReferences(bad); len(errs) != 3 {
+		t.Errorf("Expected 3 errors; found %v", errs)
+	}
+}
+
+func TestFlattenPagedEdgeSet(t *testing.T) {
+	group := func(kind string, targets ...string) *srvpb.EdgeGroup {
+		g := &srvpb.EdgeGroup{Kind: kind}
+		for _, target := range targets {
+			g.Edge = append(g.Edge, &srvpb.EdgeGroup_Edge{Target: &srvpb.Node{Ticket: target}})
+		}
+		return g
+	}
+	pages := map[string]*srvpb.EdgePage{
+		"page0": {PageKey: "page0", EdgesGroup: group(edges.Ref, "kythe:#r1", "kythe:#r2")},
+		"page1": {PageKey: "page1", EdgesGroup: group(edges.Defines, "kythe:#d2")},
+	}
+	loader := func(key string) (*srvpb.EdgePage, error) {
+		pg, ok := pages[key]
+		if !ok {
+			return nil, fmt.Errorf("no such page: %q", key)
+		}
+		return pg, nil
+	}
+
+	pes := &srvpb.PagedEdgeSet{
+		Source: &srvpb.Node{Ticket: "kythe:#source"},
+		Group: []*srvpb.EdgeGroup{
+			group(edges.ChildOf, "kythe:#parent"),
+			group(edges.Defines, "kythe:#d1"),
+		},
+		PageIndex: []*srvpb.PageIndex{
+			{EdgeKind: edges.Ref, EdgeCount: 2, PageKey: "page0"},
+			{EdgeKind: edges.Defines, EdgeCount: 1, PageKey: "page1"},
+		},
+		TotalEdges: 5,
+	}
+
+	found, err := FlattenPagedEdgeSet(pes, loader)
+	testutil.FatalOnErrT(t, "FlattenPagedEdgeSet error: %v", err)
+	expected := []*srvpb.EdgeGroup{
+		group(edges.Defines, "kythe:#d1"),
+		group(edges.Defines, "kythe:#d2"),
+		group(edges.Ref, "kythe:#r1", "kythe:#r2"),
+		group(edges.ChildOf, "kythe:#parent"),
+	}
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Error(err)
+	}
+
+	pes.PageIndex = append(pes.PageIndex, &srvpb.PageIndex{EdgeKind: edges.Ref, EdgeCount: 1, PageKey: "missing"})
+	if groups, err := FlattenPagedEdgeSet(pes, loader); err == nil {
+		t.Errorf("Expected error for missing page; found %v", groups)
+	}
+}
+
+func TestFlattenPagedCrossReferences(t *testing.T) {
+	group := func(kind string, anchors ...string) *srvpb.PagedCrossReferences_Group {
+		g := &srvpb.PagedCrossReferences_Group{Kind: kind}
+		for _, a := range anchors {
+			g.Anchor = append(g.Anchor, &srvpb.ExpandedAnchor{Ticket: a})
+		}
+		return g
+	}
+	pages := map[string]*srvpb.PagedCrossReferences_Page{
+		"page0": {PageKey: "page0", Group: group(edges.Ref, "kythe:#r1", "kythe:#r2")},
+		"page1": {PageKey: "page1", Group: group(edges.Defines, "kythe:#d2")},
+	}
+	loader := func(key string) (*srvpb.PagedCrossReferences_Page, error) {
+		pg, ok := pages[key]
+		if !ok {
+			return nil, fmt.Errorf("no such page: %q", key)
+		}
+		return pg, nil
+	}
+
+	xs := &srvpb.PagedCrossReferences{
+		SourceTicket: "kythe:#source",
+		Group: []*srvpb.PagedCrossReferences_Group{
+			group(edges.Ref, "kythe:#r0"),
+			group(edges.Defines, "kythe:#d1"),
+		},
+		PageIndex: []*srvpb.PagedCrossReferences_PageIndex{
+			{Kind: edges.Ref, Count: 2, PageKey: "page0"},
+			{Kind: edges.Defines, Count: 1, PageKey: "page1"},
+		},
+		TotalReferences: 5,
+	}
+
+	found, err := FlattenPagedCrossReferences(xs, loader)
+	testutil.FatalOnErrT(t, "FlattenPagedCrossReferences error: %v", err)
+	expected := []*srvpb.PagedCrossReferences_Group{
+		group(edges.Defines, "kythe:#d1"),
+		group(edges.Defines, "kythe:#d2"),
+		group(edges.Ref, "kythe:#r0"),
+		group(edges.Ref, "kythe:#r1", "kythe:#r2"),
+	}
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Error(err)
+	}
+
+	xs.PageIndex = append(xs.PageIndex, &srvpb.PagedCrossReferences_PageIndex{Kind: edges.Ref, Count: 1, PageKey: "missing"})
+	if groups, err := FlattenPagedCrossReferences(xs, loader); err == nil {
+		t.Errorf("Expected error for missing page; found %v", groups)
+	}
+}
+
+func TestSplitLargeFileDecorations(t *testing.T) {
+	const ticket = "kythe://corpus?path=file"
+	fd := &srvpb.FileDecorations{
+		File:   &srvpb.File{Ticket: ticket, Text: []byte(strings.Repeat("x", 200))},
+		Target: []*srvpb.Node{{Ticket: "kythe:#target"}},
+	}
+	for i := int32(0); i < 50; i++ {
+		fd.Decoration = append(fd.Decoration, &srvpb.FileDecorations_Decoration{
+			Anchor: &srvpb.RawAnchor{Ticket: fmt.Sprintf("kythe:#anchor%d", i), StartOffset: i, EndOffset: i + 1},
+			Kind:   edges.Ref,
+			Target: "kythe:#target",
+		})
+	}
+
+	if chunks := SplitLargeFileDecorations(fd, int64(proto.Size(fd))); len(chunks) != 1 || chunks[0] != fd {
+		t.Errorf("Expected FileDecorations to be returned unsplit; found %v", chunks)
+	}
+
+	const max = 512
+	chunks := SplitLargeFileDecorations(fd, max)
+	if len(chunks) < 2 {
+		t.Fatalf("Expected multiple chunks; found %d", len(chunks))
+	}
+	var decor []*srvpb.FileDecorations_Decoration
+	for i, c := range chunks {
+		if size := proto.Size(c); size > max {
+			t.Errorf("Chunk %d is too large: %d bytes", i, size)
+		}
+		if (i == 0) != (c.File != nil) {
+			t.Errorf("Chunk %d: unexpected File: %v", i, c.File)
+		}
+		decor = append(decor, c.Decoration...)
+	}
+	if err := testutil.DeepEqual(fd.Decoration, decor); err != nil {
+		t.Errorf("Decorations not preserved: %v", err)
+	}
+
+	merged, err := MergeDecorationFragments(ticket, chunks)
+	testutil.FatalOnErrT(t, "MergeDecorationFragments error: %v", err)
+	if !proto.Equal(fd, merged) {
+		t.Errorf("Expected merged chunks to equal original; found %v", merged)
+	}
+}
+
+func TestIsNodeSelfEdge(t *testing.T) {
+	es := PartialReverseEdges(&ipb.Source{
+		Ticket: "kythe:#source",
+		EdgeGroups: map[string]*ipb.Source_EdgeGroup{
+			edges.ChildOf: {Edges: []*ipb.Source_Edge{{Ticket: "kythe:#parent"}}},
+		},
+	})
+	if len(es) != 2 {
+		t.Fatalf("Expected 2 edges; found %v", es)
+	}
+	if !IsNodeSelfEdge(es[0]) || IsNodeEdge(es[0]) {
+		t.Errorf("Expected self-edge: %v", es[0])
+	}
+	if IsNodeSelfEdge(es[1]) || !IsNodeEdge(es[1]) {
+		t.Errorf("Unexpected self-edge: %v", es[1])
+	}
+}
+
+func servingEdge(src, kind string, ordinal int32, tgt string) *srvpb.Edge {
+	return &srvpb.Edge{
+		Source:  &srvpb.Node{Ticket: src},
+		Kind:    kind,
+		Ordinal: ordinal,
+		Target:  &srvpb.Node{Ticket: tgt},
+	}
+}
+
+func TestMergeEdges(t *testing.T) {
+	dup := servingEdge("kythe:#s1", edges.ChildOf, 0, "kythe:#t1")
+	a := []*srvpb.Edge{
+		{Source: &srvpb.Node{Ticket: "kythe:#s1"}},
+		dup,
+		servingEdge("kythe:#s2", edges.Param, 1, "kythe:#t1"),
+	}
+	b := []*srvpb.Edge{
+		servingEdge("kythe:#s1", edges.ChildOf, 0, "kythe:#t1"),
+		servingEdge("kythe:#s1", edges.ChildOf, 0, "kythe:#t2"),
+		servingEdge("kythe:#s2", edges.Param, 0, "kythe:#t3"),
+		servingEdge("kythe:#s3", edges.ChildOf, 0, "kythe:#t1"),
+	}
+
+	expected := []*srvpb.Edge{a[0], a[1], b[1], b[2], a[2], b[3]}
+	found := MergeEdges(a, b)
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Fatal(err)
+	}
+	if found[1] != dup {
+		t.Error("Expected duplicate edge to be taken from the first slice")
+	}
+}
+
+func BenchmarkMergeEdges(b *testing.B) {
+	const n = 10000
+	x, y := make([]*srvpb.Edge, n), make([]*srvpb.Edge, n)
+	for i := 0; i < n; i++ {
+		x[i] = servingEdge(fmt.Sprintf("kythe:#%.6d", 2*i), edges.ChildOf, 0, "kythe:#target")
+		y[i] = servingEdge(fmt.Sprintf("kythe:#%.6d", 2*i+1), edges.ChildOf, 0, "kythe:#target")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		MergeEdges(x, y)
+	}
+}
+
+func TestEdgeGroupDeduplicate(t *testing.T) {
+	eg := &srvpb.EdgeGroup{
+		Kind: edges.Param,
+		Edge: getEdgeTargets("kythe:#p0", "kythe:#p1", "kythe:#p0"),
+	}
+	eg.Edge = append(eg.Edge, &srvpb.EdgeGroup_Edge{Target: getNode("kythe:#p0"), Ordinal: 1})
+
+	deduped, removed := EdgeGroupDeduplicate(eg)
+	if removed != 1 {
+		t.Errorf("Expected 1 edge removed; found %d", removed)
+	}
+	expected := &srvpb.EdgeGroup{
+		Kind: edges.Param,
+		Edge: []*srvpb.EdgeGroup_Edge{eg.Edge[0], eg.Edge[1], eg.Edge[3]},
+	}
+	if !proto.Equal(expected, deduped) {
+		t.Errorf("Expected %v; found %v", expected, deduped)
+	}
+	if len(eg.Edge) != 4 {
+		t.Errorf("EdgeGroupDeduplicate modified its input: %v", eg)
+	}
+
+	for _, eg := range []*srvpb.EdgeGroup{{
+		Kind: edges.Param,
+		Edge: getEdgeTargets("kythe:#p0", "kythe:#p1", "kythe:#p2"), // sorted
+	}, {
+		Kind: edges.Param,
+		Edge: getEdgeTargets("kythe:#p2", "kythe:#p0", "kythe:#p1"), // unsorted
+	}} {
+		if deduped, removed := EdgeGroupDeduplicate(eg); removed != 0 || deduped != eg {
+			t.Errorf("EdgeGroupDeduplicate(%v): expected input returned unchanged; found %v, %d", eg, deduped, removed)
+		}
+	}
+
+	sorted := &srvpb.EdgeGroup{
+		Kind: edges.Param,
+		Edge: getEdgeTargets("kythe:#p0", "kythe:#p0", "kythe:#p1"),
+	}
+	if deduped, removed := EdgeGroupDeduplicate(sorted); removed != 1 || len(deduped.Edge) != 2 {
+		t.Errorf("Expected 1 adjacent duplicate removed; found %v, %d", deduped, removed)
+	}
+}
+
+func BenchmarkEdgeSetBuilderAddGroup(b *testing.B) {
+	const n = 100
+	edgs := make([]*srvpb.EdgeGroup_Edge, 10)
+	for i := range edgs {
+		edgs[i] = &srvpb.EdgeGroup_Edge{
+			Target:  getNode(fmt.Sprintf("kythe:#p%d", i)),
+			Ordinal: int32(i),
+		}
+	}
+	esb := &EdgeSetBuilder{
+		Output:     func(context.Context, *srvpb.PagedEdgeSet) error { return nil },
+		OutputPage: func(context.Context, *srvpb.EdgePage) error { return nil },
+	}
+	src := getNode("kythe:#src")
+	groups := make([]*srvpb.EdgeGroup, n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// The pager combines groups in place, so each iteration needs fresh ones.
+		b.StopTimer()
+		for j := range groups {
+			groups[j] = &srvpb.EdgeGroup{
+				Kind: edges.Param,
+				Edge: append([]*srvpb.EdgeGroup_Edge(nil), edgs...),
+			}
+		}
+		b.StartTimer()
+
+		if err := esb.StartEdgeSet(ctx, src); err != nil {
+			b.Fatal(err)
+		}
+		for _, g := range groups {
+			if err := esb.AddGroup(ctx, g); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestEdgeSetForKind(t *testing.T) {
+	childOf := &srvpb.EdgeGroup{
+		Kind: edges.ChildOf,
+		Edge: getEdgeTargets("kythe:#parent"),
+	}
+	pes := &srvpb.PagedEdgeSet{
+		Source: getNode("kythe:#someSource"),
+		Group:  []*srvpb.EdgeGroup{childOf},
+		PageIndex: []*srvpb.PageIndex{{
+			EdgeKind:  edges.Param,
+			EdgeCount: 3,
+			PageKey:   "kythe:#someSource.0000000000",
+		}},
+	}
+
+	tests := []struct {
+		kind  string
+		group *srvpb.EdgeGroup
+		paged bool
+	}{
+		{edges.ChildOf, childOf, false},
+		{edges.Param, nil, true},
+		{edges.Typed, nil, false},
+	}
+	for _, test := range tests {
+		group, paged := EdgeSetForKind(pes, test.kind)
+		if group != test.group || paged != test.paged {
+			t.Errorf("EdgeSetForKind(%q): expected (%v, %v); found (%v, %v)", test.kind, test.group, test.paged, group, paged)
+		}
+		if found, expected := EdgeSetHasKind(pes, test.kind), test.group != nil || test.paged; found != expected {
+			t.Errorf("EdgeSetHasKind(%q): expected %v; found %v", test.kind, expected, found)
+		}
+	}
+}
+
+func TestPageIndexToMap(t *testing.T) {
+	p0 := &srvpb.PageIndex{EdgeKind: edges.Param, EdgeCount: 2, PageKey: "kythe:#src.0000000000"}
+	p1 := &srvpb.PageIndex{EdgeKind: edges.ChildOf, EdgeCount: 1, PageKey: "kythe:#src.0000000001"}
+	p2 := &srvpb.PageIndex{EdgeKind: edges.Param, EdgeCount: 2, PageKey: "kythe:#src.0000000002"}
+	pes := &srvpb.PagedEdgeSet{PageIndex: []*srvpb.PageIndex{p0, p1, p2}}
+	expected := map[string][]*srvpb.PageIndex{
+		edges.Param:   {p0, p2},
+		edges.ChildOf: {p1},
+	}
+	if err := testutil.DeepEqual(expected, PageIndexToMap(pes)); err != nil {
+		t.Error(err)
+	}
+	if m := PageIndexToMap(nil); m == nil || len(m) != 0 {
+		t.Errorf("PageIndexToMap(nil): expected empty map; found %v", m)
+	}
+
+	x0 := &srvpb.PagedCrossReferences_PageIndex{Kind: edges.Ref, Count: 3, PageKey: "kythe:#src.0000000000"}
+	x1 := &srvpb.PagedCrossReferences_PageIndex{Kind: edges.Defines, Count: 1, PageKey: "kythe:#src.0000000001"}
+	x2 := &srvpb.PagedCrossReferences_PageIndex{Kind: edges.Ref, Count: 3, PageKey: "kythe:#src.0000000002"}
+	xs := &srvpb.PagedCrossReferences{PageIndex: []*srvpb.PagedCrossReferences_PageIndex{x0, x1, x2}}
+	expectedRefs := map[string][]*srvpb.PagedCrossReferences_PageIndex{
+		edges.Ref:     {x0, x2},
+		edges.Defines: {x1},
+	}
+	if err := testutil.DeepEqual(expectedRefs, CrossRefPageIndexToMap(xs)); err != nil {
+		t.Error(err)
+	}
+	if m := CrossRefPageIndexToMap(nil); m == nil || len(m) != 0 {
+		t.Errorf("CrossRefPageIndexToMap(nil): expected empty map; found %v", m)
+	}
+}
+
+func TestCheckpointableEdgeSetBuilder(t *testing.T) {
+	build := func(prev io.Reader, checkpoint io.Writer, srcs ...string) (*testESB, *CheckpointableEdgeSetBuilder) {
+		tESB := newTestESB(&EdgeSetBuilder{MaxEdgePageSize: 1})
+		b, err := NewCheckpointableEdgeSetBuilder(tESB.EdgeSetBuilder, prev, checkpoint)
+		testutil.FatalOnErrT(t, "Error creating builder: %v", err)
+		for _, src := range srcs {
+			testutil.FatalOnErrT(t, "Failure to StartEdgeSet: %v", b.StartEdgeSet(ctx, getNode(src)))
+			if found := b.CurrentSource(); found != src {
+				t.Errorf("CurrentSource: expected %q; found %q", src, found)
+			}
+			testutil.FatalOnErrT(t, "Failure to AddGroup: %v", b.AddGroup(ctx, &srvpb.EdgeGroup{
+				Kind: edges.Param,
+				Edge: getEdgeTargets("kythe:#p0", "kythe:#p1"),
+			}))
+		}
+		testutil.FatalOnErrT(t, "Failure to Flush: %v", b.Flush(ctx))
+		return tESB, b
+	}
+
+	var checkpoint bytes.Buffer
+	first, _ := build(nil, &checkpoint, "kythe:#a", "kythe:#b")
+	if len(first.PagedEdgeSets) != 2 || len(first.EdgePages) != 2 {
+		t.Fatalf("Expected 2 PagedEdgeSets and 2 EdgePages; found %d and %d", len(first.PagedEdgeSets), len(first.EdgePages))
+	}
+
+	prev := checkpoint.String()
+	checkpoint.Reset()
+	second, b := build(strings.NewReader(prev), &checkpoint, "kythe:#a", "kythe:#b", "kythe:#c")
+	if len(second.PagedEdgeSets) != 1 || second.PagedEdgeSets[0].Source.Ticket != "kythe:#c" {
+		t.Errorf("Expected only a PagedEdgeSet for kythe:#c; found %v", second.PagedEdgeSets)
+	}
+	if b.Skipped() != 2 {
+		t.Errorf("Expected 2 skipped sources; found %d", b.Skipped())
+	}
+	if err := testutil.DeepEqual([]string{first.EdgePages[0].PageKey, first.EdgePages[1].PageKey}, b.PageKeys()); err != nil {
+		t.Error(err)
+	}
+	if expected := prev + fmt.Sprintf("page %s\nset kythe:#c\n", second.EdgePages[0].PageKey); checkpoint.String() != expected {
+		t.Errorf("Expected checkpoint %q; found %q", expected, checkpoint.String())
+	}
+
+	// A second interruption, checkpointed to a fresh writer, keeps the work of
+	// both previous runs.
+	prev = checkpoint.String()
+	checkpoint.Reset()
+	third, b := build(strings.NewReader(prev), &checkpoint, "kythe:#a", "kythe:#b", "kythe:#c", "kythe:#d")
+	if len(third.PagedEdgeSets) != 1 || third.PagedEdgeSets[0].Source.Ticket != "kythe:#d" {
+		t.Errorf("Expected only a PagedEdgeSet for kythe:#d; found %v", third.PagedEdgeSets)
+	}
+	if b.Skipped() != 3 {
+		t.Errorf("Expected 3 skipped sources; found %d", b.Skipped())
+	}
+	if len(b.PageKeys()) != 3 {
+		t.Errorf("Expected 3 previous page keys; found %v", b.PageKeys())
+	}
+
+	// Records are written as each set is emitted, before the final Flush.
+	checkpoint.Reset()
+	tESB := newTestESB(&EdgeSetBuilder{MaxEdgePageSize: 1})
+	b, err := NewCheckpointableEdgeSetBuilder(tESB.EdgeSetBuilder, nil, &checkpoint)
+	testutil.FatalOnErrT(t, "Error creating builder: %v", err)
+	testutil.FatalOnErrT(t, "Failure to StartEdgeSet: %v", b.StartEdgeSet(ctx, getNode("kythe:#a")))
+	testutil.FatalOnErrT(t, "Failure to AddGroup: %v", b.AddGroup(ctx, &srvpb.EdgeGroup{Kind: edges.Param, Edge: getEdgeTargets("kythe:#p0")}))
+	testutil.FatalOnErrT(t, "Failure to StartEdgeSet: %v", b.StartEdgeSet(ctx, getNode("kythe:#b")))
+	if expected := "set kythe:#a\n"; checkpoint.String() != expected {
+		t.Errorf("Expected checkpoint %q before Flush; found %q", expected, checkpoint.String())
+	}
+
+	if _, err := NewCheckpointableEdgeSetBuilder(new(EdgeSetBuilder), strings.NewReader("bad record\n"), ioutil.Discard); err == nil {
+		t.Error("Expected error for invalid checkpoint")
+	}
+}
+
+func TestEdgeCountByKind(t *testing.T) {
+	tESB := newTestESB(&EdgeSetBuilder{MaxEdgePageSize: 2})
+
+	testutil.FatalOnErrT(t, "Failure to StartEdgeSet: %v",
+		tESB.StartEdgeSet(ctx, getNode("someSource")))
+	for _, eg := range []*srvpb.EdgeGroup{{
+		Kind: edges.ChildOf,
+		Edge: getEdgeTargets("kythe:#parent"),
+	}, {
+		Kind: edges.Param,
+		Edge: getEdgeTargets("kythe:#p0", "kythe:#p1", "kythe:#p2"),
+	}} {
+		testutil.FatalOnErrT(t, "Failure to AddGroup: %v", tESB.AddGroup(ctx, eg))
+	}
+	testutil.FatalOnErrT(t, "Failure to Flush: %v", tESB.Flush(ctx))
+
+	if len(tESB.PagedEdgeSets) != 1 {
+		t.Fatalf("Found %d PagedEdgeSets; expected 1", len(tESB.PagedEdgeSets))
+	}
+	pes := tESB.PagedEdgeSets[0]
+	if len(pes.PageIndex) == 0 {
+		t.Fatalf("Expected PagedEdgeSet with pages: %v", pes)
+	}
+
+	counts := EdgeCountByKind(pes)
+	expected := map[string]int{edges.ChildOf: 1, edges.Param: 3}
+	if err := testutil.DeepEqual(expected, counts); err != nil {
+		t.Error(err)
+	}
+	var total int
+	for _, n := range counts {
+		total += n
+	}
+	if total != int(pes.TotalEdges) {
+		t.Errorf("Sum of counts %d does not match TotalEdges %d", total, pes.TotalEdges)
+	}
+}
+
+func BenchmarkExpandAnchor(b *testing.B) {
+	const anchors = 1000
+	file := &srvpb.File{Text: []byte(strings.Repeat("some line of text\n", anchors))}
+	norm := xrefs.NewNormalizer(file.Text)
+	raw := make([]*srvpb.RawAnchor, anchors)
+	for i := range raw {
+		start := int32(i*18 + 5)
+		raw[i] = &srvpb.RawAnchor{StartOffset: start, EndOffset: start + 4}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, a := range raw {
+			if _, err := ExpandAnchor(a, file, norm, edges.Ref); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkAnchorText(b *testing.B) {
+	const anchors = 1000
+	file := &srvpb.File{Text: []byte(strings.Repeat("some line of text\n", anchors))}
+	raw := make([]*srvpb.RawAnchor, anchors)
+	for i := range raw {
+		start := int32(i*18 + 5)
+		raw[i] = &srvpb.RawAnchor{StartOffset: start, EndOffset: start + 4}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, a := range raw {
+			if _, err := AnchorText(a, file); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
 }
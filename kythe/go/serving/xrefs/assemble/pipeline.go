@@ -0,0 +1,439 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package assemble
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/services/xrefs"
+	"kythe.io/kythe/go/util/schema/edges"
+
+	ipb "kythe.io/kythe/proto/internal_proto"
+	srvpb "kythe.io/kythe/proto/serving_proto"
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Pipeline assembles the serving tables for a stream of GraphStore entries by
+// wiring together BuildNodeIndex, an EdgeSetBuilder, a
+// DecorationFragmentBuilder, and a CrossReferencesBuilder.  Every intermediate
+// result is kept in memory, so a Pipeline is only suitable for graphs that fit
+// in memory; see the kythe.io/kythe/go/serving/pipeline package for larger
+// graphs.
+//
+// Each output function is optional; if nil, its stage is skipped.  When
+// Workers > 1, the edge set, decoration, and cross-reference output functions
+// may be called concurrently with themselves and each other.  Otherwise, the
+// stages run one after another and no two output functions are ever called
+// concurrently.
+type Pipeline struct {
+	NodeOutput func(context.Context, *srvpb.Node) error
+
+	EdgeOutput     func(context.Context, *srvpb.PagedEdgeSet) error
+	EdgePageOutput func(context.Context, *srvpb.EdgePage) error
+
+	DecorationOutput func(context.Context, *srvpb.FileDecorations) error
+
+	CrossRefOutput     func(context.Context, *srvpb.PagedCrossReferences) error
+	CrossRefPageOutput func(context.Context, *srvpb.PagedCrossReferences_Page) error
+
+	// MaxPageSize is passed to each EdgeSetBuilder and CrossReferencesBuilder.
+	MaxPageSize int
+
+	// Workers is the number of builders run in parallel for the edge set and
+	// cross-reference stages.  Sources are sharded between builders using
+	// ShardBy.  If Workers <= 0, a single builder is used.
+	Workers int
+}
+
+// Run reads each entry (in GraphStore order) from entries and writes the
+// resulting serving data to p's outputs.  Run returns once entries is closed
+// and every stage has finished or after the first error is encountered.  In
+// either case, entries is always drained.
+func (p *Pipeline) Run(ctx context.Context, entries <-chan *spb.Entry) error {
+	srcs := make(chan *ipb.Source)
+	var (
+		nodeErr error
+		wg      sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		nodeErr = BuildNodeIndex(ctx, srcs, p.nodeOutput)
+		for range srcs { // drain input channel
+		}
+	}()
+
+	var partial []*srvpb.Edge
+	var group []*spb.Entry
+	addSource := func() {
+		if len(group) == 0 {
+			return
+		}
+		src := SourceFromEntries(group)
+		srcs <- src
+		partial = append(partial, PartialReverseEdges(src)...)
+		group = nil
+	}
+	for e := range entries {
+		if graphstore.IsEdge(e) && !edges.IsForward(e.EdgeKind) {
+			continue
+		}
+		if len(group) > 0 && !compare.VNamesEqual(group[0].Source, e.Source) {
+			addSource()
+		}
+		group = append(group, e)
+	}
+	addSource()
+	close(srcs)
+	wg.Wait()
+	if nodeErr != nil {
+		return fmt.Errorf("error writing nodes: %v", nodeErr)
+	}
+
+	completed := completeEdges(partial)
+	partial = nil
+
+	var (
+		edgeErr, decorErr error
+		refs              []*ipb.CrossReference
+	)
+	edgeStage := func() {
+		shards := shardEdges(completed, p.workers())
+		edgeErr = p.parallel(len(shards), func(i int) error {
+			return p.buildEdgeSets(ctx, shards[i])
+		})
+	}
+	decorStage := func() { refs, decorErr = p.buildDecorations(ctx, completed) }
+	if p.workers() > 1 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			edgeStage()
+		}()
+		go func() {
+			defer wg.Done()
+			decorStage()
+		}()
+		wg.Wait()
+	} else {
+		edgeStage()
+		decorStage()
+	}
+	if edgeErr != nil {
+		return fmt.Errorf("error writing paged edge sets: %v", edgeErr)
+	} else if decorErr != nil {
+		return fmt.Errorf("error writing file decorations: %v", decorErr)
+	}
+
+	if p.CrossRefOutput == nil {
+		return nil
+	}
+	sort.Sort(byReferent(refs))
+	shards := make([][]*ipb.CrossReference, p.workers())
+	for _, cr := range refs {
+		i := ShardBy(cr.Referent.Ticket, len(shards))
+		shards[i] = append(shards[i], cr)
+	}
+	if err := p.parallel(len(shards), func(i int) error {
+		return p.buildCrossReferences(ctx, shards[i])
+	}); err != nil {
+		return fmt.Errorf("error writing cross-references: %v", err)
+	}
+	return nil
+}
+
+func (p *Pipeline) workers() int {
+	if p.Workers <= 0 {
+		return 1
+	}
+	return p.Workers
+}
+
+func (p *Pipeline) nodeOutput(ctx context.Context, n *srvpb.Node) error {
+	if p.NodeOutput == nil {
+		return nil
+	}
+	return p.NodeOutput(ctx, n)
+}
+
+// parallel calls f for each index in [0, n) concurrently, returning the first
+// non-nil error (by index).
+func (p *Pipeline) parallel(n int, f func(i int) error) error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f(i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completeEdges returns the complete set of edges (and their mirrors) for the
+// given partial reverse edges (see PartialReverseEdges).  The result is sorted
+// in the order expected by EdgeSetBuilder and DecorationFragmentBuilder.
+func completeEdges(partial []*srvpb.Edge) []*srvpb.Edge {
+	sort.Sort(byEdgeOrder(partial))
+
+	var (
+		completed []*srvpb.Edge
+		n         *srvpb.Node
+	)
+	for _, e := range partial {
+		if n == nil || n.Ticket != e.Source.Ticket {
+			n = e.Source
+			if e.Target != nil {
+				// Ensure every node has a targetless edge to signify its start.
+				completed = append(completed, &srvpb.Edge{Source: &srvpb.Node{Ticket: e.Source.Ticket}})
+			}
+		}
+		if e.Target == nil {
+			completed = append(completed, e)
+			continue
+		}
+		completed = append(completed, &srvpb.Edge{
+			Source:  &srvpb.Node{Ticket: e.Source.Ticket},
+			Kind:    e.Kind,
+			Ordinal: e.Ordinal,
+			Target:  e.Target,
+		}, &srvpb.Edge{
+			Source:  &srvpb.Node{Ticket: e.Target.Ticket},
+			Kind:    edges.Mirror(e.Kind),
+			Ordinal: e.Ordinal,
+			Target:  FilterTextFacts(n),
+		})
+	}
+	sort.Sort(byEdgeOrder(completed))
+	return completed
+}
+
+// shardEdges partitions the given sorted edges into n shards by their source
+// ticket, retaining their order.
+func shardEdges(es []*srvpb.Edge, n int) [][]*srvpb.Edge {
+	shards := make([][]*srvpb.Edge, n)
+	for _, e := range es {
+		i := ShardBy(e.Source.Ticket, n)
+		shards[i] = append(shards[i], e)
+	}
+	return shards
+}
+
+func (p *Pipeline) buildEdgeSets(ctx context.Context, es []*srvpb.Edge) error {
+	if p.EdgeOutput == nil {
+		return nil
+	}
+	esb := &EdgeSetBuilder{
+		MaxEdgePageSize: p.MaxPageSize,
+		Output:          p.EdgeOutput,
+		OutputPage:      p.EdgePageOutput,
+	}
+	if esb.OutputPage == nil {
+		esb.OutputPage = func(context.Context, *srvpb.EdgePage) error { return nil }
+	}
+
+	var grp *srvpb.EdgeGroup
+	for _, e := range es {
+		if grp != nil && (e.Target == nil || grp.Kind != e.Kind) {
+			if err := esb.AddGroup(ctx, grp); err != nil {
+				return err
+			}
+			grp = nil
+		}
+
+		if e.Target == nil {
+			if err := esb.StartEdgeSet(ctx, e.Source); err != nil {
+				return err
+			}
+		} else if grp == nil {
+			grp = &srvpb.EdgeGroup{Kind: e.Kind}
+		}
+		if e.Target != nil {
+			grp.Edge = append(grp.Edge, &srvpb.EdgeGroup_Edge{
+				Target:  e.Target,
+				Ordinal: e.Ordinal,
+			})
+		}
+	}
+	if grp != nil {
+		if err := esb.AddGroup(ctx, grp); err != nil {
+			return err
+		}
+	}
+	return esb.Flush(ctx)
+}
+
+// buildDecorations writes the FileDecorations for the given sorted edges and
+// returns the cross-references found for each decoration.
+func (p *Pipeline) buildDecorations(ctx context.Context, es []*srvpb.Edge) ([]*ipb.CrossReference, error) {
+	if p.DecorationOutput == nil && p.CrossRefOutput == nil {
+		return nil, nil
+	}
+
+	fragments := make(map[string][]*srvpb.FileDecorations)
+	fdb := &DecorationFragmentBuilder{
+		Output: func(_ context.Context, file string, fragment *srvpb.FileDecorations) error {
+			fragments[file] = append(fragments[file], fragment)
+			return nil
+		},
+	}
+	for _, e := range es {
+		if err := fdb.AddEdge(ctx, e); err != nil {
+			return nil, err
+		}
+	}
+	if err := fdb.Flush(ctx); err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(fragments))
+	for file := range fragments {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var refs []*ipb.CrossReference
+	for _, ticket := range files {
+		decor := &srvpb.FileDecorations{}
+		targets := make(map[string]*srvpb.Node)
+		for _, fragment := range fragments[ticket] {
+			if fragment.File != nil {
+				decor.File = fragment.File
+			}
+			decor.Decoration = append(decor.Decoration, fragment.Decoration...)
+			for _, n := range fragment.Target {
+				targets[n.Ticket] = n
+			}
+		}
+		delete(fragments, ticket)
+		if decor.File == nil {
+			log.Printf("WARNING: missing file for %d decorations: %q", len(decor.Decoration), ticket)
+			continue
+		}
+
+		if p.CrossRefOutput != nil {
+			norm := xrefs.NewNormalizer(decor.File.Text)
+			byteRange := cachedByteRange(decor.File, norm)
+			for _, d := range decor.Decoration {
+				cr, err := crossReference(decor.File, norm, byteRange, d, targets[d.Target])
+				if err != nil {
+					log.Printf("WARNING: error assembling cross-reference: %v", err)
+					continue
+				}
+				refs = append(refs, cr)
+			}
+		}
+
+		if p.DecorationOutput == nil {
+			continue
+		}
+		for _, d := range decor.Decoration {
+			// Snippet offsets are only needed for the cross-references above.
+			d.Anchor.SnippetStart, d.Anchor.SnippetEnd = 0, 0
+		}
+		for _, n := range targets {
+			decor.Target = append(decor.Target, n)
+		}
+		sort.Sort(ByOffset(decor.Decoration))
+		sort.Sort(ByTicket(decor.Target))
+		if err := p.DecorationOutput(ctx, decor); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// buildCrossReferences writes the PagedCrossReferences for the given
+// cross-references, sorted by referent.
+func (p *Pipeline) buildCrossReferences(ctx context.Context, refs []*ipb.CrossReference) error {
+	xb := &CrossReferencesBuilder{
+		MaxPageSize: p.MaxPageSize,
+		Output:      p.CrossRefOutput,
+		OutputPage:  p.CrossRefPageOutput,
+	}
+	if xb.OutputPage == nil {
+		xb.OutputPage = func(context.Context, *srvpb.PagedCrossReferences_Page) error { return nil }
+	}
+
+	var curTicket string
+	for _, cr := range refs {
+		if curTicket != cr.Referent.Ticket {
+			curTicket = cr.Referent.Ticket
+			if err := xb.StartSet(ctx, cr.Referent); err != nil {
+				return fmt.Errorf("error starting cross-references set: %v", err)
+			}
+		}
+		if err := xb.AddGroup(ctx, &srvpb.PagedCrossReferences_Group{
+			Kind:   cr.TargetAnchor.Kind,
+			Anchor: []*srvpb.ExpandedAnchor{cr.TargetAnchor},
+		}); err != nil {
+			return fmt.Errorf("error adding cross-reference: %v", err)
+		}
+	}
+	return xb.Flush(ctx)
+}
+
+// byEdgeOrder sorts edges by (Source.Ticket, Kind, Ordinal, Target.Ticket)
+// with each source's targetless edge first.
+type byEdgeOrder []*srvpb.Edge
+
+func (s byEdgeOrder) Len() int      { return len(s) }
+func (s byEdgeOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byEdgeOrder) Less(i, j int) bool {
+	x, y := s[i], s[j]
+	if x.Source.Ticket != y.Source.Ticket {
+		return x.Source.Ticket < y.Source.Ticket
+	} else if x.Target == nil || y.Target == nil {
+		return x.Target == nil && y.Target != nil
+	} else if x.Kind != y.Kind {
+		return x.Kind < y.Kind
+	} else if x.Ordinal != y.Ordinal {
+		return x.Ordinal < y.Ordinal
+	}
+	return x.Target.Ticket < y.Target.Ticket
+}
+
+// byReferent sorts cross-references by their referent's ticket, then by their
+// anchor's kind and span.
+type byReferent []*ipb.CrossReference
+
+func (s byReferent) Len() int      { return len(s) }
+func (s byReferent) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byReferent) Less(i, j int) bool {
+	x, y := s[i], s[j]
+	if x.Referent.Ticket != y.Referent.Ticket {
+		return x.Referent.Ticket < y.Referent.Ticket
+	} else if x.TargetAnchor.Kind != y.TargetAnchor.Kind {
+		return x.TargetAnchor.Kind < y.TargetAnchor.Kind
+	} else if xs, ys := x.TargetAnchor.Span.Start.ByteOffset, y.TargetAnchor.Span.Start.ByteOffset; xs != ys {
+		return xs < ys
+	}
+	return x.TargetAnchor.Span.End.ByteOffset < y.TargetAnchor.Span.End.ByteOffset
+}
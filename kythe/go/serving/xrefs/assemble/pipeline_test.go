@@ -0,0 +1,179 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package assemble
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"kythe.io/kythe/go/util/kytheuri"
+	"kythe.io/kythe/go/util/schema/edges"
+	"kythe.io/kythe/go/util/schema/facts"
+	"kythe.io/kythe/go/util/schema/nodes"
+
+	srvpb "kythe.io/kythe/proto/serving_proto"
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+var (
+	testFile   = &spb.VName{Corpus: "corpus", Path: "file.go"}
+	testAnchor = &spb.VName{Corpus: "corpus", Path: "file.go", Signature: "a0", Language: "go"}
+	testTarget = &spb.VName{Corpus: "corpus", Signature: "target", Language: "go"}
+)
+
+func testPipelineEntries() []*spb.Entry {
+	factEntry := func(src *spb.VName, name, value string) *spb.Entry {
+		return &spb.Entry{Source: src, FactName: name, FactValue: []byte(value)}
+	}
+	edgeEntry := func(src *spb.VName, kind string, tgt *spb.VName) *spb.Entry {
+		return &spb.Entry{Source: src, EdgeKind: kind, Target: tgt, FactName: "/"}
+	}
+	return []*spb.Entry{
+		factEntry(testFile, facts.NodeKind, nodes.File),
+		factEntry(testFile, facts.Text, "func target() {}\n"),
+		factEntry(testAnchor, facts.AnchorEnd, "11"),
+		factEntry(testAnchor, facts.AnchorStart, "5"),
+		factEntry(testAnchor, facts.NodeKind, nodes.Anchor),
+		edgeEntry(testAnchor, edges.ChildOf, testFile),
+		edgeEntry(testAnchor, edges.Ref, testTarget),
+		factEntry(testTarget, facts.NodeKind, nodes.Function),
+	}
+}
+
+// pipelineOutputs records a Pipeline's outputs.  Its output functions are only
+// synchronized when the Pipeline may call them concurrently (Workers > 1) so
+// that the race detector checks the Pipeline's contract otherwise.
+type pipelineOutputs struct {
+	mu         sync.Mutex
+	concurrent bool
+
+	// calls is shared by every output function, like a single output sink.
+	calls int
+
+	nodes   []string
+	edgeSet map[string]*srvpb.PagedEdgeSet
+	decor   map[string]*srvpb.FileDecorations
+	xrefs   map[string]*srvpb.PagedCrossReferences
+}
+
+func (o *pipelineOutputs) lock() func() {
+	if !o.concurrent {
+		return func() {}
+	}
+	o.mu.Lock()
+	return o.mu.Unlock
+}
+
+func (o *pipelineOutputs) pipeline(workers int) *Pipeline {
+	o.concurrent = workers > 1
+	o.edgeSet = make(map[string]*srvpb.PagedEdgeSet)
+	o.decor = make(map[string]*srvpb.FileDecorations)
+	o.xrefs = make(map[string]*srvpb.PagedCrossReferences)
+	return &Pipeline{
+		Workers: workers,
+		NodeOutput: func(_ context.Context, n *srvpb.Node) error {
+			defer o.lock()()
+			o.calls++
+			o.nodes = append(o.nodes, n.Ticket)
+			return nil
+		},
+		EdgeOutput: func(_ context.Context, pes *srvpb.PagedEdgeSet) error {
+			defer o.lock()()
+			o.calls++
+			o.edgeSet[pes.Source.Ticket] = pes
+			return nil
+		},
+		DecorationOutput: func(_ context.Context, fd *srvpb.FileDecorations) error {
+			defer o.lock()()
+			o.calls++
+			o.decor[fd.File.Ticket] = fd
+			return nil
+		},
+		CrossRefOutput: func(_ context.Context, xs *srvpb.PagedCrossReferences) error {
+			defer o.lock()()
+			o.calls++
+			o.xrefs[xs.SourceTicket] = xs
+			return nil
+		},
+	}
+}
+
+func runPipeline(p *Pipeline, entries []*spb.Entry) error {
+	ch := make(chan *spb.Entry)
+	go func() {
+		defer close(ch)
+		for _, e := range entries {
+			ch <- e
+		}
+	}()
+	return p.Run(context.Background(), ch)
+}
+
+func TestPipeline(t *testing.T) {
+	file, anchor, target := kytheuri.ToString(testFile), kytheuri.ToString(testAnchor), kytheuri.ToString(testTarget)
+
+	for _, workers := range []int{0, 1, 4} {
+		var out pipelineOutputs
+		if err := runPipeline(out.pipeline(workers), testPipelineEntries()); err != nil {
+			t.Fatalf("Run error (workers=%d): %v", workers, err)
+		}
+
+		expectedNodes := []string{file, target, anchor}
+		sort.Strings(expectedNodes)
+		sort.Strings(out.nodes)
+		if found, expected := strings.Join(out.nodes, " "), strings.Join(expectedNodes, " "); found != expected {
+			t.Errorf("Nodes (workers=%d): expected %q; found %q", workers, expected, found)
+		}
+
+		if len(out.edgeSet) != 3 {
+			t.Errorf("Expected 3 edge sets (workers=%d); found %d", workers, len(out.edgeSet))
+		}
+		if pes := out.edgeSet[target]; pes == nil {
+			t.Errorf("Missing edge set for %q (workers=%d)", target, workers)
+		} else if g, _ := EdgeSetForKind(pes, edges.Mirror(edges.Ref)); g == nil || len(g.Edge) != 1 || g.Edge[0].Target.Ticket != anchor {
+			t.Errorf("Unexpected edge set for %q (workers=%d): %v", target, workers, pes)
+		}
+
+		fd := out.decor[file]
+		if fd == nil {
+			t.Fatalf("Missing decorations for %q (workers=%d)", file, workers)
+		} else if len(fd.Decoration) != 1 || fd.Decoration[0].Target != target || fd.Decoration[0].Kind != edges.Ref {
+			t.Errorf("Unexpected decorations (workers=%d): %v", workers, fd)
+		}
+
+		xs := out.xrefs[target]
+		if xs == nil {
+			t.Fatalf("Missing cross-references for %q (workers=%d)", target, workers)
+		} else if refs := ExtractReferences(xs); len(refs) != 1 || refs[0].Ticket != anchor || refs[0].Text != "target" {
+			t.Errorf("Unexpected cross-references (workers=%d): %v", workers, xs)
+		}
+	}
+}
+
+func TestPipelineError(t *testing.T) {
+	expected := errors.New("node error")
+	p := &Pipeline{
+		NodeOutput: func(context.Context, *srvpb.Node) error { return expected },
+	}
+	if err := runPipeline(p, testPipelineEntries()); err == nil || !strings.Contains(err.Error(), expected.Error()) {
+		t.Errorf("Expected error %v; found %v", expected, err)
+	}
+}
@@ -18,7 +18,9 @@
 package text
 
 import (
+	"bytes"
 	"errors"
+	"unicode/utf8"
 
 	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/htmlindex"
@@ -47,6 +49,133 @@ func ToUTF8(encodingName string, b []byte) (string, error) {
 	return transformBytes(t, b)
 }
 
+// ErrUnknownEncoding is returned by Detect if no encoding could be determined.
+var ErrUnknownEncoding = errors.New("unable to detect encoding")
+
+// An Encoding is a text encoding determined by Detect.
+type Encoding struct {
+	// Name is the encoding's canonical name, as accepted by ToUTF8.
+	Name string
+
+	// BOMLength is the length of the byte order mark at the start of the text,
+	// or 0 if there was none.
+	BOMLength int
+}
+
+// String returns the Encoding's name.
+func (e Encoding) String() string { return e.Name }
+
+// ToUTF8 converts the given text, which must be in encoding e, to a UTF-8
+// string.  A leading byte order mark, if present, is dropped.
+func (e Encoding) ToUTF8(b []byte) (string, error) {
+	if e.BOMLength > 0 && len(b) >= e.BOMLength {
+		b = b[e.BOMLength:]
+	}
+	return ToUTF8(e.Name, b)
+}
+
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+)
+
+// detectSampleSize is the maximum number of bytes examined by Detect's
+// heuristics.
+const detectSampleSize = 4096
+
+// Detect guesses the encoding of the given text.  A byte order mark for UTF-8,
+// UTF-16LE, or UTF-16BE is used when present.  Otherwise, valid UTF-8 text is
+// reported as UTF-8, text whose NUL bytes fall predominantly in either the odd
+// or even positions is reported as UTF-16, and any other text without NUL
+// bytes is reported as windows-1252.  ErrUnknownEncoding is returned if none
+// of these heuristics apply.
+func Detect(b []byte) (Encoding, error) {
+	switch {
+	case bytes.HasPrefix(b, utf8BOM):
+		return Encoding{Name: "utf-8", BOMLength: len(utf8BOM)}, nil
+	case bytes.HasPrefix(b, utf16LEBOM):
+		return Encoding{Name: "utf-16le", BOMLength: len(utf16LEBOM)}, nil
+	case bytes.HasPrefix(b, utf16BEBOM):
+		return Encoding{Name: "utf-16be", BOMLength: len(utf16BEBOM)}, nil
+	}
+
+	sample := b
+	if len(sample) > detectSampleSize {
+		sample = sample[:detectSampleSize]
+	}
+	var evenNULs, oddNULs int
+	for i, c := range sample {
+		if c != 0 {
+			continue
+		} else if i%2 == 0 {
+			evenNULs++
+		} else {
+			oddNULs++
+		}
+	}
+
+	switch pairs := len(sample) / 2; {
+	case evenNULs+oddNULs == 0:
+		if utf8.Valid(b) {
+			return Encoding{Name: "utf-8"}, nil
+		}
+		return Encoding{Name: "windows-1252"}, nil
+	case len(sample)%2 == 0 && oddNULs > pairs/4 && evenNULs == 0:
+		return Encoding{Name: "utf-16le"}, nil
+	case len(sample)%2 == 0 && evenNULs > pairs/4 && oddNULs == 0:
+		return Encoding{Name: "utf-16be"}, nil
+	}
+	return Encoding{}, ErrUnknownEncoding
+}
+
+// ToUTF8WithFallback converts the given encoded text to a UTF-8 string.
+// Unlike ToUTF8, it never fails: if the encoding is unsupported or the text
+// cannot be decoded, b is treated as UTF-8 and each invalid sequence is
+// replaced with U+FFFD.  The result may therefore be lossy.
+func ToUTF8WithFallback(encodingName string, b []byte) string {
+	if s, err := ToUTF8(encodingName, b); err == nil {
+		return s
+	}
+	s, _ := transformBytes(encoding.Replacement.NewEncoder(), b)
+	return s
+}
+
+// TruncateSnippet truncates s to at most maxRunes Unicode code points.  If s
+// was truncated, "…" is appended to the result.  Truncation always
+// happens on a code point boundary so a valid UTF-8 string remains valid.
+func TruncateSnippet(s string, maxRunes int) string {
+	var n int
+	for i := range s {
+		if n >= maxRunes {
+			return s[:i] + "…"
+		}
+		n++
+	}
+	return s
+}
+
+// LineOffsets returns the byte offset of the start of each line in b.  The
+// first line always starts at offset 0.  Lines may be terminated by "\n",
+// "\r\n", or a lone "\r"; a line terminator at the very end of b begins a
+// final, empty line.
+func LineOffsets(b []byte) []int32 {
+	offsets := []int32{0}
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\r':
+			if i+1 < len(b) && b[i+1] == '\n' {
+				i++
+			}
+		case '\n':
+		default:
+			continue
+		}
+		offsets = append(offsets, int32(i+1))
+	}
+	return offsets
+}
+
 func transformBytes(e transform.Transformer, text []byte) (string, error) {
 	res, _, err := transform.Bytes(e, text)
 	return string(res), err
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package text
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineOffsets(t *testing.T) {
+	tests := []struct {
+		text    string
+		offsets []int32
+	}{
+		{"", []int32{0}},
+		{"no newline", []int32{0}},
+		{"a\nbc\n\nd", []int32{0, 2, 5, 6}},
+		{"a\nbc\n", []int32{0, 2, 5}},
+		{"a\r\nbc\r\n\r\nd", []int32{0, 3, 7, 9}},
+		{"a\rbc\r\rd", []int32{0, 2, 5, 6}},
+		{"a\nb\r\nc\rd\n\re", []int32{0, 2, 5, 7, 9, 10}},
+		{"\r", []int32{0, 1}},
+	}
+
+	for _, test := range tests {
+		if found := LineOffsets([]byte(test.text)); !reflect.DeepEqual(found, test.offsets) {
+			t.Errorf("LineOffsets(%q): expected %v; found %v", test.text, test.offsets, found)
+		}
+	}
+}
+
+func TestToUTF8WithFallback(t *testing.T) {
+	tests := []struct {
+		encoding string
+		text     string
+		expected string
+	}{
+		{"", "plain", "plain"},
+		{"utf-8", "héllo", "héllo"},
+		{"latin1", "h\xe9llo", "héllo"},
+		{"", "bad \xff byte", "bad � byte"},
+		{"no-such-encoding", "ok", "ok"},
+		{"no-such-encoding", "bad \xff byte", "bad � byte"},
+	}
+
+	for _, test := range tests {
+		if found := ToUTF8WithFallback(test.encoding, []byte(test.text)); found != test.expected {
+			t.Errorf("ToUTF8WithFallback(%q, %q): expected %q; found %q", test.encoding, test.text, test.expected, found)
+		}
+	}
+}
+
+func TestTruncateSnippet(t *testing.T) {
+	tests := []struct {
+		snippet  string
+		maxRunes int
+		expected string
+	}{
+		{"", 0, ""},
+		{"short", 10, "short"},
+		{"exact", 5, "exact"},
+		{"truncated", 5, "trunc…"},
+		{"anything", 0, "…"},
+		{"日本語のテキスト", 8, "日本語のテキスト"},
+		{"日本語のテキスト", 3, "日本語…"},
+		{"a日b本", 2, "a日…"},
+	}
+
+	for _, test := range tests {
+		if found := TruncateSnippet(test.snippet, test.maxRunes); found != test.expected {
+			t.Errorf("TruncateSnippet(%q, %d): expected %q; found %q", test.snippet, test.maxRunes, test.expected, found)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected Encoding
+	}{
+		{"", Encoding{Name: "utf-8"}},
+		{"plain ascii", Encoding{Name: "utf-8"}},
+		{"héllo", Encoding{Name: "utf-8"}},
+		{"\xef\xbb\xbfhi", Encoding{Name: "utf-8", BOMLength: 3}},
+		{"\xff\xfeh\x00i\x00", Encoding{Name: "utf-16le", BOMLength: 2}},
+		{"\xfe\xff\x00h\x00i", Encoding{Name: "utf-16be", BOMLength: 2}},
+		{"h\x00i\x00!\x00", Encoding{Name: "utf-16le"}},
+		{"\x00h\x00i\x00!", Encoding{Name: "utf-16be"}},
+		{"h\xe9llo", Encoding{Name: "windows-1252"}},
+	}
+
+	for _, test := range tests {
+		found, err := Detect([]byte(test.text))
+		if err != nil {
+			t.Errorf("Detect(%q): unexpected error: %v", test.text, err)
+		} else if found != test.expected {
+			t.Errorf("Detect(%q): expected %+v; found %+v", test.text, test.expected, found)
+		}
+	}
+
+	if enc, err := Detect([]byte("\x00\x00\x01\x00\x00")); err != ErrUnknownEncoding {
+		t.Errorf("Detect(binary): expected ErrUnknownEncoding; found %+v, %v", enc, err)
+	}
+}
+
+func TestEncodingToUTF8(t *testing.T) {
+	for _, text := range []string{"\xff\xfeh\x00i\x00", "\xfe\xff\x00h\x00i", "\xef\xbb\xbfhi", "hi"} {
+		enc, err := Detect([]byte(text))
+		if err != nil {
+			t.Errorf("Detect(%q): unexpected error: %v", text, err)
+			continue
+		}
+		if found, err := enc.ToUTF8([]byte(text)); err != nil {
+			t.Errorf("%v.ToUTF8(%q): unexpected error: %v", enc, text, err)
+		} else if found != "hi" {
+			t.Errorf("%v.ToUTF8(%q): expected %q; found %q", enc, text, "hi", found)
+		}
+	}
+}
@@ -230,6 +230,23 @@ func ToVName(s string) (*spb.VName, error) {
 	return uri.VName(), nil
 }
 
+// IsValid reports whether ticket plausibly is a Kythe ticket: it must begin
+// with "kythe://" and contain no NUL bytes.  IsValid is much cheaper than
+// Parse, but does not guarantee that ticket can be parsed; use Parse where
+// correctness is critical.
+func IsValid(ticket string) bool {
+	return strings.HasPrefix(ticket, Scheme+"://") && strings.IndexByte(ticket, 0) < 0
+}
+
+// Components parses ticket as a Kythe URI and returns its components.
+func Components(ticket string) (corpus, root, path, language, signature string, err error) {
+	u, err := Parse(ticket)
+	if err != nil {
+		return "", "", "", "", "", err
+	}
+	return u.Corpus, u.Root, u.Path, u.Language, u.Signature, nil
+}
+
 // MustParse returns the URI from parsing s, or panics in case of error.
 func MustParse(s string) *URI {
 	u, err := Parse(s)
@@ -248,8 +265,23 @@ func Fix(s string) (string, error) {
 	return u.String(), nil
 }
 
+// Normalize returns the canonical form of the given Kythe ticket.  Unlike Fix,
+// an error is returned for an empty ticket (one with no corpus, root, path,
+// language, or signature).
+func Normalize(ticket string) (string, error) {
+	u, err := Parse(ticket)
+	if err != nil {
+		return "", err
+	} else if *u == (URI{}) {
+		return "", errors.New("empty ticket")
+	}
+	return u.String(), nil
+}
+
 // Equal reports whether the two Kythe URI strings are equal in canonical form.
-// If either URI is invalid, Equal returns false.
+// If either URI is invalid, Equal returns false.  Since both URIs are parsed,
+// Equal is much more expensive than ==; it should only be used where tickets
+// may be formatted differently (e.g. with different escaping).
 func Equal(u1, u2 string) bool {
 	f1, err := Fix(u1)
 	if err != nil {
@@ -18,6 +18,7 @@ package kytheuri
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
@@ -117,6 +118,8 @@ func TestEqual(t *testing.T) {
 		// Escaping is respected.
 		{"kythe:?path=%50", "kythe://?path=P"},
 		{"kythe:?lang=%4c?path=%50", "kythe://?lang=L?path=P"},
+		{"kythe://c?path=a%2Fb#%73ig", "kythe://c?path=a/b#sig"},
+		{"kythe://%63orpus#sig", "kythe://corpus#sig"},
 
 		// Paths are cleaned.
 		{"kythe://a?path=b/../c#sig", "kythe://a?path=c#sig"},
@@ -141,6 +144,8 @@ func TestEqual(t *testing.T) {
 		a, b string
 	}{
 		{"kythe://a", "kythe://a?path=P"},
+		{"kythe://a?path=%50", "kythe://a?path=p"},
+		{"kythe://a#%73ig", "kythe://a#Sig"},
 		{"bogus", "bogus"},
 		{"bogus", "kythe://good"},
 		{"kythe://good", "bogus"},
@@ -162,6 +167,48 @@ func TestEqual(t *testing.T) {
 	}
 }
 
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		ticket, want string
+	}{
+		// Already canonical
+		{"kythe://corpus?lang=go?path=a/b#sig", "kythe://corpus?lang=go?path=a/b#sig"},
+		{"kythe:?root=R#sig", "kythe:?root=R#sig"},
+
+		// Unnecessary escaping and attribute ordering
+		{"kythe://corpus?path=%61/b?lang=%67o#%73ig", "kythe://corpus?lang=go?path=a/b#sig"},
+		{"//corpus?path=a/../b", "kythe://corpus?path=b"},
+	}
+	for _, test := range tests {
+		got, err := Normalize(test.ticket)
+		if err != nil {
+			t.Errorf("Normalize %q: unexpected error: %v", test.ticket, err)
+		} else if got != test.want {
+			t.Errorf("Normalize %q: got %q, want %q", test.ticket, got, test.want)
+		}
+	}
+
+	for _, bad := range []string{"", "kythe:", "kythe://", "http://corpus#sig", "//a/%x"} {
+		if got, err := Normalize(bad); err == nil {
+			t.Errorf("Normalize %q: got %q, want error", bad, got)
+		}
+	}
+}
+
+func TestComponents(t *testing.T) {
+	corpus, root, path, lang, sig, err := Components("kythe://c?lang=l?path=p?root=r#s")
+	if err != nil {
+		t.Fatalf("Components: unexpected error: %v", err)
+	}
+	if got := []string{corpus, root, path, lang, sig}; strings.Join(got, ",") != "c,r,p,l,s" {
+		t.Errorf("Components: got %q, want [c r p l s]", got)
+	}
+
+	if _, _, _, _, _, err := Components("http://bogus"); err == nil {
+		t.Error("Components: expected error for invalid ticket")
+	}
+}
+
 func TestRoundTripURI(t *testing.T) {
 	// Test that converting a Kythe URI to a VName and then back preserves
 	// equivalence.
@@ -262,3 +309,39 @@ func TestString(t *testing.T) {
 		}
 	}
 }
+
+func TestIsValid(t *testing.T) {
+	tests := []struct {
+		ticket string
+		valid  bool
+	}{
+		{"kythe://corpus?lang=go?path=a/b#sig", true},
+		{"kythe://", true},
+		{"", false},
+		{"kythe:", false},
+		{"//corpus?path=p", false},
+		{"http://corpus", false},
+		{"kythe://corpus#sig\x00", false},
+	}
+	for _, test := range tests {
+		if got := IsValid(test.ticket); got != test.valid {
+			t.Errorf("IsValid %q: got %v, want %v", test.ticket, got, test.valid)
+		}
+	}
+}
+
+const benchTicket = "kythe://kythe?lang=go?path=kythe/go/util/kytheuri/uri.go?root=root#IsValid%3Afunc"
+
+func BenchmarkIsValid(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		IsValid(benchTicket)
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(benchTicket); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -79,12 +79,54 @@ type SetPager struct {
 	//   Size(l) + Size(r) == Size(Combine(l, r))
 	Size func(Group) int
 
+	// HeadKey optionally returns an identifier for the given Head, such as a
+	// ticket, to use in errors.  If nil, a Head is identified by its type.
+	HeadKey func(Head) string
+
+	maxGroups int
+
+	curHead         Head
 	curSet          Set
 	curGrp          Group
 	groups          *sortutil.ByLesser // heap sorted by Size
 	resident, total int
+	pages, added    int
+}
+
+// SetMaxGroups limits the number of Groups that may be added to a single Set.
+// Once the limit is reached, AddGroup returns a *TooManyGroupsError.  If n <=
+// 0, there is no limit.
+func (p *SetPager) SetMaxGroups(n int) { p.maxGroups = n }
+
+// TooManyGroupsError is returned by AddGroup when adding a Group would exceed
+// the limit given to SetMaxGroups.  Callers should detect it with a type
+// assertion on *TooManyGroupsError.
+type TooManyGroupsError struct {
+	// Head is the Head of the Set that exceeded the limit.
+	Head Head
+	// Key identifies Head, as given by the SetPager's HeadKey.
+	Key string
+}
+
+// Error implements the error interface.
+func (e *TooManyGroupsError) Error() string {
+	return fmt.Sprintf("too many groups in set: %s", e.Key)
+}
+
+func (p *SetPager) headKey(hd Head) string {
+	if p.HeadKey != nil {
+		return p.HeadKey(hd)
+	}
+	return fmt.Sprintf("%T", hd)
 }
 
+// PageCount returns the number of Pages emitted for the current Set.
+func (p *SetPager) PageCount() int { return p.pages }
+
+// GroupCount returns the number of Groups added to the current Set since the
+// last call to StartSet.
+func (p *SetPager) GroupCount() int { return p.added }
+
 // StartSet begins a new Set for the given Head, possibly emitting a previous
 // Set.  Each following call to AddGroup adds the group to this new Set until
 // another call to StartSet is made.
@@ -95,7 +137,7 @@ func (p *SetPager) StartSet(ctx context.Context, hd Head) error {
 		}
 	}
 
-	p.curSet = p.NewSet(hd)
+	p.curHead, p.curSet = hd, p.NewSet(hd)
 	p.groups = &sortutil.ByLesser{
 		Lesser: sortutil.LesserFunc(func(a, b interface{}) bool {
 			// Sort larger Groups first.
@@ -113,6 +155,8 @@ func (p *SetPager) StartSet(ctx context.Context, hd Head) error {
 func (p *SetPager) AddGroup(ctx context.Context, g Group) error {
 	if p.curSet == nil {
 		return errors.New("no Set currently being built")
+	} else if p.maxGroups > 0 && p.added >= p.maxGroups {
+		return &TooManyGroupsError{Head: p.curHead, Key: p.headKey(p.curHead)}
 	}
 
 	// Setup p.curGrp; ensuring it is non-nil
@@ -132,6 +176,7 @@ func (p *SetPager) AddGroup(ctx context.Context, g Group) error {
 	// Update group size counters
 	p.resident += sz
 	p.total += sz
+	p.added++
 
 	// Handle creation of pages when # of resident elements passes config value
 	for p.MaxPageSize > 0 && p.resident > p.MaxPageSize {
@@ -152,6 +197,7 @@ func (p *SetPager) AddGroup(ctx context.Context, g Group) error {
 		}
 
 		p.resident -= p.Size(eviction)
+		p.pages++
 		if err := p.OutputPage(ctx, p.curSet, eviction); err != nil {
 			return err
 		}
@@ -160,6 +206,36 @@ func (p *SetPager) AddGroup(ctx context.Context, g Group) error {
 	return nil
 }
 
+// DryRun returns the number of Pages that would be emitted for a Set consisting
+// of the given Groups without emitting anything.  The Set currently being built
+// is unaffected.  Since Combine and Split may modify their arguments, the
+// given Groups should not be reused.
+func (p *SetPager) DryRun(ctx context.Context, groups []Group) (pageCount int, err error) {
+	dry := &SetPager{
+		MaxPageSize: p.MaxPageSize,
+		SkipEmpty:   p.SkipEmpty,
+		maxGroups:   p.maxGroups,
+
+		OutputSet:  func(context.Context, int, Set, []Group) error { return nil },
+		OutputPage: func(context.Context, Set, Group) error { return nil },
+
+		NewSet:  func(Head) Set { return struct{}{} },
+		Combine: p.Combine,
+		Split:   p.Split,
+		Size:    p.Size,
+	}
+	if err := dry.StartSet(ctx, nil); err != nil {
+		return 0, err
+	}
+	for _, g := range groups {
+		if err := dry.AddGroup(ctx, g); err != nil {
+			return dry.PageCount(), err
+		}
+	}
+	pageCount = dry.PageCount()
+	return pageCount, dry.Flush(ctx)
+}
+
 // Flush signals the end of the current Set being built, flushing it, and its
 // Groups to the output function.  This should be called after the final call to
 // AddGroup.  Manually calling Flush at any other time is unnecessary.
@@ -180,6 +256,7 @@ func (p *SetPager) Flush(ctx context.Context) error {
 	if !p.SkipEmpty || p.total > 0 {
 		err = p.OutputSet(ctx, p.total, p.curSet, grps)
 	}
-	p.curSet, p.curGrp, p.groups, p.resident, p.total = nil, nil, nil, 0, 0
+	p.curHead, p.curSet, p.curGrp, p.groups, p.resident, p.total = nil, nil, nil, nil, 0, 0
+	p.pages, p.added = 0, 0
 	return err
 }
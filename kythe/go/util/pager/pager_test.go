@@ -212,3 +212,139 @@ func TestPager(t *testing.T) {
 		t.Fatalf("error checking Pages: %v", err)
 	}
 }
+
+type testOutput struct {
+	Sets  []*testSet
+	Pages []*testPage
+}
+
+func newTestPager(maxPageSize int) (*SetPager, *testOutput) {
+	out := &testOutput{}
+	return &SetPager{
+		MaxPageSize: maxPageSize,
+
+		OutputSet: func(_ context.Context, total int, s Set, grps []Group) error {
+			ts := s.(*testSet)
+			ts.Total = total
+			for _, g := range grps {
+				ts.Groups = append(ts.Groups, g.(*testGroup))
+			}
+			out.Sets = append(out.Sets, ts)
+			return nil
+		},
+		OutputPage: func(_ context.Context, s Set, g Group) error {
+			ts := s.(*testSet)
+			out.Pages = append(out.Pages, &testPage{
+				Index: ts.Pages,
+				Group: g.(*testGroup),
+			})
+			ts.Pages++
+			return nil
+		},
+
+		NewSet: func(h Head) Set {
+			return &testSet{Head: h.(string)}
+		},
+		Combine: func(l, r Group) Group {
+			lg, rg := l.(*testGroup), r.(*testGroup)
+			if lg.Key != rg.Key {
+				return nil
+			}
+			lg.Vals = append(lg.Vals, rg.Vals...)
+			return lg
+		},
+		Split: func(total int, g Group) (Group, Group) {
+			tg := g.(*testGroup)
+			ng := &testGroup{
+				Key:  tg.Key,
+				Vals: tg.Vals[:total],
+			}
+			tg.Vals = tg.Vals[total:]
+			return ng, tg
+		},
+		Size: func(g Group) int { return len(g.(*testGroup).Vals) },
+	}, out
+}
+
+func TestPagerCounts(t *testing.T) {
+	p, out := newTestPager(4)
+
+	ctx := context.Background()
+	testutil.FatalOnErrT(t, "StartSet error: %v", p.StartSet(ctx, "head key"))
+	groups := []*testGroup{
+		{Key: "key1", Vals: []int{11, 12, 13}},
+		{Key: "key1", Vals: []int{14, 15, 16}},
+		{Key: "key2", Vals: []int{21}},
+	}
+	for i, g := range groups {
+		testutil.FatalOnErrT(t, "AddGroup error: %v", p.AddGroup(ctx, g))
+		if found := p.GroupCount(); found != i+1 {
+			t.Errorf("GroupCount: expected %d; found %d", i+1, found)
+		}
+		if found := p.PageCount(); found != len(out.Pages) {
+			t.Errorf("PageCount: expected %d; found %d", len(out.Pages), found)
+		}
+	}
+	if p.PageCount() != 1 {
+		t.Errorf("PageCount: expected 1; found %d", p.PageCount())
+	}
+
+	testutil.FatalOnErrT(t, "StartSet error: %v", p.StartSet(ctx, "next set"))
+	if p.GroupCount() != 0 || p.PageCount() != 0 {
+		t.Errorf("Expected counts to be reset; found %d groups and %d pages", p.GroupCount(), p.PageCount())
+	}
+}
+
+func TestPagerMaxGroups(t *testing.T) {
+	p, _ := newTestPager(0)
+	p.SetMaxGroups(2)
+	p.HeadKey = func(hd Head) string { return hd.(string) }
+
+	ctx := context.Background()
+	testutil.FatalOnErrT(t, "StartSet error: %v", p.StartSet(ctx, "head key"))
+	testutil.FatalOnErrT(t, "AddGroup error: %v", p.AddGroup(ctx, &testGroup{Key: "key1"}))
+	testutil.FatalOnErrT(t, "AddGroup error: %v", p.AddGroup(ctx, &testGroup{Key: "key2"}))
+
+	err := p.AddGroup(ctx, &testGroup{Key: "key3"})
+	if tmg, ok := err.(*TooManyGroupsError); !ok {
+		t.Fatalf("Expected TooManyGroupsError; found %v", err)
+	} else if tmg.Head != "head key" {
+		t.Errorf("Expected Head %q; found %v", "head key", tmg.Head)
+	} else if expected := "too many groups in set: head key"; tmg.Error() != expected {
+		t.Errorf("Expected error %q; found %q", expected, tmg.Error())
+	}
+
+	// The limit applies per Set.
+	testutil.FatalOnErrT(t, "StartSet error: %v", p.StartSet(ctx, "next set"))
+	testutil.FatalOnErrT(t, "AddGroup error: %v", p.AddGroup(ctx, &testGroup{Key: "key1"}))
+}
+
+func TestPagerDryRun(t *testing.T) {
+	testGroups := func() []Group {
+		return []Group{
+			&testGroup{Key: "key1", Vals: []int{11, 12, 13}},
+			&testGroup{Key: "key1", Vals: []int{14, 15, 16}},
+			&testGroup{Key: "key2", Vals: []int{21}},
+			&testGroup{Key: "key3", Vals: []int{31, 32, 33, 34, 35, 36, 37, 38, 39}},
+		}
+	}
+
+	p, out := newTestPager(4)
+	ctx := context.Background()
+	testutil.FatalOnErrT(t, "StartSet error: %v", p.StartSet(ctx, "head key"))
+
+	predicted, err := p.DryRun(ctx, testGroups())
+	testutil.FatalOnErrT(t, "DryRun error: %v", err)
+	if len(out.Sets) != 0 || len(out.Pages) != 0 {
+		t.Fatalf("DryRun emitted output: %d sets; %d pages", len(out.Sets), len(out.Pages))
+	}
+
+	for _, g := range testGroups() {
+		testutil.FatalOnErrT(t, "AddGroup error: %v", p.AddGroup(ctx, g))
+	}
+	testutil.FatalOnErrT(t, "Flush error: %v", p.Flush(ctx))
+
+	if predicted == 0 || predicted != len(out.Pages) {
+		t.Errorf("DryRun predicted %d pages; found %d", predicted, len(out.Pages))
+	}
+}
@@ -19,6 +19,7 @@ package edges
 
 import (
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -58,6 +59,30 @@ const (
 	RefImports        = Prefix + "ref/imports"
 )
 
+// known holds every edge kind defined above, sorted.
+var known = sortedKinds(
+	ChildOf, Extends, ExtendsPrivate, ExtendsPrivateVirtual, ExtendsProtected,
+	ExtendsProtectedVirtual, ExtendsPublic, ExtendsPublicVirtual, ExtendsVirtual,
+	Named, Overrides, Param, Satisfies, Typed,
+	Completes, CompletesUniquely, Defines, DefinesBinding, Documents, Ref,
+	RefCall, RefImports,
+)
+
+func sortedKinds(kinds ...string) []string {
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Known returns the sorted forward edge kinds defined by the schema.
+func Known() []string { return append([]string(nil), known...) }
+
+// IsKnown reports whether kind is a forward edge kind defined by the schema.
+// Ordinals (see ParamIndex) and reverse edge kinds are not considered known.
+func IsKnown(kind string) bool {
+	i := sort.SearchStrings(known, kind)
+	return i < len(known) && known[i] == kind
+}
+
 // ParamIndex returns an edge label of the form "param.i" for the i given.
 func ParamIndex(i int) string { return Param + "." + strconv.Itoa(i) }
 
@@ -17,9 +17,15 @@
 package edges
 
 import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
 	"testing"
 
 	"kythe.io/kythe/go/test/testutil"
+	"kythe.io/kythe/go/util/schema"
 )
 
 func TestParseOrdinal(t *testing.T) {
@@ -137,3 +143,126 @@ func TestParamIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestKnown(t *testing.T) {
+	kinds := Known()
+	if !sort.StringsAreSorted(kinds) {
+		t.Errorf("Known() is not sorted: %v", kinds)
+	}
+	for _, kind := range kinds {
+		if !IsKnown(kind) {
+			t.Errorf("IsKnown(%q) = false; want true", kind)
+		} else if IsReverse(kind) {
+			t.Errorf("Known() includes reverse kind %q", kind)
+		}
+	}
+	for _, kind := range []string{Defines, RefCall, ChildOf, ExtendsPublicVirtual} {
+		if !IsKnown(kind) {
+			t.Errorf("IsKnown(%q) = false; want true", kind)
+		}
+	}
+	for _, kind := range []string{"", Mirror(Ref), ParamIndex(0), Prefix + "bogus"} {
+		if IsKnown(kind) {
+			t.Errorf("IsKnown(%q) = true; want false", kind)
+		}
+	}
+}
+
+// TestKnownMatchesConstants ensures that every edge kind constant declared in
+// edges.go is included in Known.
+func TestKnownMatchesConstants(t *testing.T) {
+	consts := exportedConsts(t, "edges.go", map[string]string{"schema.Prefix": schema.Prefix})
+	delete(consts, "Prefix")
+	if len(consts) == 0 {
+		t.Fatal("Found no edge kind constants in edges.go")
+	}
+	for name, kind := range consts {
+		if !IsKnown(kind) {
+			t.Errorf("Edge kind %s (%q) missing from Known()", name, kind)
+		}
+	}
+	if len(Known()) != len(consts) {
+		t.Errorf("Known() has %d kinds; edges.go declares %d", len(Known()), len(consts))
+	}
+}
+
+// exportedConsts parses the Go source file at path and returns the value of
+// each exported string constant it declares, keyed by name.  Each constant's
+// value must be a string literal, a reference to an identifier in idents (or an
+// earlier constant in the file), or a sum of these.
+func exportedConsts(t *testing.T, path string, idents map[string]string) map[string]string {
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+	if err != nil {
+		t.Fatalf("Error parsing %s: %v", path, err)
+	}
+
+	vals := make(map[string]string)
+	for name, val := range idents {
+		vals[name] = val
+	}
+	var eval func(ast.Expr) string
+	eval = func(e ast.Expr) string {
+		switch e := e.(type) {
+		case *ast.BasicLit:
+			if s, err := strconv.Unquote(e.Value); err == nil {
+				return s
+			}
+		case *ast.Ident:
+			if val, ok := vals[e.Name]; ok {
+				return val
+			}
+		case *ast.SelectorExpr:
+			if x, ok := e.X.(*ast.Ident); ok {
+				if val, ok := vals[x.Name+"."+e.Sel.Name]; ok {
+					return val
+				}
+			}
+		case *ast.BinaryExpr:
+			if e.Op == token.ADD {
+				return eval(e.X) + eval(e.Y)
+			}
+		}
+		t.Fatalf("Unsupported constant expression in %s: %#v", path, e)
+		return ""
+	}
+
+	exported := make(map[string]string)
+	for _, decl := range f.Decls {
+		if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.CONST {
+			for _, spec := range gd.Specs {
+				vs := spec.(*ast.ValueSpec)
+				for i, name := range vs.Names {
+					vals[name.Name] = eval(vs.Values[i])
+					if name.IsExported() {
+						exported[name.Name] = vals[name.Name]
+					}
+				}
+			}
+		}
+	}
+	return exported
+}
+
+func benchmarkKinds() []string {
+	distinct := Known()[:20]
+	kinds := make([]string, 10000)
+	for i := range kinds {
+		kinds[i] = distinct[i%len(distinct)]
+		if i%2 == 0 {
+			kinds[i] = Mirror(kinds[i])
+		}
+	}
+	return kinds
+}
+
+var canonicalSink string
+
+func BenchmarkCanonical(b *testing.B) {
+	kinds := benchmarkKinds()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, kind := range kinds {
+			canonicalSink = Canonical(kind)
+		}
+	}
+}
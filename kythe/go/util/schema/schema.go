@@ -18,6 +18,9 @@
 package schema
 
 import (
+	"sort"
+	"strings"
+
 	"kythe.io/kythe/go/util/schema/facts"
 
 	spb "kythe.io/kythe/proto/storage_proto"
@@ -96,3 +99,64 @@ func (n *Node) ToEntries() []*spb.Entry {
 	}
 	return entries
 }
+
+// IsTextFact reports whether factName is one of the facts holding a node's
+// (potentially large) text.
+func IsTextFact(factName string) bool {
+	return factName == facts.Text || factName == facts.TextEncoding
+}
+
+// IsAnchorFact reports whether factName is one of the offset facts only
+// meaningful on anchor nodes.
+func IsAnchorFact(factName string) bool {
+	switch factName {
+	case facts.AnchorStart, facts.AnchorEnd, facts.SnippetStart, facts.SnippetEnd:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsNodeKindFact reports whether factName is the node kind fact.
+func IsNodeKindFact(factName string) bool { return factName == facts.NodeKind }
+
+// IsCompleteFact reports whether factName is the completeness fact.
+func IsCompleteFact(factName string) bool { return factName == facts.Complete }
+
+// knownFactNames holds every fact name defined in the facts package, sorted.
+var knownFactNames = sortedNames(
+	facts.AnchorEnd, facts.AnchorStart, facts.Complete, facts.Code,
+	facts.ParamDefault, facts.NodeKind, facts.SnippetEnd, facts.SnippetStart,
+	facts.Subkind, facts.Text, facts.TextEncoding,
+)
+
+func sortedNames(names ...string) []string {
+	sort.Strings(names)
+	return names
+}
+
+// KnownFactNames returns the sorted fact names defined by the schema.  The
+// schema's edge kinds are available from the edges package (see edges.Known).
+func KnownFactNames() []string { return append([]string(nil), knownFactNames...) }
+
+// IsKnownFactName reports whether name is a fact name defined by the schema.
+func IsKnownFactName(name string) bool {
+	i := sort.SearchStrings(knownFactNames, name)
+	return i < len(knownFactNames) && knownFactNames[i] == name
+}
+
+// FactNamespace returns the language namespace of a fact name of the form
+// "/kythe/<language>/<name>" (e.g. "go" for "/kythe/go/package").  The empty
+// string is returned for the language-agnostic facts defined by the schema and
+// for any fact name not matching the expected structure.
+func FactNamespace(factName string) string {
+	if IsKnownFactName(factName) || !strings.HasPrefix(factName, Prefix) {
+		return ""
+	}
+	rest := factName[len(Prefix):]
+	i := strings.Index(rest, "/")
+	if i <= 0 || i == len(rest)-1 {
+		return ""
+	}
+	return rest[:i]
+}
@@ -17,6 +17,11 @@
 package schema
 
 import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
 	"testing"
 
 	"kythe.io/kythe/go/util/schema/facts"
@@ -74,3 +79,166 @@ func TestEdgeToEntry(t *testing.T) {
 		t.Errorf("ToEdge(%+v):\n--- got\n%s\n--- want\n%s", e, proto.MarshalTextString(got), proto.MarshalTextString(want))
 	}
 }
+
+func TestIsTextFact(t *testing.T) {
+	for _, name := range []string{facts.Text, facts.TextEncoding} {
+		if !IsTextFact(name) {
+			t.Errorf("IsTextFact(%q) = false; want true", name)
+		}
+	}
+	for _, name := range []string{facts.NodeKind, facts.Code, facts.Text + "/other", ""} {
+		if IsTextFact(name) {
+			t.Errorf("IsTextFact(%q) = true; want false", name)
+		}
+	}
+}
+
+func TestFactPredicates(t *testing.T) {
+	tests := []struct {
+		pred  func(string) bool
+		name  string
+		valid []string
+	}{
+		{IsAnchorFact, "IsAnchorFact", []string{facts.AnchorStart, facts.AnchorEnd, facts.SnippetStart, facts.SnippetEnd}},
+		{IsNodeKindFact, "IsNodeKindFact", []string{facts.NodeKind}},
+		{IsCompleteFact, "IsCompleteFact", []string{facts.Complete}},
+	}
+	all := []string{
+		facts.AnchorStart, facts.AnchorEnd, facts.SnippetStart, facts.SnippetEnd,
+		facts.NodeKind, facts.Complete, facts.Subkind, facts.Text, "",
+	}
+
+	for _, test := range tests {
+		for _, fact := range all {
+			var want bool
+			for _, v := range test.valid {
+				if v == fact {
+					want = true
+				}
+			}
+			if got := test.pred(fact); got != want {
+				t.Errorf("%s(%q) = %v; want %v", test.name, fact, got, want)
+			}
+		}
+	}
+}
+
+func TestKnownFactNames(t *testing.T) {
+	names := KnownFactNames()
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("KnownFactNames() is not sorted: %v", names)
+	}
+	for _, name := range names {
+		if !IsKnownFactName(name) {
+			t.Errorf("IsKnownFactName(%q) = false; want true", name)
+		}
+	}
+	for _, name := range []string{"", Prefix, facts.Text + "/bogus", "/other/fact"} {
+		if IsKnownFactName(name) {
+			t.Errorf("IsKnownFactName(%q) = true; want false", name)
+		}
+	}
+}
+
+// TestKnownFactNamesMatchConstants ensures that every fact name constant
+// declared in the facts package is included in KnownFactNames.
+func TestKnownFactNamesMatchConstants(t *testing.T) {
+	consts := exportedConsts(t, "facts/facts.go", nil)
+	delete(consts, "DefaultTextEncoding") // a fact value, not a fact name
+	if len(consts) == 0 {
+		t.Fatal("Found no fact name constants in facts/facts.go")
+	}
+	for name, fact := range consts {
+		if !IsKnownFactName(fact) {
+			t.Errorf("Fact name facts.%s (%q) missing from KnownFactNames()", name, fact)
+		}
+	}
+	if len(KnownFactNames()) != len(consts) {
+		t.Errorf("KnownFactNames() has %d names; facts/facts.go declares %d", len(KnownFactNames()), len(consts))
+	}
+}
+
+// exportedConsts parses the Go source file at path and returns the value of
+// each exported string constant it declares, keyed by name.  Each constant's
+// value must be a string literal, a reference to an identifier in idents (or an
+// earlier constant in the file), or a sum of these.
+func exportedConsts(t *testing.T, path string, idents map[string]string) map[string]string {
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+	if err != nil {
+		t.Fatalf("Error parsing %s: %v", path, err)
+	}
+
+	vals := make(map[string]string)
+	for name, val := range idents {
+		vals[name] = val
+	}
+	var eval func(ast.Expr) string
+	eval = func(e ast.Expr) string {
+		switch e := e.(type) {
+		case *ast.BasicLit:
+			if s, err := strconv.Unquote(e.Value); err == nil {
+				return s
+			}
+		case *ast.Ident:
+			if val, ok := vals[e.Name]; ok {
+				return val
+			}
+		case *ast.SelectorExpr:
+			if x, ok := e.X.(*ast.Ident); ok {
+				if val, ok := vals[x.Name+"."+e.Sel.Name]; ok {
+					return val
+				}
+			}
+		case *ast.BinaryExpr:
+			if e.Op == token.ADD {
+				return eval(e.X) + eval(e.Y)
+			}
+		}
+		t.Fatalf("Unsupported constant expression in %s: %#v", path, e)
+		return ""
+	}
+
+	exported := make(map[string]string)
+	for _, decl := range f.Decls {
+		if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.CONST {
+			for _, spec := range gd.Specs {
+				vs := spec.(*ast.ValueSpec)
+				for i, name := range vs.Names {
+					vals[name.Name] = eval(vs.Values[i])
+					if name.IsExported() {
+						exported[name.Name] = vals[name.Name]
+					}
+				}
+			}
+		}
+	}
+	return exported
+}
+
+func TestFactNamespace(t *testing.T) {
+	tests := []struct {
+		fact, namespace string
+	}{
+		// Language-specific facts
+		{"/kythe/go/package", "go"},
+		{"/kythe/java/annotation/name", "java"},
+
+		// Cross-language facts
+		{facts.NodeKind, ""},
+		{facts.AnchorStart, ""},
+		{facts.TextEncoding, ""},
+
+		// Unexpected structure
+		{"", ""},
+		{"/kythe/", ""},
+		{"/kythe/lonely", ""},
+		{"/kythe//name", ""},
+		{"/kythe/go/", ""},
+		{"/other/go/package", ""},
+	}
+	for _, test := range tests {
+		if found := FactNamespace(test.fact); found != test.namespace {
+			t.Errorf("FactNamespace(%q) = %q; want %q", test.fact, found, test.namespace)
+		}
+	}
+}